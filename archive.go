@@ -0,0 +1,583 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"./libs/filippo.io/age"
+	"./libs/golang.org/x/crypto/openpgp"
+	"./libs/golang.org/x/crypto/openpgp/packet"
+)
+
+// archive is built in process: tar -> xz -> gpg, the result is the same
+// format the command line tools produce, so it can be restored by hand:
+//   gpg -d archive.bin | xz -d | tar x
+// or with age if it is encrypted to recipients:
+//   age -d -i key.txt archive.bin | xz -d | tar x
+
+// the first line of age file
+const ageHeader = "age-encryption.org/v1"
+
+// pipeline stages as they are reported
+const (
+	stageTar         = "tar"
+	stageCompression = "compression"
+	stageEncryption  = "encryption"
+	stageOutput      = "output"
+	stageInput       = "input"
+)
+
+// failure of a single pipeline stage
+type StageError struct {
+	stage string
+	err   error
+}
+
+func (this *StageError) Error() string {
+	return this.stage + ": " + this.err.Error()
+}
+
+func (this *StageError) Unwrap() error {
+	return this.err
+}
+
+//------------------------------------------------------------------------------
+// errors coming from the stages further down the pipe keep their stage
+func stageFailure(stage string, err error) error {
+	var stageErr *StageError
+	if err == nil || errors.As(err, &stageErr) {
+		return err
+	}
+	return &StageError{stage, err}
+}
+
+//------------------------------------------------------------------------------
+// stage of the error, empty if it did not come from the pipeline
+func stageOf(err error) string {
+	var stageErr *StageError
+	if errors.As(err, &stageErr) {
+		return stageErr.stage
+	}
+	return ""
+}
+
+// marks write errors with the stage
+type stageWriter struct {
+	stage  string
+	writer io.Writer
+}
+
+func (this stageWriter) Write(p []byte) (int, error) {
+	n, err := this.writer.Write(p)
+	return n, stageFailure(this.stage, err)
+}
+
+// marks read errors with the stage, EOF is passed as is
+type stageReader struct {
+	stage  string
+	reader io.Reader
+}
+
+func (this stageReader) Read(p []byte) (int, error) {
+	n, err := this.reader.Read(p)
+	if err == io.EOF {
+		return n, err
+	}
+	return n, stageFailure(this.stage, err)
+}
+
+//------------------------------------------------------------------------------
+// tar --exclude semantic: pattern matches the name or any of its tails
+func isExcluded(patterns []string, name string) bool {
+	var parts = strings.Split(name, "/")
+	for _, pattern := range patterns {
+		for index := range parts {
+			if ok, _ := path.Match(pattern, strings.Join(parts[index:], "/")); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//------------------------------------------------------------------------------
+// file content, a file shrunk while being read is padded with zeros
+// as tar does
+func writeTarFile(ctx context.Context, writer io.Writer, fileName string, size int64) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	n, err := io.CopyN(writer, contextReader{ctx, file}, size)
+	if err == io.EOF {
+		log.Printf("%s changed while reading, padded\n", fileName)
+		_, err = io.CopyN(writer, zeroReader{}, size - n)
+	}
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for index := range p {
+		p[index] = 0
+	}
+	return len(p), nil
+}
+
+//------------------------------------------------------------------------------
+// calls action for every entry of item.path not excluded, names are relative
+// to its parent directory as they are stored in tar
+func walkSource(ctx context.Context, item *PathItem,
+	action func(name string, fileName string, fi os.FileInfo) error) error {
+	var parent = filepath.Dir(item.path)
+
+	return filepath.Walk(item.path, func(fileName string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// removed after being listed
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		name, err := filepath.Rel(parent, fileName)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		if isExcluded(item.exclude, name) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.Mode() & os.ModeSocket != 0 {
+			return nil
+		}
+		return action(name, fileName, fi)
+	})
+}
+
+//------------------------------------------------------------------------------
+// tar stream of item.path, only changed entries and the list of deleted ones
+// for incremental backup; hash gets the same stream with zero mtimes
+// (as tar --mtime=0), so touching files does not change it
+func writeTar(ctx context.Context, item *PathItem, output io.Writer, hash io.Writer) error {
+	var writer = tar.NewWriter(output)
+	var shadow = tar.NewWriter(hash)
+
+	var err error
+	if item.delta != nil {
+		if err = writeDeleted(writer, item.delta.deleted); err == nil {
+			err = writeDeleted(shadow, item.delta.deleted)
+		}
+	}
+	if err == nil {
+		err = walkSource(ctx, item, func(name string, fileName string, fi os.FileInfo) error {
+			if item.delta != nil && !item.delta.changed[name] {
+				return nil
+			}
+			var link string
+			var err error
+			if fi.Mode() & os.ModeSymlink != 0 {
+				if link, err = os.Readlink(fileName); err != nil {
+					return err
+				}
+			}
+			header, err := tar.FileInfoHeader(fi, link)
+			if err != nil {
+				return err
+			}
+			header.Name = name
+			if fi.IsDir() {
+				header.Name += "/"
+			}
+			var shadowHeader = *header
+			shadowHeader.ModTime = time.Unix(0, 0)
+			if err = writer.WriteHeader(header); err != nil {
+				return err
+			}
+			if err = shadow.WriteHeader(&shadowHeader); err != nil {
+				return err
+			}
+			if header.Typeflag == tar.TypeReg {
+				return writeTarFile(ctx, io.MultiWriter(writer, shadow), fileName, header.Size)
+			}
+			return nil
+		})
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = shadow.Close()
+	}
+	return stageFailure(stageTar, err)
+}
+
+//------------------------------------------------------------------------------
+// age public keys (age1...) or files with them, one per line
+func loadRecipients(list []string) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	for _, value := range list {
+		if strings.HasPrefix(value, "age1") {
+			recipient, err := age.ParseX25519Recipient(value)
+			if err != nil {
+				return nil, err
+			}
+			recipients = append(recipients, recipient)
+			continue
+		}
+		file, err := os.Open(normalizePathNoCheck(value))
+		if err != nil {
+			return nil, err
+		}
+		parsed, err := age.ParseRecipients(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", value, err)
+		}
+		recipients = append(recipients, parsed...)
+	}
+	return recipients, nil
+}
+
+//------------------------------------------------------------------------------
+// private keys as age-keygen writes them, needed for restore only
+func loadIdentities(fileName string) ([]age.Identity, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return age.ParseIdentities(file)
+}
+
+//------------------------------------------------------------------------------
+// OpenPGP message starts with a session key packet (public key or symmetric),
+// age file with its header line
+func isEncrypted(header []byte) bool {
+	if bytes.HasPrefix(header, []byte(ageHeader)) {
+		return true
+	}
+	if len(header) == 0 || header[0] & 0x80 == 0 {
+		return false
+	}
+	var tag = header[0] & 0x3f
+	if header[0] & 0x40 == 0 {
+		// old packet format
+		tag >>= 2
+	}
+	return tag == 1 || tag == 3
+}
+
+//------------------------------------------------------------------------------
+// age to recipients if there are any, otherwise the same as gpg -z 0 -c:
+// symmetric encryption without compression
+func encryptWriter(output io.Writer, recipients []age.Recipient,
+	password string) (io.WriteCloser, error) {
+	if len(recipients) > 0 {
+		return age.Encrypt(output, recipients...)
+	}
+	var config = packet.Config{
+		DefaultCipher:          packet.CipherAES256,
+		DefaultCompressionAlgo: packet.CompressionNone,
+	}
+	return openpgp.SymmetricallyEncrypt(output, []byte(password),
+		&openpgp.FileHints{IsBinary: true}, &config)
+}
+
+//------------------------------------------------------------------------------
+// format is detected, integrity is checked when the body is read to the end
+func decryptReader(input io.Reader, options Options) (io.Reader, error) {
+	var buffered = bufio.NewReader(input)
+	if header, _ := buffered.Peek(len(ageHeader)); string(header) == ageHeader {
+		var identities = decryptionIdentities(options)
+		if len(identities) == 0 {
+			return nil, errors.New("identity-file or password is needed to decrypt")
+		}
+		return age.Decrypt(buffered, identities...)
+	}
+	input = buffered
+
+	var password = options.password
+	var prompted bool
+	var prompt = func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		// asked again if the password does not fit
+		if prompted {
+			return nil, errors.New("wrong password")
+		}
+		prompted = true
+		return []byte(password), nil
+	}
+	details, err := openpgp.ReadMessage(input, nil, prompt, nil)
+	if err != nil {
+		return nil, err
+	}
+	return details.UnverifiedBody, nil
+}
+
+//------------------------------------------------------------------------------
+// writes archive of the item to output,
+// returns md5 of the tar stream without mtimes to detect changes
+func writeArchive(ctx context.Context, item *PathItem, options Options,
+	output io.Writer) (string, error) {
+	var writer io.Writer = stageWriter{stageOutput, output}
+
+	var encryptor io.WriteCloser
+	if item.encryption {
+		recipients, err := encryptionRecipients(item.recipients, options, false)
+		if err == nil {
+			encryptor, err = encryptWriter(writer, recipients, options.password)
+		}
+		if err != nil {
+			return "", stageFailure(stageEncryption, err)
+		}
+		writer = stageWriter{stageEncryption, encryptor}
+	}
+	compressor, err := compressWriter(writer, item.compression)
+	if err != nil {
+		return "", stageFailure(stageCompression, err)
+	}
+	if compressor != nil {
+		writer = stageWriter{stageCompression, compressor}
+	}
+
+	var hash = md5.New()
+	if err := writeTar(ctx, item, writer, hash); err != nil {
+		return "", err
+	}
+	// flush in the order of the pipe
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return "", stageFailure(stageCompression, err)
+		}
+	}
+	if encryptor != nil {
+		if err := encryptor.Close(); err != nil {
+			return "", stageFailure(stageEncryption, err)
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+//------------------------------------------------------------------------------
+// md5 of the tar stream, nothing is written
+func getSourceHash(ctx context.Context, item *PathItem) (string, error) {
+	var hash = md5.New()
+	if err := writeTar(ctx, item, ioutil.Discard, hash); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+//------------------------------------------------------------------------------
+// md5 of names, sizes, mtimes and modes of the entries: cheap check
+// for changes, content is not read
+func getFingerprint(ctx context.Context, item *PathItem) (string, error) {
+	var hash = md5.New()
+	err := walkSource(ctx, item, func(name string, fileName string, fi os.FileInfo) error {
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\x00%o\n",
+			name, fi.Size(), fi.ModTime().UnixNano(), uint32(fi.Mode()))
+		return nil
+	})
+	if err != nil {
+		return "", stageFailure(stageTar, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+//------------------------------------------------------------------------------
+// archive entries must stay inside the target directory
+func extractPath(dir string, name string) (string, error) {
+	var clean = filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == ".." ||
+		strings.HasPrefix(clean, ".." + string(filepath.Separator)) {
+		return "", errors.New("unsafe path in archive: " + name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+//------------------------------------------------------------------------------
+// entry is never written through a symlink under the target dir, e.g. one
+// restored from the archive just before (link -> /outside, then link/file)
+func checkParents(dir string, target string) error {
+	relative, err := filepath.Rel(dir, filepath.Dir(target))
+	if err != nil || relative == "." {
+		return err
+	}
+	var parent = dir
+	for _, name := range strings.Split(relative, string(filepath.Separator)) {
+		parent = filepath.Join(parent, name)
+		fi, err := os.Lstat(parent)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode() & os.ModeSymlink != 0 {
+			return errors.New("unsafe path in archive, symlink on the way: " + parent)
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+func extractFile(reader io.Reader, target string, mode os.FileMode) error {
+	// the place is cleared before, a link made there since is not followed
+	file, err := os.OpenFile(target, os.O_CREATE | os.O_EXCL | os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+//------------------------------------------------------------------------------
+// unpacks tar stream to the target, existing entries are handled by its
+// conflict policy
+func extractTar(ctx context.Context, input io.Reader, target *RestoreTarget) error {
+	var reader = tar.NewReader(input)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			return stageFailure(stageTar, err)
+		}
+		if header.Name == deletedEntry {
+			if err = applyDeleted(reader, target); err != nil {
+				return stageFailure(stageTar, err)
+			}
+			continue
+		}
+		// parents are restored with the first entry selected in them
+		if !target.included(header.Name) {
+			if header.Typeflag == tar.TypeDir {
+				target.pending[header.Name] = header
+			}
+			continue
+		}
+		if err = target.restoreParents(header.Name); err == nil {
+			err = extractEntry(reader, header, target)
+		}
+		if err != nil {
+			return stageFailure(stageTar, err)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func extractEntry(reader io.Reader, header *tar.Header, target *RestoreTarget) error {
+	_, restored := target.restored[header.Name]
+	fileName, err := target.place(header)
+	if err != nil || len(fileName) == 0 {
+		return err
+	}
+	var mode = header.FileInfo().Mode().Perm()
+	if err = os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return err
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		// existing directory keeps its attributes unless it is overwritten
+		if _, e := os.Lstat(fileName); os.IsNotExist(e) || restored ||
+			target.conflict == conflictOverwrite {
+			target.dirs[header.Name] = header
+		}
+		// owner has to be able to fill it
+		err = os.MkdirAll(fileName, mode | 0700)
+	case tar.TypeReg:
+		err = extractFile(reader, fileName, mode)
+	case tar.TypeSymlink:
+		err = os.Symlink(header.Linkname, fileName)
+	case tar.TypeLink:
+		var source string
+		if source, err = target.restoredPath(header.Linkname); err != nil {
+			return err
+		}
+		if err = checkParents(target.dir, source); err != nil {
+			return err
+		}
+		// source may be left out of partial restore
+		if _, e := os.Lstat(source); os.IsNotExist(e) {
+			log.Printf("%s: link target %s is not restored, skipped\n", header.Name, header.Linkname)
+			return nil
+		}
+		err = os.Link(source, fileName)
+	default:
+		log.Printf("%s: unsupported entry type, skipped\n", header.Name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	target.restored[header.Name] = fileName
+	// hard link shares attributes with its source
+	if header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeLink {
+		target.setAttributes(fileName, header)
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// reverse of writeArchive: tar stream of archive read from input is
+// passed to process, e.g. unpacked
+func readArchive(ctx context.Context, item PathItem, options Options,
+	input io.Reader, process func(io.Reader) error) error {
+	var buffered = bufio.NewReader(stageReader{stageInput, input})
+	var reader io.Reader = buffered
+
+	// archive may be made with other settings, e.g. on other host
+	if header, _ := buffered.Peek(len(ageHeader)); isEncrypted(header) {
+		decrypted, err := decryptReader(reader, options)
+		if err != nil {
+			return stageFailure(stageEncryption, err)
+		}
+		reader = stageReader{stageEncryption, decrypted}
+	} else if isArchiveEncryptionRequired(item, options) {
+		return stageFailure(stageEncryption, errNotEncrypted)
+	}
+	// compression is found by magic bytes as well
+	decompressed, err := decompressReader(reader)
+	if err != nil {
+		return stageFailure(stageCompression, err)
+	}
+	defer decompressed.Close()
+	reader = stageReader{stageCompression, decompressed}
+	if err := process(reader); err != nil {
+		return err
+	}
+	// tar stops at the end marker, the rest has to be read to check
+	// integrity of encrypted data
+	_, err = io.Copy(ioutil.Discard, reader)
+	return stageFailure(stageTar, err)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// files of the tree, content by relative name, dirs end with slash
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		var fileName = filepath.Join(dir, filepath.FromSlash(name))
+		var err error
+		if strings.HasSuffix(name, "/") {
+			err = os.MkdirAll(fileName, 0700)
+		} else if err = os.MkdirAll(filepath.Dir(fileName), 0700); err == nil {
+			err = ioutil.WriteFile(fileName, []byte(content), 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// content of the tree the way writeTree takes it, symlinks as "-> target"
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	var files = make(map[string]string)
+	err := filepath.Walk(dir, func(fileName string, fi os.FileInfo, err error) error {
+		if err != nil || fileName == dir {
+			return err
+		}
+		name, _ := filepath.Rel(dir, fileName)
+		name = filepath.ToSlash(name)
+		switch {
+		case fi.Mode() & os.ModeSymlink != 0:
+			link, err := os.Readlink(fileName)
+			files[name] = "-> " + link
+			return err
+		case fi.IsDir():
+			files[name + "/"] = ""
+		default:
+			data, err := ioutil.ReadFile(fileName)
+			files[name] = string(data)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+//------------------------------------------------------------------------------
+func checkTree(t *testing.T, dir string, expected map[string]string) {
+	t.Helper()
+	var files = readTree(t, dir)
+	for name, content := range expected {
+		if value, ok := files[name]; !ok || value != content {
+			t.Errorf("%s: %q, expected %q", name, value, content)
+		}
+	}
+	for name := range files {
+		if _, ok := expected[name]; !ok {
+			t.Errorf("%s is not expected", name)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// tar stream read by readArchive is unpacked to the dir
+func extractTo(ctx context.Context, dir string) func(io.Reader) error {
+	var target = newRestoreTarget(dir, conflictOverwrite)
+	return func(reader io.Reader) error {
+		return extractTar(ctx, reader, target)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestArchiveRoundTrip(t *testing.T) {
+	var tests = []struct {
+		encryption  bool
+		compression Compression
+	}{
+		{false, noCompression},
+		{false, fastCompression},
+		{true, noCompression},
+		{true, fastCompression},
+	}
+	var source = filepath.Join(t.TempDir(), "data")
+	writeTree(t, source, map[string]string{
+		"a.txt":       "a",
+		"sub/b.txt":   strings.Repeat("b", 100000),
+		"sub/c.log":   "excluded",
+		"cache/d.txt": "excluded",
+		"empty/":      "",
+	})
+	if err := os.Symlink("a.txt", filepath.Join(source, "link")); err != nil {
+		t.Fatal(err)
+	}
+	var options = Options{password: "secret"}
+	var ctx = context.Background()
+
+	for _, test := range tests {
+		var item = PathItem{path: source, exclude: []string{"*.log", "cache"},
+			encryption: test.encryption, noEncryption: !test.encryption, compression: test.compression}
+		var archive bytes.Buffer
+		hash, err := writeArchive(ctx, &item, options, &archive)
+		if err != nil {
+			t.Fatalf("%+v: write: %v", test, err)
+		}
+		if sourceHash, err := getSourceHash(ctx, &item); err != nil || sourceHash != hash {
+			t.Fatalf("%+v: source hash %s %v, archive hash %s", test, sourceHash, err, hash)
+		}
+		var plain = bytes.Contains(archive.Bytes(), []byte("bbbbbbbb"))
+		if plain == (test.encryption || test.compression != noCompression) {
+			t.Fatalf("%+v: content is plain: %v", test, plain)
+		}
+
+		var target = t.TempDir()
+		if err = readArchive(ctx, item, options, bytes.NewReader(archive.Bytes()),
+			extractTo(ctx, target)); err != nil {
+			t.Fatalf("%+v: read: %v", test, err)
+		}
+		checkTree(t, target, map[string]string{
+			"data/":          "",
+			"data/a.txt":     "a",
+			"data/sub/":      "",
+			"data/sub/b.txt": strings.Repeat("b", 100000),
+			"data/empty/":    "",
+			"data/link":      "-> a.txt",
+		})
+
+		if test.encryption {
+			var wrong = options
+			wrong.password = "wrong"
+			err = readArchive(ctx, item, wrong, bytes.NewReader(archive.Bytes()),
+				extractTo(ctx, t.TempDir()))
+			if stageOf(err) != stageEncryption {
+				t.Fatalf("%+v: wrong password: %v", test, err)
+			}
+			// damaged data is found when the body is read to the end
+			var damaged = append([]byte{}, archive.Bytes()...)
+			damaged[len(damaged) - 30] ^= 1
+			if err = readArchive(ctx, item, options, bytes.NewReader(damaged),
+				extractTo(ctx, t.TempDir())); err == nil {
+				t.Fatalf("%+v: damaged archive is accepted", test)
+			}
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// the hash does not depend on mtime but on content
+func TestSourceHash(t *testing.T) {
+	var source = t.TempDir()
+	writeTree(t, source, map[string]string{"a.txt": "a"})
+	var item = PathItem{path: source}
+	var ctx = context.Background()
+	first, err := getSourceHash(ctx, &item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fileName = filepath.Join(source, "a.txt")
+	os.Chtimes(fileName, time.Now(), time.Now().Add(time.Hour))
+	if hash, _ := getSourceHash(ctx, &item); hash != first {
+		t.Fatal("touch changes the hash")
+	}
+	ioutil.WriteFile(fileName, []byte("b"), 0600)
+	if hash, _ := getSourceHash(ctx, &item); hash == first {
+		t.Fatal("new content keeps the hash")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err = getSourceHash(ctx, &item); stageOf(err) != stageTar {
+		t.Fatalf("cancelled: %v", err)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestIsExcluded(t *testing.T) {
+	var tests = []struct {
+		patterns []string
+		name     string
+		excluded bool
+	}{
+		{[]string{"*.log"}, "data/a.log", true},
+		{[]string{"*.log"}, "data/sub/a.log", true},
+		{[]string{"*.log"}, "data/a.txt", false},
+		{[]string{"cache"}, "data/cache", true},
+		{[]string{"sub/cache"}, "data/sub/cache", true},
+		{[]string{"sub/cache"}, "data/cache", false},
+		{[]string{"data"}, "data", true},
+		{nil, "data", false},
+	}
+	for _, test := range tests {
+		if excluded := isExcluded(test.patterns, test.name); excluded != test.excluded {
+			t.Errorf("%v %s: %v", test.patterns, test.name, excluded)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestExtractPath(t *testing.T) {
+	var tests = []struct {
+		name   string
+		target string
+	}{
+		{"a/b", "/dir/a/b"},
+		{"a/../b", "/dir/b"},
+		{"./a", "/dir/a"},
+		{"a/", "/dir/a"},
+		{"..", ""},
+		{"../a", ""},
+		{"a/../../b", ""},
+		{"/etc/passwd", ""},
+	}
+	for _, test := range tests {
+		target, err := extractPath("/dir", test.name)
+		if target != test.target || (err != nil) != (len(test.target) == 0) {
+			t.Errorf("%s: %s %v", test.name, target, err)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// entries leading out of the target are refused
+func TestExtractTarUnsafe(t *testing.T) {
+	var archive bytes.Buffer
+	var writer = tar.NewWriter(&archive)
+	writer.WriteHeader(&tar.Header{Name: "data/a.txt", Mode: 0600, Size: 1, Typeflag: tar.TypeReg})
+	writer.Write([]byte("a"))
+	writer.WriteHeader(&tar.Header{Name: "data/../../escape.txt", Mode: 0600, Size: 1,
+		Typeflag: tar.TypeReg})
+	writer.Write([]byte("e"))
+	writer.Close()
+
+	var dir = t.TempDir()
+	var target = filepath.Join(dir, "target")
+	var err = extractTar(context.Background(), &archive, newRestoreTarget(target, conflictOverwrite))
+	if err == nil || stageOf(err) != stageTar {
+		t.Fatalf("unsafe entry: %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dir, "escape.txt")); !os.IsNotExist(err) {
+		t.Fatalf("file out of target: %v", err)
+	}
+}
+
+//------------------------------------------------------------------------------
+// names, sizes, mtimes and modes are in the fingerprint, content is not
+func TestFingerprint(t *testing.T) {
+	var source = t.TempDir()
+	writeTree(t, source, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+	var item = PathItem{path: source}
+	var ctx = context.Background()
+	var fileName = filepath.Join(source, "a.txt")
+	var date = time.Date(2024, 5, 10, 20, 30, 0, 0, time.UTC)
+	os.Chtimes(fileName, date, date)
+	first, err := getFingerprint(ctx, &item)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		what    string
+		change  func()
+		changed bool
+	}{
+		{"nothing", func() {}, false},
+		{"content", func() {
+			ioutil.WriteFile(fileName, []byte("b"), 0600)
+			os.Chtimes(fileName, date, date)
+		}, false},
+		{"mtime", func() { os.Chtimes(fileName, date, date.Add(time.Second)) }, true},
+		{"size", func() {
+			ioutil.WriteFile(fileName, []byte("bb"), 0600)
+			os.Chtimes(fileName, date, date)
+		}, true},
+		{"mode", func() { os.Chmod(fileName, 0640) }, true},
+		{"new file", func() { writeTree(t, source, map[string]string{"sub/c.txt": ""}) }, true},
+		{"dir mtime", func() { os.Chtimes(source, date, date) }, true},
+		{"excluded file", func() {
+			item.exclude = []string{"*.log"}
+			writeTree(t, source, map[string]string{"d.log": ""})
+			// mtime of the dir is in the fingerprint
+			os.Chtimes(source, date, date)
+		}, false},
+	}
+	for _, test := range tests {
+		test.change()
+		fingerprint, err := getFingerprint(ctx, &item)
+		if err != nil || (fingerprint != first) != test.changed {
+			t.Errorf("%s: changed %v %v", test.what, fingerprint != first, err)
+		}
+		first = fingerprint
+	}
+}
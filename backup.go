@@ -8,7 +8,7 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
@@ -22,13 +22,19 @@ import (
 	"time"
 	"errors"
 
-	"./libs/ext-logger"
+	"./libs/filippo.io/age"
 	"./libs/github.com/go-ini/ini"
 	"./libs/github.com/cloudfoundry/bytefmt"
 )
 
 const configFile = "cloud-backup.ini"
 
+// upload is repeated on temporary cloud failures
+const (
+	uploadAttempts   = 3
+	uploadRetryDelay = 10 * time.Second
+)
+
 const (
 	Once    = iota
 	Dayly   = iota
@@ -40,15 +46,34 @@ type PathItem struct {
 	path        string
 	exclude     []string
 	pathHash    string
+	hostId      string		// of the host the versions are made by
 	encryption  bool
-	compression bool
+	noEncryption bool		// turned off for the path, plain archives are expected
+	compression Compression
 	dataHash    string
 	schedule    int
+	cron        *CronSchedule	// replaces schedule if set
+	every       time.Duration	// interval, replaces schedule if set
+	maxDelay    time.Duration	// missed backup is not caught up later than that
 	date        time.Time
 	archive     string		// base name
 	archiveSize int64
 	upload      bool
+	streaming   bool
+	retention   Retention
+	versions    []string	// archive names, kept for clouds that cannot list
+	failDate    time.Time	// last failed backup, zero after a good one
+	failError   string
+	incremental bool
+	fullInterval time.Duration
+	manifest    Manifest	// source state for the next delta
+	delta       *Delta		// nil for full archive
+	repository  bool		// chunks and snapshots instead of archives
+	fingerprint string		// names, sizes and mtimes at the last backup
+	paranoid    bool		// source content is always compared
+	recipients  []age.Recipient	// public keys to encrypt to instead of password
 	cloud 		Cloud
+	cloudPath   string		// remote folder, with trailing slash
 }
 
 type Options struct {
@@ -56,11 +81,36 @@ type Options struct {
 	stateFile   string
 	workingPath string
 	password    string
+	encryptionFormat string
+	recipients  []age.Recipient
+	identities  []age.Identity
 	weeklyDays  []int
 	monthlyDays []int
 	cloudName	string
 	cloudPath	string
-	level		int
+	webdavURL	string
+	webdavUser	string
+	webdavPassword	string
+	s3Endpoint	string
+	s3Bucket	string
+	s3Region	string
+	s3AccessKey	string
+	s3SecretKey	string
+	localDir	string
+	sftpHost	string
+	sftpPort	int
+	sftpUser	string
+	sftpKeyFile	string
+	sftpKnownHosts	string
+	rcloneRemote	string
+	rcloneConfig	string
+	compression	Compression
+	streaming	bool
+	repository	bool
+	paranoid	bool
+	maxDelay	time.Duration
+	retention	Retention
+	fullInterval	time.Duration
 	verbose		bool
 }
 
@@ -72,26 +122,80 @@ func changeDirectory(path string) {
 
 //------------------------------------------------------------------------------
 func checkCommandExists(command string) bool {
-	cmd := exec.Command("sh", "-c", "hash " + command)
-	return cmd.Run() == nil
+	_, err := exec.LookPath(command)
+	return err == nil
 }
 
 //------------------------------------------------------------------------------
-func normalizePath(path string) string {
-	cmd := exec.Command("sh", "-c", "realpath " + path)
-	output, _ := cmd.Output()
-	path = strings.Trim(string(output), "\r\n")
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		log.Fatalf("path %s not exists\n", path)
+// working dir is needed by every command but recover
+func checkWorkingPath(options Options) error {
+	if len(options.workingPath) == 0 {
+		return errors.New("working path is not specified")
 	}
-	return path
+	if _, err := os.Stat(options.workingPath); os.IsNotExist(err) {
+		return fmt.Errorf("path %s not exists", options.workingPath)
+	}
+	return nil
 }
 
 //------------------------------------------------------------------------------
+// source path of config may be missing, e.g. to be restored
+func sourcePath(path string) (string, error) {
+	if normalized := normalizePathNoCheck(path); len(normalized) > 0 {
+		return normalized, nil
+	}
+	if expanded := os.ExpandEnv(path); filepath.IsAbs(expanded) {
+		return filepath.Clean(expanded), nil
+	}
+	return "", fmt.Errorf("bad path %s", path)
+}
+
+//------------------------------------------------------------------------------
+// configured paths the command line argument names, missing ones as well
+func selectPaths(paths []PathItem, path string) []PathItem {
+	normalized, err := sourcePath(path)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	var result []PathItem
+	for _, item := range paths {
+		if item.path == normalized {
+			result = append(result, item)
+		}
+	}
+	if len(result) == 0 {
+		log.Fatalf("path %s is not in config\n", normalized)
+	}
+	return result
+}
+
+//------------------------------------------------------------------------------
+// the same as realpath in shell: ~ and variables expanded, symlinks resolved,
+// empty if the path is not valid
 func normalizePathNoCheck(path string) string {
-	cmd := exec.Command("sh", "-c", "realpath " + path)
-	output, _ := cmd.Output()
-	return strings.Trim(string(output), "\r\n")
+	path = os.ExpandEnv(path)
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		path = home + path[1:]
+	}
+	if len(path) == 0 {
+		return ""
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	// realpath accepts missing last component only
+	if _, err := os.Stat(filepath.Dir(path)); err != nil {
+		return ""
+	}
+	return path
 }
 
 //------------------------------------------------------------------------------
@@ -128,6 +232,23 @@ func getList(input string, sep string) []string {
 	return result
 }
 
+//------------------------------------------------------------------------------
+func cloudDir(path string) string {
+	if len(path) != 0 && path[len(path) - 1] != '/' {
+		path += "/"
+	}
+	return path
+}
+
+//------------------------------------------------------------------------------
+func isYes(value string) bool {
+	switch strings.ToLower(value) {
+	case "yes", "true", "on", "1":
+		return true
+	}
+	return false
+}
+
 //------------------------------------------------------------------------------
 func readDays(days []string) ([]int, error) {
 	var result []int
@@ -153,14 +274,31 @@ func loadOptions(values map[string]string) (Options, error) {
 
 	options.logFile = normalizePathNoCheck(values["log-file"])
 	options.stateFile = normalizePathNoCheck(values["state-file"])
-	options.workingPath = normalizePath(values["working-dir"])
-
-	if len(options.workingPath) == 0 {
-		log.Fatalln("working path is not specified")
+	// may be missing, recover creates it
+	if len(values["working-dir"]) > 0 {
+		if options.workingPath, err = sourcePath(values["working-dir"]); err != nil {
+			return options, err
+		}
+		options.workingPath += "/"
 	}
-	options.workingPath += "/"
 
 	options.password = values["password"]
+	options.encryptionFormat = encryptionGpg
+	if len(values["encryption-format"]) > 0 {
+		options.encryptionFormat = values["encryption-format"]
+	}
+	if options.encryptionFormat != encryptionGpg && options.encryptionFormat != encryptionAge {
+		return options, errors.New("bad encryption-format value")
+	}
+	if options.recipients, err = loadRecipients(getList(values["recipients"], ",")); err != nil {
+		return options, fmt.Errorf("bad recipients: %v", err)
+	}
+	if len(values["identity-file"]) > 0 {
+		options.identities, err = loadIdentities(normalizePathNoCheck(values["identity-file"]))
+		if err != nil {
+			return options, fmt.Errorf("bad identity file: %v", err)
+		}
+	}
 
 	var days []string
 	days = getList(values["monthly"], ",")
@@ -171,18 +309,82 @@ func loadOptions(values map[string]string) (Options, error) {
 	days = getList(values["weekly"], ",")
 	options.weeklyDays, err = readDays(days)
 
-	options.level = 2
+	options.compression = Compression{compressionXz, -1}
+	if len(values["compression"]) > 0 {
+		if options.compression, err = parseCompression(values["compression"]); err != nil {
+			return options, fmt.Errorf("bad compression: %v", err)
+		}
+	}
+	// level of the old configs, for xz
 	if len(values["compression-level"]) > 0 {
-		options.level,_ = strconv.Atoi(values["compression-level"])
-		if options.level < 0 || options.level > 9 {
-			log.Fatalln("bad compression level value")
+		options.compression.level, _ = strconv.Atoi(values["compression-level"])
+		if _, err = parseCompression(options.compression.String()); err != nil {
+			return options, errors.New("bad compression level value")
 		}
 	}
 	
+	options.streaming = isYes(values["streaming"])
+	options.repository = isYes(values["repository"])
+	options.paranoid = isYes(values["paranoid"])
+	if options.retention, err = loadRetention(values); err != nil {
+		return options, err
+	}
+
+	options.fullInterval = defaultFullInterval
+	if len(values["full-interval"]) > 0 {
+		days, err := strconv.Atoi(values["full-interval"])
+		if err != nil || days < 0 {
+			return options, errors.New("bad full-interval value")
+		}
+		options.fullInterval = time.Duration(days) * 24 * time.Hour
+	}
+
+	if len(values["max-delay"]) > 0 {
+		if options.maxDelay, err = parseInterval(values["max-delay"]); err != nil {
+			return options, fmt.Errorf("bad max-delay value: %v", err)
+		}
+	}
+
 	options.cloudName = values["cloud"]
-	options.cloudPath = values["cloud-dir"]
-	if len(options.cloudPath) != 0 && options.cloudPath[len(options.cloudPath) - 1] != '/' {
-		options.cloudPath += "/";
+	options.cloudPath = cloudDir(values["cloud-dir"])
+
+	options.webdavURL = values["webdav-url"]
+	options.webdavUser = values["webdav-user"]
+	options.webdavPassword = values["webdav-password"]
+
+	options.s3Endpoint = values["s3-endpoint"]
+	options.s3Bucket = values["s3-bucket"]
+	options.s3Region = values["s3-region"]
+	options.s3AccessKey = values["s3-access-key"]
+	options.s3SecretKey = values["s3-secret-key"]
+
+	if len(values["local-dir"]) > 0 {
+		options.localDir = normalizePathNoCheck(values["local-dir"])
+	}
+
+	options.sftpHost = values["sftp-host"]
+	options.sftpPort = 22
+	if len(values["sftp-port"]) > 0 {
+		if options.sftpPort, err = strconv.Atoi(values["sftp-port"]); err != nil {
+			return options, errors.New("bad sftp port value")
+		}
+	}
+	options.sftpUser = values["sftp-user"]
+	if len(options.sftpUser) == 0 {
+		options.sftpUser = os.Getenv("USER")
+	}
+	if len(values["sftp-key-file"]) > 0 {
+		options.sftpKeyFile = normalizePathNoCheck(values["sftp-key-file"])
+	}
+	options.sftpKnownHosts = values["sftp-known-hosts"]
+	if len(options.sftpKnownHosts) == 0 {
+		options.sftpKnownHosts = "~/.ssh/known_hosts"
+	}
+	options.sftpKnownHosts = normalizePathNoCheck(options.sftpKnownHosts)
+
+	options.rcloneRemote = strings.TrimRight(values["rclone-remote"], ":")
+	if len(values["rclone-config"]) > 0 {
+		options.rcloneConfig = normalizePathNoCheck(values["rclone-config"])
 	}
 	return options, err
 }
@@ -192,41 +394,291 @@ func loadPaths(values map[string]string, options Options) ([]PathItem, error) {
 	var list []PathItem
 
 	for path, value := range values {
-		var item PathItem
-		item.path = normalizePath(path)
-		item.pathHash = getStrHash(path)
-		item.archive = item.pathHash + ".bin"
-		item.compression = true
-		item.encryption = len(options.password) > 0
+		item, err := newPathItem(path, options)
+		if err != nil {
+			return nil, err
+		}
+
+		// own retention rules replace the global ones
+		var retention Retention
+		var ownRetention bool
+		var noEncryption bool
+		var ownRecipients bool
 
 		for _, opt := range getList(value, ",") {
 			switch opt {
-			case "once":
-				item.schedule = Once
-			case "dayly":
-				item.schedule = Dayly
-			case "weekly":
-				item.schedule = Weekly
-			case "monthly":
-				item.schedule = Monthly
+			case "once", "dayly", "weekly", "monthly":
+				item.schedule, _ = parseSchedule(opt)
 			case "no-compression":
-				item.compression = false
+				item.compression = Compression{compressionNone, -1}
 			case "no-encryption":
-				item.encryption = false
+				noEncryption = true
+			case "streaming":
+				item.streaming = true
+			case "no-streaming":
+				item.streaming = false
+			case "incremental":
+				item.incremental = true
+			case "repository":
+				item.repository = true
+			case "no-repository":
+				item.repository = false
+			case "paranoid":
+				item.paranoid = true
+			case "no-paranoid":
+				item.paranoid = false
 			default:
+				if strings.Index(opt, "full-interval=") == 0 {
+					days, err := strconv.Atoi(opt[len("full-interval="):])
+					if err != nil || days < 0 {
+						return nil, fmt.Errorf("bad value of %s, path %s", opt, path)
+					}
+					item.fullInterval = time.Duration(days) * 24 * time.Hour
+					break
+				}
+				if strings.Index(opt, "every=") == 0 {
+					var err error
+					if item.every, err = parseInterval(opt[len("every="):]); err != nil {
+						return nil, fmt.Errorf("%v, path %s", err, path)
+					}
+					break
+				}
+				if strings.Index(opt, "max-delay=") == 0 {
+					var err error
+					if item.maxDelay, err = parseInterval(opt[len("max-delay="):]); err != nil {
+						return nil, fmt.Errorf("%v, path %s", err, path)
+					}
+					break
+				}
+				if strings.Index(opt, "compression=") == 0 {
+					var err error
+					item.compression, err = parseCompression(opt[len("compression="):])
+					if err != nil {
+						return nil, fmt.Errorf("bad compression: %v, path %s", err, path)
+					}
+					break
+				}
+				if strings.Index(opt, "recipients=") == 0 {
+					var err error
+					item.recipients, err = loadRecipients(getList(opt[len("recipients="):], ":"))
+					if err != nil {
+						return nil, fmt.Errorf("bad recipients: %v, path %s", err, path)
+					}
+					ownRecipients = true
+					break
+				}
 				if strings.Index(opt, "exclude:") == 0 {
 					item.exclude = getList(opt[len("exclude:"):], ":")
 					break
 				}
-				if item.cloud = getCloudByName(opt); item.cloud == nil {
-					log.Fatalf("unknown option %s, path %s \n", opt, path)
+				if ok, err := parseRetentionOption(&retention, opt); ok {
+					if err != nil {
+						return nil, fmt.Errorf("%v, path %s", err, path)
+					}
+					ownRetention = true
+					break
+				}
+				if item.cloud, err = getCloudByName(opt, options); err != nil {
+					return nil, fmt.Errorf("%v, path %s", err, path)
+				}
+				if item.cloud == nil {
+					return nil, fmt.Errorf("unknown option %s, path %s", opt, path)
 				}
 			}
 		}
-		
+		if ownRetention {
+			item.retention = retention
+		}
+		if !noEncryption {
+			item.encryption = len(options.password) > 0 || len(item.recipients) > 0
+		}
+		item.noEncryption = noEncryption
+		if err := checkRepositoryKeys(item, ownRecipients, options); err != nil {
+			return nil, fmt.Errorf("%v, path %s", err, path)
+		}
+
 		if item.cloud == nil {
-			if item.cloud = getCloudByName(options.cloudName); item.cloud == nil {
-				log.Fatalf("cloud name for path %s not specified\n", path);
+			if item.cloud, err = getCloudByName(options.cloudName, options); err != nil {
+				return nil, err
+			}
+			if item.cloud == nil {
+				return nil, fmt.Errorf("cloud name for path %s not specified", path)
+			}
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
+
+//------------------------------------------------------------------------------
+// chunks are shared by all paths of the cloud dir, so repository is encrypted
+// with the global password and recipients only
+func checkRepositoryKeys(item PathItem, ownRecipients bool, options Options) error {
+	if !item.repository {
+		return nil
+	}
+	if ownRecipients {
+		return errors.New("repository cannot use own recipients, set them globally")
+	}
+	if item.encryption != isRepositoryEncrypted(options) {
+		return errors.New("repository cannot change encryption, it follows the global keys")
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// path with the global settings, its own options override them
+func newPathItem(path string, options Options) (PathItem, error) {
+	var item PathItem
+	var err error
+	if item.path, err = sourcePath(path); err != nil {
+		return item, err
+	}
+	item.pathHash = getStrHash(path)
+	item.hostId = hostId(hostName())
+	item.compression = options.compression
+	item.recipients = options.recipients
+	item.streaming = options.streaming
+	item.repository = options.repository
+	item.paranoid = options.paranoid
+	item.retention = options.retention
+	item.fullInterval = options.fullInterval
+	item.cloudPath = options.cloudPath
+	item.maxDelay = options.maxDelay
+	return item, nil
+}
+
+//------------------------------------------------------------------------------
+func parseSchedule(value string) (int, error) {
+	switch value {
+	case "once":
+		return Once, nil
+	case "dayly", "daily":
+		return Dayly, nil
+	case "weekly":
+		return Weekly, nil
+	case "monthly":
+		return Monthly, nil
+	}
+	return Once, fmt.Errorf("unknown schedule %s", value)
+}
+
+//------------------------------------------------------------------------------
+// name of [path "name"] or [path.name] section, false for other sections
+func pathSectionName(section string) (string, bool) {
+	if strings.HasPrefix(section, "path.") {
+		return section[len("path."):], len(section) > len("path.")
+	}
+	var name = strings.TrimSpace(strings.TrimPrefix(section, "path"))
+	if name == section || len(name) < 3 || name[0] != '"' || name[len(name) - 1] != '"' {
+		return "", false
+	}
+	return name[1:len(name) - 1], true
+}
+
+//------------------------------------------------------------------------------
+// paths configured by sections, one per path, so values may have any
+// characters; keys are named as the options of [paths]
+func loadPathSections(sections []*ini.Section, options Options) ([]PathItem, error) {
+	var list []PathItem
+
+	for _, section := range sections {
+		if _, ok := pathSectionName(section.Name()); !ok {
+			continue
+		}
+		var values = section.KeysHash()
+		if len(values["source"]) == 0 {
+			return nil, fmt.Errorf("source is not set in section [%s]", section.Name())
+		}
+		item, err := newPathItem(values["source"], options)
+		if err != nil {
+			return nil, fmt.Errorf("%v in section [%s]", err, section.Name())
+		}
+		var retention Retention
+		var ownRetention bool
+		var ownRecipients bool
+		var encryption = "auto"
+
+		for _, key := range section.KeyStrings() {
+			var value = values[key]
+			var err error
+			switch key {
+			case "source":
+			case "schedule":
+				// cron expression unless it is a period
+				if item.schedule, err = parseSchedule(value); err != nil {
+					item.cron, err = parseCron(value)
+				}
+			case "every":
+				item.every, err = parseInterval(value)
+			case "max-delay":
+				item.maxDelay, err = parseInterval(value)
+			case "exclude":
+				item.exclude = getList(value, ",")
+			case "cloud":
+				if item.cloud, err = getCloudByName(value, options); err == nil && item.cloud == nil {
+					err = fmt.Errorf("unknown cloud %s", value)
+				}
+			case "cloud-dir":
+				item.cloudPath = cloudDir(value)
+			case "compression":
+				item.compression, err = parseCompression(value)
+			case "encryption":
+				encryption = strings.ToLower(value)
+				if encryption != "yes" && encryption != "no" && encryption != "auto" {
+					err = errors.New("yes, no or auto is expected")
+				}
+			case "recipients":
+				item.recipients, err = loadRecipients(getList(value, ","))
+				ownRecipients = true
+			case "streaming":
+				item.streaming = isYes(value)
+			case "incremental":
+				item.incremental = isYes(value)
+			case "full-interval":
+				days, err := strconv.Atoi(value)
+				if err != nil || days < 0 {
+					return nil, fmt.Errorf("bad value of %s in section [%s]", key, section.Name())
+				}
+				item.fullInterval = time.Duration(days) * 24 * time.Hour
+			case "repository":
+				item.repository = isYes(value)
+			case "paranoid":
+				item.paranoid = isYes(value)
+			default:
+				var ok bool
+				if ok, err = parseRetentionOption(&retention, key + "=" + value); !ok {
+					return nil, fmt.Errorf("unknown key %s in section [%s]", key, section.Name())
+				}
+				ownRetention = true
+			}
+			if err != nil {
+				return nil, fmt.Errorf("bad value of %s in section [%s]: %v", key, section.Name(), err)
+			}
+		}
+		if ownRetention {
+			item.retention = retention
+		}
+		var keys = len(options.password) > 0 || len(item.recipients) > 0
+		switch {
+		case encryption == "auto":
+			item.encryption = keys
+		case encryption == "yes" && !keys:
+			return nil, fmt.Errorf("no password or recipients to encrypt section [%s]", section.Name())
+		default:
+			item.encryption = encryption == "yes"
+			item.noEncryption = !item.encryption
+		}
+		if err := checkRepositoryKeys(item, ownRecipients, options); err != nil {
+			return nil, fmt.Errorf("%v in section [%s]", err, section.Name())
+		}
+
+		if item.cloud == nil {
+			if item.cloud, err = getCloudByName(options.cloudName, options); err != nil {
+				return nil, fmt.Errorf("%v in section [%s]", err, section.Name())
+			}
+			if item.cloud == nil {
+				return nil, fmt.Errorf("cloud is not specified in section [%s]", section.Name())
 			}
 		}
 		list = append(list, item)
@@ -237,7 +689,8 @@ func loadPaths(values map[string]string, options Options) ([]PathItem, error) {
 //------------------------------------------------------------------------------
 func loadState(fileName string, items []PathItem) error {
 	// state file format
-	// path:md5(path):md5(data):last backup date:archive size
+	// path:md5(path):md5(data):last backup date:archive size:archive versions:
+	// source fingerprint:last failure date:failure message
 	file, err := os.Open(fileName)
 	if err != nil {
 		return nil
@@ -245,7 +698,8 @@ func loadState(fileName string, items []PathItem) error {
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		list := strings.Split(scanner.Text(), ",")
+		// failure message is the last one and may have commas
+		list := strings.SplitN(scanner.Text(), ",", 7)
 		if len(list) < 5 {
 			return nil
 		}
@@ -254,6 +708,24 @@ func loadState(fileName string, items []PathItem) error {
 				items[index].dataHash = list[2]
 				items[index].date.UnmarshalText([]byte(list[3]))
 				items[index].archiveSize, _ = strconv.ParseInt(list[4], 10, 64)
+				if len(list) > 5 {
+					items[index].versions = getList(list[5], " ")
+				}
+				if len(list) > 6 {
+					var rest = strings.SplitN(list[6], ",", 3)
+					// older files have no fingerprint before the failure date
+					var date time.Time
+					if date.UnmarshalText([]byte(rest[0])) == nil {
+						rest = strings.SplitN(list[6], ",", 2)
+					} else {
+						items[index].fingerprint = rest[0]
+						rest = rest[1:]
+					}
+					if len(rest) > 1 {
+						items[index].failDate.UnmarshalText([]byte(rest[0]))
+						items[index].failError = rest[1]
+					}
+				}
 				break
 			}
 		}
@@ -262,6 +734,9 @@ func loadState(fileName string, items []PathItem) error {
 	return nil
 }
 
+// path of section may have commas, the separator of state fields
+var statePath = strings.NewReplacer("%", "%25", ",", "%2C")
+
 //------------------------------------------------------------------------------
 func saveState(fileName string, items []PathItem) error {
 	file, err := os.Create(fileName)
@@ -270,8 +745,11 @@ func saveState(fileName string, items []PathItem) error {
 	}
 	for _, item := range items {
 		date, _ := item.date.MarshalText()
-		fmt.Fprintf(file, "%s,%s,%s,%s,%d\n", 
-			item.path, item.pathHash, item.dataHash, string(date), item.archiveSize)
+		failDate, _ := item.failDate.MarshalText()
+		fmt.Fprintf(file, "%s,%s,%s,%s,%d,%s,%s,%s,%s\n", 
+			statePath.Replace(item.path), item.pathHash, item.dataHash, string(date), item.archiveSize,
+			strings.Join(item.versions, " "), item.fingerprint, string(failDate),
+			strings.Replace(item.failError, "\n", " ", -1))
 	}
 	file.Close()
 	return nil
@@ -292,16 +770,6 @@ func getTotalBackupSize(items []PathItem) {
 	}
 }
 
-//------------------------------------------------------------------------------
-func contain(list []int, value int) bool {
-	for _, n := range list {
-		if n == value {
-			return true
-		}
-	}
-	return false
-}
-
 //------------------------------------------------------------------------------
 func logCommandOuput(output []byte) {
 	str := strings.Replace(string(output), "\n", "|", -1)
@@ -309,121 +777,246 @@ func logCommandOuput(output []byte) {
 }
 
 //------------------------------------------------------------------------------
-func deleteArchive(item PathItem, options Options) {
-	log.Printf("delete remote archive %s\n", item.archive)
+// logs tool output and a hint for errors user has to deal with
+func logCloudError(err error) {
+	var cloudErr *CloudError
+	if errors.As(err, &cloudErr) && len(cloudErr.output) > 0 {
+		logCommandOuput(cloudErr.output)
+	}
+	if errors.Is(err, errAuth) {
+		log.Println("cloud access denied, check credentials")
+	} else if errors.Is(err, errQuota) {
+		log.Println("cloud storage is full")
+	}
+}
 
-	if output, err := item.cloud.remove(options.cloudPath + item.archive); err != nil {
-		logCommandOuput(output)
+//------------------------------------------------------------------------------
+func deleteArchive(ctx context.Context, item PathItem, name string, options Options) {
+	log.Printf("delete remote archive %s\n", name)
+
+	err := item.cloud.delete(ctx, item.cloudPath + name)
+	if err != nil && !errors.Is(err, errNotFound) {
+		logCloudError(err)
 		log.Printf("remote delete failed %v\n", err)		
 	}
 }
 
 //------------------------------------------------------------------------------
-func restoreArchive(item PathItem, options Options) error {
+// removes every version of the path
+func clearArchives(ctx context.Context, item PathItem, options Options) error {
+	versions, err := listVersions(ctx, item, options)
+	if err != nil {
+		return err
+	}
+	var snapshots bool
+	for _, version := range versions {
+		deleteArchive(ctx, item, version.name, options)
+		snapshots = snapshots || version.snapshot
+	}
+	if snapshots {
+		return collectGarbage(ctx, item, options)
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// archives to read for the version: delta is applied over the full backup
+// and the deltas before it; version is a time prefix of the archive,
+// the newest one if empty. true if it is the newest one
+func findChain(ctx context.Context, item PathItem, version string,
+	options Options) ([]ArchiveVersion, bool, error) {
+	versions, err := listVersions(ctx, item, options)
+	if err != nil {
+		logCloudError(err)
+		return nil, false, err
+	}
+	archive, ok := findVersion(versions, version)
+	if !ok && len(version) == 0 && len(versions) == 0 {
+		// single archive of the old format, unknown to the state
+		archive, ok = ArchiveVersion{name: item.pathHash + ".bin"}, true
+	}
+	if !ok {
+		log.Printf("no archive for %s in %s\n", item.path, item.cloud.name())
+		return nil, false, errNotFound
+	}
+	chain, err := versionChain(versions, archive)
+	if err != nil {
+		return nil, false, err
+	}
+	return chain, len(versions) > 0 && versions[0].name == archive.name, nil
+}
+
+//------------------------------------------------------------------------------
+// tar streams of the chain are passed to process one by one, the oldest first
+func readChain(ctx context.Context, item PathItem, chain []ArchiveVersion,
+	process func(io.Reader) error, options Options) error {
+	for _, version := range chain {
+		item.archive = version.name
+		var err error
+		if version.snapshot {
+			err = restoreSnapshot(ctx, item, process, options)
+		} else {
+			err = unpackArchive(ctx, item, process, options)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// version is a time prefix of the archive, the newest one if empty
+func restoreArchive(ctx context.Context, item PathItem, version string,
+	target *RestoreTarget, options Options) error {
 
 	changeDirectory(options.workingPath)
-	os.Remove(item.archive)
 
+	chain, _, err := findChain(ctx, item, version, options)
+	if err != nil {
+		return err
+	}
+	err = readChain(ctx, item, chain, func(reader io.Reader) error {
+		return extractTar(ctx, reader, target)
+	}, options)
+	if err != nil {
+		return err
+	}
+	target.finish()
+	return nil
+}
+
+//------------------------------------------------------------------------------
+func unpackArchive(ctx context.Context, item PathItem, process func(io.Reader) error,
+	options Options) error {
 	log.Printf("download %s\n", item.archive)
-	if output,err := item.cloud.download(options.cloudPath + item.archive); err != nil {
-		logCommandOuput(output)
+	reader, err := item.cloud.get(ctx, item.cloudPath + item.archive)
+	if errors.Is(err, errNotFound) {
+		log.Printf("no archive for %s in %s\n", item.path, item.cloud.name())
+		return err
+	}
+	if err != nil {
+		logCloudError(err)
 		log.Printf("download archive failed %v\n", err)
 		return err
 	}
+	defer reader.Close()
 	
-	var content string
-	if item.encryption {
-		content = "gpg -d  -o- --passphrase '" + options.password +  
-		"' "  + item.archive
-	} else {
-		content = "cat " + item.archive
-	} 
-
-	content += " | tar xJ"
-	cmd := exec.Command("sh", "-c", content)
-	if _, err := cmd.Output(); err != nil {
+	if err = readArchive(ctx, item, options, reader, process); err != nil {
+		logCloudError(err)
 		return err
 	}
-	os.Remove(item.archive)
 	return nil
 }
 
 //------------------------------------------------------------------------------
-func uploadArchive(item *PathItem, options Options) error {
+// archive is uploaded under temporary name and renamed when it is complete,
+// so a failed upload never looks like a version
+func partName(archive string) string {
+	return archive + ".part"
+}
+
+//------------------------------------------------------------------------------
+// checks size of uploaded archive and gives it the version name
+func commitUpload(ctx context.Context, item *PathItem, size int64, options Options) error {
+	return commitFile(ctx, item.cloud, item.cloudPath + partName(item.archive),
+		item.cloudPath + item.archive, size)
+}
+
+//------------------------------------------------------------------------------
+func commitFile(ctx context.Context, cloud Cloud, temp string, target string, size int64) error {
+	file, err := cloud.stat(ctx, temp)
+	switch {
+	case errors.Is(err, errUnsupported):
+		log.Printf("%s cannot check uploaded file, not verified\n", cloud.name())
+	case err != nil:
+		return err
+	case file.size >= 0 && file.size != size:
+		return newCloudError("verify", temp, nil,
+			fmt.Errorf("%d bytes uploaded instead of %d", file.size, size), nil)
+	}
+	return cloud.move(ctx, temp, target)
+}
+
+//------------------------------------------------------------------------------
+// staged archive is named as the temporary upload, so tools needing a local
+// file can take it as is
+func putArchive(ctx context.Context, item *PathItem, options Options) error {
+	file, err := os.Open(partName(item.archive))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err = item.cloud.put(ctx, item.cloudPath + partName(item.archive), file, fi.Size()); err != nil {
+		return err
+	}
+	return commitUpload(ctx, item, fi.Size(), options)
+}
+
+//------------------------------------------------------------------------------
+// repeats upload on temporary cloud failures
+func retryTransient(ctx context.Context, upload func() error) error {
+	var err error
+	for attempt := 1; attempt <= uploadAttempts; attempt++ {
+		if err = upload(); err == nil || !errors.Is(err, errTransient) {
+			return err
+		}
+		log.Printf("temporary upload failure, attempt %d of %d: %v\n", attempt, uploadAttempts, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * uploadRetryDelay):
+		}
+	}
+	return err
+}
+
+//------------------------------------------------------------------------------
+func uploadArchive(ctx context.Context, item *PathItem, options Options) error {
 	changeDirectory(options.workingPath)
-	deleteArchive(*item, options)
 
 	log.Printf("upload %s\n", item.archive)
 	log.Printf("  encryption: %v\n", item.encryption)
 	log.Printf("  cloud: %s\n", item.cloud.name())
 	
-	if output,err := item.cloud.upload(item.archive, options.cloudPath); err != nil {
-		logCommandOuput(output)
+	err := retryTransient(ctx, func() error {
+		return putArchive(ctx, item, options)
+	})
+	if err != nil {
+		logCloudError(err)
+		// previous versions are untouched, only the partial upload goes
+		deleteArchive(ctx, *item, partName(item.archive), options)
+		os.Remove(partName(item.archive))
 		return err
 	}
-	os.Remove(item.archive)
+	os.Remove(partName(item.archive))
+	item.versions = append(item.versions, item.archive)
 	return nil
 }
 
 //------------------------------------------------------------------------------
-func createArchive(item *PathItem, options Options) (bool, error) {
-
-	var targetFile = options.workingPath + item.archive
-	var buffer bytes.Buffer
-	buffer.WriteString("tar")
-	for _, s := range item.exclude {
-		buffer.WriteString(" --exclude=")
-		buffer.WriteString(s)
-	}
-	buffer.WriteString(" --mtime=0")
-	buffer.WriteString(" -cf - ")
-	buffer.WriteString(filepath.Base(item.path))
-	buffer.WriteString(" | tee >")
-	if item.compression || item.encryption  {
-		buffer.WriteString("(")
-		if item.compression {
-			buffer.WriteString("xz --stdout -")
-			buffer.WriteString(strconv.Itoa(options.level))
-			if item.encryption  {
-				buffer.WriteString(" - | ")
-			} else {
-				buffer.WriteString(" > ")
-				buffer.WriteString(targetFile)
-			}
-		}
-		if item.encryption {
-			buffer.WriteString("gpg -z 0 -o ")
-			buffer.WriteString(targetFile)
-			buffer.WriteString(" --passphrase ")
-			buffer.WriteString(options.password)
-			buffer.WriteString(" -c - ")
-		}
-		buffer.WriteString(")")
-	} else {
-		buffer.WriteString(targetFile)
-	}
-	buffer.WriteString(" | md5sum")
-	//tar --mtime=0 -cf - 'input' | tee >(xz --stdout - | gpg -z 0 -o 'output' --passphrase 'password' -c -) | md5sum
-	
+func createArchive(ctx context.Context, item *PathItem, options Options) (bool, error) {
+
+	var targetFile = options.workingPath + partName(item.archive)
 	os.Remove(targetFile)
-	changeDirectory(filepath.Dir(item.path))	
 
 	log.Printf("archive %s -> %s\n", item.path, targetFile)
-	if options.verbose {
-		log.Printf("command: %s\n", buffer.String())	
-	}
-
-	var output []byte	
-	var err error
-	cmd := exec.Command("bash", "-c", buffer.String())
-	if output,err = cmd.CombinedOutput(); err != nil {
+	file, err := os.Create(targetFile)
+	if err != nil {
 		return false, err
 	}
-
-	if len(output) < 32 {
-		return false, errors.New("calculate md5 sum failed")
+	hash, err := writeArchive(ctx, item, options, file)
+	if e := file.Close(); err == nil {
+		err = stageFailure(stageOutput, e)
+	}
+	if err != nil {
+		os.Remove(targetFile)
+		return false, err
 	}
-	var hash = string(output[0:32]);
 
 	fi, _ := os.Stat(targetFile)
 	item.archiveSize = fi.Size()
@@ -439,55 +1032,190 @@ func createArchive(item *PathItem, options Options) (bool, error) {
 	return true, nil
 }
 
+// counts bytes passed through
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (this *countingReader) Read(p []byte) (int, error) {
+	n, err := this.reader.Read(p)
+	this.count += int64(n)
+	return n, err
+}
+
+//------------------------------------------------------------------------------
+// pipes archive straight to the cloud,
+// returns md5 of the tar stream and archive size
+func streamUpload(ctx context.Context, item *PathItem, options Options) (string, int64, error) {
+	reader, writer := io.Pipe()
+
+	var hash string
+	var done = make(chan error, 1)
+	go func() {
+		var err error
+		hash, err = writeArchive(ctx, item, options, writer)
+		writer.CloseWithError(err)
+		done <- err
+	}()
+
+	var counter = countingReader{reader: reader}
+	err := item.cloud.put(ctx, item.cloudPath + partName(item.archive), &counter, -1)
+	// stops the archive if the cloud gave up
+	reader.CloseWithError(err)
+	archiveErr := <-done
+
+	// the cloud error is the cause unless the archive failed by itself
+	if archiveErr != nil && (err == nil || stageOf(archiveErr) != stageOutput) {
+		return "", 0, archiveErr
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if err = commitUpload(ctx, item, counter.count, options); err != nil {
+		return "", 0, err
+	}
+	return hash, counter.count, nil
+}
+
+//------------------------------------------------------------------------------
+// the same as createArchive + uploadArchive without staging archive
+// in working dir, source is read twice: to check hash and to upload
+func streamArchive(ctx context.Context, item *PathItem, options Options) (bool, error) {
+	log.Printf("stream %s -> %s %s\n", item.path, item.cloud.name(), item.cloudPath + item.archive)
+	var hash string
+	var err error
+	// incremental path is checked by manifest already
+	if !item.incremental {
+		if hash, err = getSourceHash(ctx, item); err != nil {
+			return false, err
+		}
+		log.Printf("  data hash: %s\n", hash)
+		if hash == item.dataHash {
+			log.Printf("source not changed, skipping ")
+			return false, nil
+		}
+		log.Printf("previous hash (%s) is different, upload\n", item.dataHash)
+	}
+	log.Printf("  encryption: %v\n", item.encryption)
+
+	var size int64
+	err = retryTransient(ctx, func() error {
+		var err error
+		hash, size, err = streamUpload(ctx, item, options)
+		return err
+	})
+	if err != nil {
+		logCloudError(err)
+		// previous versions are untouched, only the partial upload goes
+		deleteArchive(ctx, *item, partName(item.archive), options)
+		return false, err
+	}
+
+	item.dataHash = hash
+	item.archiveSize = size
+	item.versions = append(item.versions, item.archive)
+	log.Printf("  size: %s\n", bytefmt.ByteSize(uint64(size)))
+	return true, nil
+}
+
 //------------------------------------------------------------------------------
-func proccessPathItem(item *PathItem, options Options) (bool, error) {
+// archive of the path as a single file in the cloud, false if it is not needed
+func backupArchive(ctx context.Context, item *PathItem, current time.Time,
+	options Options) (bool, error) {
+	item.archive = versionName(item.pathHash, item.hostId, current)
+	if item.incremental {
+		if upload, err := prepareIncremental(ctx, item, options); err != nil || !upload {
+			return false, err
+		}
+		if item.delta != nil {
+			item.archive = deltaVersionName(item.pathHash, item.hostId, current)
+		}
+	}
+	if item.streaming && !item.cloud.streaming() {
+		log.Printf("%s cannot take a stream, stage archive in working dir\n", item.cloud.name())
+	}
+	if item.streaming && item.cloud.streaming() {
+		upload, err := streamArchive(ctx, item, options)
+		if err != nil {
+			log.Printf("stream archive failed %v", err)
+		}
+		return upload, err
+	}
+	upload, err := createArchive(ctx, item, options)
+	if err != nil {
+		log.Printf("create archive failed %v", err)
+		return false, err
+	}
+	if upload {
+		if err = uploadArchive(ctx, item, options); err != nil {
+			log.Printf("upload archive failed %v", err)
+			return false, err
+		}
+	}
+	return upload, nil
+}
+
+//------------------------------------------------------------------------------
+// false if the path is not due, the cloud is up to date after true
+// even if nothing was uploaded
+func proccessPathItem(ctx context.Context, item *PathItem, options Options) (bool, error) {
 	log.Printf("proccessing path %s\n", item.path)
-	var need bool
 	var current = time.Now()
-
-	switch item.schedule {
-	case Once:
-		need = item.date.IsZero()
-	case Dayly:
-		need = current.YearDay() != item.date.YearDay()
-	case Weekly:
-		if item.date.IsZero() || 
-			(current.Day() != item.date.Day() &&
-			contain(options.weeklyDays, int(current.Weekday()))) {
-			need = true
-		}
-		break
-	case Monthly:
-		if item.date.IsZero() || 
-			(current.Day() != item.date.Day() && 
-			contain(options.monthlyDays, current.Day())) {
-			need = true
-		}
-	}
-	if !need {
+	if !isDue(item, current, options) {
 		log.Printf("recently backuped, skipping\n")
 		return false, nil
 	}
+	// walk takes missing source for empty one
+	if _, err := os.Stat(item.path); err != nil {
+		return false, err
+	}
 
 	var err error
+	if !item.paranoid {
+		// walking the tree is much cheaper than archiving it
+		fingerprint, err := getFingerprint(ctx, item)
+		if err != nil {
+			return false, err
+		}
+		log.Printf("  fingerprint: %s\n", fingerprint)
+		if fingerprint == item.fingerprint {
+			log.Printf("source not changed, skipping ")
+			return true, nil
+		}
+		item.fingerprint = fingerprint
+	} else {
+		item.fingerprint = ""
+	}
+
 	log.Printf("back up %s\n", item.path)
-	if item.upload, err = createArchive(item, options); err != nil {
-		log.Printf("create archive failed %v", err)
+	// every backup is a new version, old ones are pruned after upload
+	if item.repository {
+		// chunks are deduplicated, so every snapshot is complete
+		item.archive = snapshotName(item.pathHash, item.hostId, current)
+		if item.upload, err = repositoryBackup(ctx, item, options); err != nil {
+			log.Printf("repository backup failed %v", err)
+			return false, err
+		}
+	} else if item.upload, err = backupArchive(ctx, item, current, options); err != nil {
 		return false, err
 	}
 	if !item.upload {
-		return false, nil
+		return true, nil
+	}
+	if item.incremental && !item.repository {
+		commitIncremental(item, options)
 	}
 
-	if err := uploadArchive(item, options); err != nil {
-		log.Printf("upload archive failed %v", err)
-		return false, err
+	if err = pruneVersions(ctx, item, options); err != nil {
+		logCloudError(err)
+		log.Printf("prune versions failed %v\n", err)
 	}
 	return true, nil
 }
 
 //------------------------------------------------------------------------------
-func parseCommandLine(paths []PathItem, options Options) {
+func parseCommandLine(ctx context.Context, paths []PathItem, options Options) {
 	if len(os.Args) <= 1 {
 		return
 	}
@@ -495,104 +1223,231 @@ func parseCommandLine(paths []PathItem, options Options) {
 	case "reset":
 		log.Println("reset backup state")
 		os.Remove(options.stateFile)
+		for _, item := range paths {
+			os.Remove(manifestFile(&item, options))
+		}
 		os.Exit(0)
 	case "clear-archive":
 		log.Println("clear backup archive")
 		changeDirectory(options.workingPath)
 		for _, item := range paths {
-			deleteArchive(item, options)
+			if err := clearArchives(ctx, item, options); err != nil {
+				logCloudError(err)
+				log.Printf("list archives of %s failed: %v\n", item.path, err)
+			}
+		}
+		os.Exit(0)
+	case "ls", "browse":
+		if len(os.Args) > 2 {
+			request, err := parseRestoreArgs(os.Args[2:], true)
+			if err != nil {
+				log.Fatalf("%s: %v", os.Args[1], err)
+			}
+			if err = printArchives(ctx, selectPaths(paths, request.path), request, options); err != nil {
+				log.Fatalf("list failed: %v", err)
+			}
+			os.Exit(0)
+		}
+	case "recover":
+		request, err := parseRecoverArgs(os.Args[2:])
+		if err != nil {
+			log.Fatalf("recover: %v", err)
 		}
+		if err = recoverPaths(ctx, request, options); err != nil {
+			log.Fatalf("recover failed: %v", err)
+		}
+		log.Println("recovered")
 		os.Exit(0)
+	case "versions":
+		if len(os.Args) > 2 {
+			for _, item := range selectPaths(paths, os.Args[2]) {
+				versions, err := listVersions(ctx, item, options)
+				if err != nil {
+					log.Fatalf("list versions failed: %v", err)
+				}
+				for _, version := range versions {
+					fmt.Printf("%s  %s\n", version.date.UTC().Format(versionTimeFormat), version.name)
+				}
+			}
+			os.Exit(0)
+		}
 	case "restore": 
 		if len(os.Args) > 2 {
-			var path = normalizePath(os.Args[2])
-			log.Printf("restore path %s to working folder\n", path)
-			for _, item := range paths {
-				if item.path == path {
-					if err := restoreArchive(item, options); err != nil {
-						log.Fatalf("restore failed: %v", err)
-					}
-					log.Println("restored")
-				}				
+			request, err := parseRestoreArgs(os.Args[2:], false)
+			if err != nil {
+				log.Fatalf("restore: %v", err)
+			}
+			var selected = paths
+			if !request.all {
+				selected = selectPaths(paths, request.path)
+			}
+			if !restorePaths(ctx, selected, request, options) {
+				os.Exit(1)
 			}
 			os.Exit(0)
 		}
 	}
-	fmt.Println("commands: reset, clear-archive, restore <path>")	
+	fmt.Println("commands: reset, clear-archive, versions <path>, restore <path> | --all [version] [--to dir | --in-place] [--conflict overwrite|skip|newer|rename] [--include glob]..., ls <path> [version] [--include glob]... [--json], recover --cloud <name> [--cloud-dir dir] [--host name] [--list] [--to dir] [--conflict policy], daemon")	
 	os.Exit(0)
 }
 
 //------------------------------------------------------------------------------
-func checkCommands(paths []PathItem, options Options) {
+func checkCommands(paths []PathItem, options Options) error {
+	// archive is made in process, only cloud tools are needed
 	var commands = make(map[string]bool);
-	commands["bash"] = true
-	commands["tar"] = true
-	commands["md5sum"] = true
-	
 	for _,item := range paths {
-		if item.encryption {
-			commands["gpg"] = true
-		}
-		if item.compression {
-			commands["xz"] = true
+		if command := item.cloud.command(); len(command) > 0 {
+			commands[command] = true
 		}
-		commands[item.cloud.command()] = true
 	}
 	for item,_ := range commands {
 		if !checkCommandExists(item) {
-			log.Fatalf("required command %s not found\n", item)		
+			return fmt.Errorf("required command %s not found", item)
 		}
 	}
+	return nil
 }
 
 //------------------------------------------------------------------------------
-func main() {
-	var err error
-	var logger ext_logger.ExtLogger
-	log.SetOutput(&logger)
-	defer logger.Close()
-
-	var configPath = filepath.Dir(os.Args[0]) + "/" + configFile
-	if _, err := os.Stat(configPath); err != nil {	
-		configPath = normalizePathNoCheck("~/" + configFile)
+// state, manifest and versions of a path are named by the hash of its source,
+// so a source may be configured only once
+func checkDuplicatePaths(paths []PathItem) error {
+	var sources = make(map[string]bool)
+	for _, item := range paths {
+		if sources[item.pathHash] {
+			return fmt.Errorf("path %s is configured more than once", item.path)
+		}
+		sources[item.pathHash] = true
 	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// options and paths of [paths] and path sections with their state,
+// log goes to the log file of the config once it is loaded
+func loadConfig(configPath string, logger *RunLogger) (Options, []PathItem, error) {
 	log.Printf("open config file %s...\n", configPath)
-	var cfg *ini.File
-	if cfg, err = ini.Load(configPath); err != nil {
-		log.Fatalf("config file not loaded: %v", err)
+	cfg, err := ini.Load(configPath)
+	if err != nil {
+		return Options{}, nil, fmt.Errorf("config file not loaded: %v", err)
 	}
 
-	var options Options
-	if options, err = loadOptions(cfg.Section("config").KeysHash()); err != nil {
-		log.Fatalf("failed to read options: %v", err)
+	options, err := loadOptions(cfg.Section("config").KeysHash())
+	if err != nil {
+		return options, nil, fmt.Errorf("failed to read options: %v", err)
 	}
 	options.verbose = false
 
-	logger.SetFile(options.logFile)
+	paths, err := loadPaths(cfg.Section("paths").KeysHash(), options)
+	if err != nil {
+		return options, nil, fmt.Errorf("config error: %v", err)
+	}
+	sections, err := loadPathSections(cfg.Sections(), options)
+	if err != nil {
+		return options, nil, fmt.Errorf("config error: %v", err)
+	}
+	paths = append(paths, sections...)
+	if err = checkDuplicatePaths(paths); err != nil {
+		return options, nil, fmt.Errorf("config error: %v", err)
+	}
+	if err = checkCommands(paths, options); err != nil {
+		return options, nil, err
+	}
+
+	if err = logger.setFile(options.logFile); err != nil {
+		return options, nil, fmt.Errorf("log file not opened: %v", err)
+	}
 	log.Println("")
 	log.Println("start logging")
-
-	var paths []PathItem
-	paths, err = loadPaths(cfg.Section("paths").KeysHash(), options)
 	loadState(options.stateFile, paths)
+	return options, paths, nil
+}
 
-	checkCommands(paths, options)
-	parseCommandLine(paths, options)
-
-	var backuped bool
+//------------------------------------------------------------------------------
+// backs up the due paths, all of them if there is no filter,
+// the state is saved after every one
+func backupPaths(ctx context.Context, paths []PathItem, options Options,
+	filter func(PathItem) bool) {
+	// catalogs are updated for the paths which versions are changed
+	var changed, checked = make(map[string]bool), make(map[string]bool)
+	defer func() {
+		if ctx.Err() == nil && len(checked) > 0 {
+			updateCatalogs(ctx, paths, changed, checked, options)
+		}
+	}()
 	for index, item := range paths {
-		if backuped, err = proccessPathItem(&item, options); err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		if filter != nil && !filter(item) {
+			continue
+		}
+		backuped, err := proccessPathItem(ctx, &item, options)
+		if err != nil && ctx.Err() != nil {
+			// stopped, it is not a failure of the path
+			log.Printf("backup of %s is aborted\n", item.path)
+			return
+		}
+		if err != nil {
 			log.Printf("backup error for path %s: %v\n", item.path, err)
+			// the previous archive is intact, only the failure is recorded
+			paths[index].failDate = time.Now()
+			paths[index].failError = err.Error()
+			if err = saveState(options.stateFile, paths); err != nil {
+				log.Fatalf("error saving state: %v\n", err)
+			}
 			continue
 		}
 		if backuped {
+			checked[item.pathHash] = true
+			changed[item.pathHash] = strings.Join(item.versions, " ") !=
+				strings.Join(paths[index].versions, " ")
+			// schedules count from the last good run, upload or not
 			item.date = time.Now()
+			item.failDate = time.Time{}
+			item.failError = ""
 			paths[index] = item
 			if err = saveState(options.stateFile, paths); err != nil {
 				log.Fatalf("error saving state: %v\n", err)
 			}
 		}
 	}
+}
+
+//------------------------------------------------------------------------------
+func main() {
+	var ctx = context.Background()
+	var logger RunLogger
+	log.SetOutput(&logger)
+	defer logger.Close()
+
+	var configPath = filepath.Dir(os.Args[0]) + "/" + configFile
+	if _, err := os.Stat(configPath); err != nil {	
+		configPath = normalizePathNoCheck("~/" + configFile)
+	}
+	// working dir is changed by backup, daemon reloads the config later
+	if path, err := filepath.Abs(configPath); err == nil {
+		configPath = path
+	}
+	if isJsonListing(os.Args[1:]) {
+		logger.setStderr()
+	}
+	options, paths, err := loadConfig(configPath, &logger)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(os.Args) <= 1 || os.Args[1] != "recover" {
+		if err = checkWorkingPath(options); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if len(os.Args) > 1 && os.Args[1] == "daemon" {
+		runDaemon(configPath, &logger, paths, options)
+		return
+	}
+	parseCommandLine(ctx, paths, options)
+
+	backupPaths(ctx, paths, options, nil)
 	getTotalBackupSize(paths);
 	log.Println("done")
 }
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"./libs/github.com/go-ini/ini"
+)
+
+//------------------------------------------------------------------------------
+// the failure message and the path may have commas
+func TestStateRoundTrip(t *testing.T) {
+	var date = time.Date(2024, 5, 10, 20, 30, 0, 0, time.UTC)
+	var items = []PathItem{
+		{path: "/data/a", pathHash: getStrHash("/data/a"), dataHash: "1", date: date, archiveSize: 10,
+			versions: []string{"x.bin", "y.bin"}, fingerprint: "f", failDate: date.Add(time.Hour),
+			failError: "put: quota, try later\nagain"},
+		{path: "/data/b, 2%", pathHash: getStrHash("/data/b, 2%"), dataHash: "2", date: date},
+	}
+	var fileName = filepath.Join(t.TempDir(), "state")
+	if err := saveState(fileName, items); err != nil {
+		t.Fatal(err)
+	}
+	var loaded = []PathItem{
+		{path: "/data/b, 2%", pathHash: getStrHash("/data/b, 2%")},
+		{path: "/data/a", pathHash: getStrHash("/data/a")},
+	}
+	if err := loadState(fileName, loaded); err != nil {
+		t.Fatal(err)
+	}
+	var a, b = loaded[1], loaded[0]
+	if a.dataHash != "1" || !a.date.Equal(date) || a.archiveSize != 10 ||
+		strings.Join(a.versions, " ") != "x.bin y.bin" || a.fingerprint != "f" ||
+		!a.failDate.Equal(date.Add(time.Hour)) ||
+		a.failError != "put: quota, try later again" {
+		t.Fatalf("loaded %+v", a)
+	}
+	if b.dataHash != "2" || len(b.versions) > 0 || len(b.fingerprint) > 0 || !b.failDate.IsZero() ||
+		len(b.failError) > 0 {
+		t.Fatalf("loaded %+v", b)
+	}
+
+	// files of the older format have no fingerprint
+	var line = "/data/a," + getStrHash("/data/a") + ",1,2024-05-10T20:30:00Z,10,x.bin," +
+		"2024-05-10T21:30:00Z,put: quota, try later\n"
+	ioutil.WriteFile(fileName, []byte(line), 0600)
+	loaded = []PathItem{{path: "/data/a", pathHash: getStrHash("/data/a")}}
+	if err := loadState(fileName, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if a = loaded[0]; len(a.fingerprint) > 0 || !a.failDate.Equal(date.Add(time.Hour)) ||
+		a.failError != "put: quota, try later" {
+		t.Fatalf("loaded old format %+v", a)
+	}
+}
+
+//------------------------------------------------------------------------------
+// upload of another size is not given the version name
+func TestCommitUpload(t *testing.T) {
+	var cloud = CloudLocal{t.TempDir()}
+	var ctx = context.Background()
+	var item = PathItem{archive: "hash-20240510T203000Z.bin", cloud: cloud, cloudPath: "backup/"}
+	var options = Options{}
+	if err := cloud.put(ctx, "backup/" + partName(item.archive), strings.NewReader("data"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitUpload(ctx, &item, 5, options); err == nil {
+		t.Fatal("short upload is committed")
+	}
+	if names := listRemote(t, cloud, "backup"); strings.Join(names, " ") != partName(item.archive) {
+		t.Fatalf("cloud has %v", names)
+	}
+	if err := commitUpload(ctx, &item, 4, options); err != nil {
+		t.Fatal(err)
+	}
+	if names := listRemote(t, cloud, "backup"); strings.Join(names, " ") != item.archive {
+		t.Fatalf("cloud has %v", names)
+	}
+}
+
+//------------------------------------------------------------------------------
+// unchanged metadata skips the archive, paranoid mode reads the content
+func TestFingerprintSkip(t *testing.T) {
+	var work = t.TempDir()
+	t.Chdir(work)
+	var source = filepath.Join(t.TempDir(), "data")
+	writeTree(t, source, map[string]string{"a.txt": "aaaa"})
+	var cloud = CloudLocal{t.TempDir()}
+	var options = Options{stateFile: filepath.Join(work, "state"), workingPath: work + "/"}
+	var item = PathItem{path: source, pathHash: getStrHash(source), schedule: Once,
+		retention: Retention{last: 10}, cloud: cloud, cloudPath: "backup/"}
+	var ctx = context.Background()
+	// true if a new version is uploaded
+	var run = func() bool {
+		t.Helper()
+		item.upload = false
+		if ok, err := proccessPathItem(ctx, &item, options); !ok || err != nil {
+			t.Fatalf("backup failed: %v", err)
+		}
+		return item.upload
+	}
+	if !run() || len(item.fingerprint) == 0 {
+		t.Fatalf("first backup: %q", item.fingerprint)
+	}
+	if run() {
+		t.Fatal("unchanged source is uploaded")
+	}
+
+	// content changed behind the same size and mtime
+	var fileName = filepath.Join(source, "a.txt")
+	fi, _ := os.Stat(fileName)
+	ioutil.WriteFile(fileName, []byte("bbbb"), 0600)
+	os.Chtimes(fileName, fi.ModTime(), fi.ModTime())
+	if run() {
+		t.Fatal("content is compared without paranoid")
+	}
+	item.paranoid = true
+	if !run() || len(item.fingerprint) > 0 {
+		t.Fatalf("paranoid mode misses the change: %q", item.fingerprint)
+	}
+	if run() {
+		t.Fatal("paranoid mode uploads the same content")
+	}
+
+	// a touch is found by the fingerprint, the content is the same
+	item.paranoid = false
+	run()
+	os.Chtimes(fileName, fi.ModTime().Add(time.Hour), fi.ModTime().Add(time.Hour))
+	var fingerprint = item.fingerprint
+	if run() || item.fingerprint == fingerprint {
+		t.Fatalf("touch: fingerprint %q, before %q", item.fingerprint, fingerprint)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestPathSectionName(t *testing.T) {
+	var tests = []struct {
+		section string
+		name    string
+		ok      bool
+	}{
+		{`path "docs"`, "docs", true},
+		{`path  "my docs"`, "my docs", true},
+		{"path.docs", "docs", true},
+		{"path.", "", false},
+		{`path ""`, "", false},
+		{"path docs", "", false},
+		{"paths", "", false},
+		{"DEFAULT", "", false},
+	}
+	for _, test := range tests {
+		if name, ok := pathSectionName(test.section); name != test.name || ok != test.ok {
+			t.Errorf("%s: %q %v", test.section, name, ok)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func loadSections(t *testing.T, config string, options Options) ([]PathItem, error) {
+	t.Helper()
+	cfg, err := ini.Load([]byte(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loadPathSections(cfg.Sections(), options)
+}
+
+//------------------------------------------------------------------------------
+// source of a section may have commas and colons, exclude patterns colons only,
+// the global settings apply unless the section has its own
+func TestLoadPathSections(t *testing.T) {
+	var options = Options{cloudName: "local", localDir: t.TempDir(), cloudPath: "backup/",
+		password: "secret", compression: Compression{compressionXz, -1},
+		retention: Retention{daily: 7}}
+	var dir = t.TempDir()
+	writeTree(t, dir, map[string]string{"photos, 2019/": "", "mail/": ""})
+	var recipient = newIdentity(t).Recipient().String()
+	items, err := loadSections(t, `
+[paths]
+/data/old = weekly
+
+[path "photos"]
+source = ` + dir + `/photos, 2019
+schedule = monthly
+exclude = *.tmp, cache:old
+cloud-dir = photos
+compression = zstd:19
+keep-monthly = 12
+
+[path.mail]
+source = ` + dir + `/mail
+encryption = no
+`, options)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("%d items: %v", len(items), err)
+	}
+	var photos, mail = items[0], items[1]
+	if photos.path != dir + "/photos, 2019" || photos.pathHash != getStrHash(dir + "/photos, 2019") ||
+		photos.schedule != Monthly || strings.Join(photos.exclude, "|") != "*.tmp|cache:old" ||
+		photos.cloudPath != "photos/" || photos.compression != (Compression{compressionZstd, 19}) ||
+		photos.retention != (Retention{monthly: 12}) || !photos.encryption {
+		t.Errorf("photos: %+v", photos)
+	}
+	if mail.path != dir + "/mail" || mail.cloudPath != "backup/" || mail.retention != options.retention ||
+		mail.compression != options.compression || mail.encryption || mail.cloud == nil {
+		t.Errorf("mail: %+v", mail)
+	}
+
+	var failures = []string{
+		"[path \"a\"]\nschedule = weekly\n",
+		"[path \"a\"]\nsource = " + dir + "\nschedule = hourly\n",
+		"[path \"a\"]\nsource = " + dir + "\ncompression = xz:10\n",
+		"[path \"a\"]\nsource = " + dir + "\ncloud = floppy\n",
+		"[path \"a\"]\nsource = " + dir + "\nfull-interval = -1\n",
+		"[path \"a\"]\nsource = " + dir + "\nkeep-yearly = 1\n",
+		"[path \"a\"]\nsource = " + dir + "\nrecipients = age1bad\n",
+		"[path \"a\"]\nsource = " + dir + "\nencryption = maybe\n",
+		"[path \"a\"]\nsource = " + dir + "\nencryption = true\n",
+		"[path \"a\"]\nsource = " + dir + "\nencryption =\n",
+		// chunks of the repository are shared, so are the keys
+		"[path \"a\"]\nsource = " + dir + "\nrepository = yes\nencryption = no\n",
+		"[path \"a\"]\nsource = " + dir + "\nrepository = yes\nrecipients = " + recipient + "\n",
+	}
+	for _, config := range failures {
+		if _, err = loadSections(t, config, options); err == nil {
+			t.Errorf("accepted %q", config)
+		}
+	}
+	options.password = ""
+	var config = "[path \"a\"]\nsource = " + dir + "\nencryption = yes\n"
+	if _, err = loadSections(t, config, options); err == nil {
+		t.Error("encryption without keys is accepted")
+	}
+	// the same without any keys
+	config = "[path \"a\"]\nsource = " + dir + "\nrepository = yes\n"
+	if _, err = loadSections(t, config, options); err != nil {
+		t.Errorf("plain repository: %v", err)
+	}
+}
+
+//------------------------------------------------------------------------------
+// state and versions are named by the source, it is configured once
+func TestLoadConfigDuplicates(t *testing.T) {
+	var work = t.TempDir()
+	var source = filepath.Join(t.TempDir(), "data")
+	writeTree(t, source, map[string]string{"a.txt": "a"})
+	var config = "[config]\nworking-dir = " + work + "\nstate-file = " + work + "/state\n" +
+		"cloud = local\nlocal-dir = " + t.TempDir() + "\n"
+	var tests = []struct {
+		name   string
+		config string
+		ok     bool
+	}{
+		{"one", "[path \"a\"]\nsource = " + source + "\n", true},
+		{"sections", "[path \"a\"]\nsource = " + source + "\n[path \"b\"]\nsource = " + source +
+			"\ncloud-dir = other\n", false},
+		{"paths and section", "[paths]\n" + source + " = once\n[path \"a\"]\nsource = " + source +
+			"\n", false},
+	}
+	var logger RunLogger
+	for _, test := range tests {
+		var configPath = filepath.Join(work, test.name + ".ini")
+		ioutil.WriteFile(configPath, []byte(config + test.config), 0600)
+		_, paths, err := loadConfig(configPath, &logger)
+		if (err == nil) != test.ok || test.ok && len(paths) != 1 {
+			t.Errorf("%s: %d paths, %v", test.name, len(paths), err)
+		}
+	}
+}
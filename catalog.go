@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// every host keeps the list of its paths in each cloud dir it uses,
+// so the archives can be found without the config and the state file
+const (
+	catalogPrefix = "catalog-"
+	catalogHeader = "cloud-backup catalog 1"
+)
+
+// path as it is stored in the cloud
+type CatalogPath struct {
+	path        string
+	pathHash    string
+	// archive, incremental, repository
+	layout      string
+	compression string
+	// password, age or none
+	encryption  string
+	size        int64
+	versions    []string	// oldest first
+}
+
+type Catalog struct {
+	host  string
+	date  time.Time
+	paths []CatalogPath
+}
+
+// recover --cloud name --cloud-dir dir [--host name] [--list] [--to dir]
+// [--conflict policy]
+type RecoverRequest struct {
+	cloud    string
+	cloudDir string
+	host     string
+	list     bool
+	dir      string
+	conflict string
+}
+
+var catalogHostName = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+//------------------------------------------------------------------------------
+// host name is kept if it is safe for the cloud and as a dir name, otherwise
+// the replaced characters are followed by its hash, so a/b and a_b do not
+// share the catalog
+func safeHostName(host string) string {
+	var name = catalogHostName.ReplaceAllString(host, "_")
+	if name != host || strings.Trim(name, ".") == "" {
+		name += "-" + getStrHash(host)[:8]
+	}
+	return name
+}
+
+//------------------------------------------------------------------------------
+func catalogName(host string) string {
+	return catalogPrefix + safeHostName(host) + ".bin"
+}
+
+//------------------------------------------------------------------------------
+// host part of version names, the host name may have any characters
+func hostId(host string) string {
+	return getStrHash(host)[:8]
+}
+
+//------------------------------------------------------------------------------
+func hostName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		log.Printf("host name unknown: %v\n", err)
+		return "localhost"
+	}
+	return host
+}
+
+//------------------------------------------------------------------------------
+func catalogPath(item PathItem) CatalogPath {
+	var entry = CatalogPath{
+		path:        item.path,
+		pathHash:    item.pathHash,
+		layout:      "archive",
+		compression: item.compression.String(),
+		encryption:  "none",
+		size:        item.archiveSize,
+		versions:    item.versions,
+	}
+	switch {
+	case item.repository:
+		entry.layout = "repository"
+	case item.incremental:
+		entry.layout = "incremental"
+	}
+	switch {
+	case len(item.recipients) > 0:
+		entry.encryption = "age"
+	case item.encryption:
+		entry.encryption = "password"
+	}
+	return entry
+}
+
+//------------------------------------------------------------------------------
+// header, host and date, a path line for every path followed by its versions;
+// the path is the last as it may have spaces
+func (this *Catalog) encode(options Options) ([]byte, error) {
+	var output bytes.Buffer
+	fmt.Fprintln(&output, catalogHeader)
+	fmt.Fprintf(&output, "host %s\n", this.host)
+	fmt.Fprintf(&output, "date %s\n", this.date.UTC().Format(time.RFC3339))
+	for _, item := range this.paths {
+		fmt.Fprintf(&output, "path %s %s %s %s %d %s\n", item.pathHash, item.layout,
+			item.compression, item.encryption, item.size, item.path)
+		for _, version := range item.versions {
+			fmt.Fprintf(&output, "version %s\n", version)
+		}
+	}
+	if !isRepositoryEncrypted(options) {
+		return output.Bytes(), nil
+	}
+	return encryptData(output.Bytes(), options)
+}
+
+//------------------------------------------------------------------------------
+func loadCatalog(ctx context.Context, cloud Cloud, remotePath string,
+	options Options) (Catalog, error) {
+	var catalog Catalog
+	reader, err := cloud.get(ctx, remotePath)
+	if err != nil {
+		return catalog, err
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return catalog, err
+	}
+	if data, err = openData(data, options); err != nil {
+		return catalog, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1 << 20)
+	if !scanner.Scan() || scanner.Text() != catalogHeader {
+		return catalog, errors.New("bad catalog " + remotePath)
+	}
+	for scanner.Scan() {
+		list := strings.SplitN(scanner.Text(), " ", 2)
+		if len(list) != 2 {
+			return catalog, fmt.Errorf("bad catalog line: %s", scanner.Text())
+		}
+		switch list[0] {
+		case "host":
+			catalog.host = list[1]
+		case "date":
+			catalog.date, _ = time.Parse(time.RFC3339, list[1])
+		case "path":
+			fields := strings.SplitN(list[1], " ", 6)
+			if len(fields) != 6 {
+				return catalog, fmt.Errorf("bad catalog line: %s", scanner.Text())
+			}
+			var item = CatalogPath{pathHash: fields[0], layout: fields[1],
+				compression: fields[2], encryption: fields[3], path: fields[5]}
+			item.size, _ = strconv.ParseInt(fields[4], 10, 64)
+			catalog.paths = append(catalog.paths, item)
+		case "version":
+			if len(catalog.paths) == 0 {
+				return catalog, fmt.Errorf("bad catalog line: %s", scanner.Text())
+			}
+			var last = &catalog.paths[len(catalog.paths) - 1]
+			last.versions = append(last.versions, list[1])
+		}
+	}
+	return catalog, scanner.Err()
+}
+
+//------------------------------------------------------------------------------
+// catalogs of the cloud dirs the changed paths are stored in are uploaded
+// again, the one missing in the cloud is uploaded as well
+func updateCatalogs(ctx context.Context, paths []PathItem, changed map[string]bool,
+	checked map[string]bool, options Options) {
+	var host = hostName()
+	var name = catalogName(host)
+	var done = make(map[string]bool)
+	for _, item := range paths {
+		var location = item.cloud.name() + " " + item.cloudPath
+		if done[location] || !changed[item.pathHash] && !checked[item.pathHash] {
+			continue
+		}
+		done[location] = true
+		if !changed[item.pathHash] {
+			if _, err := item.cloud.stat(ctx, item.cloudPath + name); err == nil ||
+				!errors.Is(err, errNotFound) {
+				continue
+			}
+		}
+		var catalog = Catalog{host: host, date: time.Now()}
+		for _, other := range paths {
+			if other.cloud.name() == item.cloud.name() && other.cloudPath == item.cloudPath {
+				catalog.paths = append(catalog.paths, catalogPath(other))
+			}
+		}
+		log.Printf("upload %s\n", name)
+		data, err := catalog.encode(options)
+		if err == nil {
+			err = putCommitted(ctx, item.cloud, item.cloudPath + name, data)
+		}
+		if err != nil {
+			logCloudError(err)
+			log.Printf("catalog upload to %s failed: %v\n", item.cloud.name(), err)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func parseRecoverArgs(args []string) (RecoverRequest, error) {
+	var request = RecoverRequest{conflict: conflictOverwrite}
+	for index := 0; index < len(args); index++ {
+		var value = func() (string, error) {
+			if index + 1 >= len(args) {
+				return "", fmt.Errorf("%s needs a value", args[index])
+			}
+			index++
+			return args[index], nil
+		}
+		var err error
+		switch args[index] {
+		case "--cloud":
+			request.cloud, err = value()
+		case "--cloud-dir":
+			request.cloudDir, err = value()
+		case "--host":
+			request.host, err = value()
+		case "--list":
+			request.list = true
+		case "--to":
+			request.dir, err = value()
+		case "--conflict":
+			if request.conflict, err = value(); err == nil {
+				err = checkConflict(request.conflict)
+			}
+		default:
+			err = fmt.Errorf("unknown option %s", args[index])
+		}
+		if err != nil {
+			return request, err
+		}
+	}
+	if len(request.cloud) == 0 {
+		return request, errors.New("--cloud is expected")
+	}
+	return request, nil
+}
+
+//------------------------------------------------------------------------------
+// catalogs in the cloud dir, only the one of the host if it is given
+// or the cloud cannot list
+func findCatalogs(ctx context.Context, cloud Cloud, cloudPath string, host string) ([]string, error) {
+	if len(host) > 0 {
+		return []string{catalogName(host)}, nil
+	}
+	files, err := cloud.list(ctx, cloudPath)
+	if errors.Is(err, errUnsupported) {
+		log.Printf("%s cannot list, catalog of this host is read\n", cloud.name())
+		return []string{catalogName(hostName())}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		if !file.dir && strings.HasPrefix(file.name, catalogPrefix) &&
+			strings.HasSuffix(file.name, ".bin") {
+			names = append(names, file.name)
+		}
+	}
+	return names, nil
+}
+
+//------------------------------------------------------------------------------
+// lists the paths of catalogs in the cloud dir and restores the version
+// of every one the catalog has as the newest under the target dir as they were
+// laid out on the host, each host in its own dir if there are several;
+// only the cloud settings and the password or identity are needed
+func recoverPaths(ctx context.Context, request RecoverRequest, options Options) error {
+	cloud, err := getCloudByName(request.cloud, options)
+	if err != nil {
+		return err
+	}
+	if cloud == nil {
+		return fmt.Errorf("unknown cloud %s", request.cloud)
+	}
+	var cloudPath = cloudDir(request.cloudDir)
+	names, err := findCatalogs(ctx, cloud, cloudPath, request.host)
+	if err != nil {
+		logCloudError(err)
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no catalog in %s %s", cloud.name(), cloudPath)
+	}
+	// cloud settings are enough, working dir may be missing as well
+	var root = request.dir
+	if len(root) == 0 {
+		root = options.workingPath
+	}
+	if len(root) == 0 {
+		return errors.New("--to is expected, working dir is not set")
+	}
+	if root, err = sourcePath(root); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(root, 0700); err != nil {
+		return err
+	}
+
+	var failed int
+	var catalogs []Catalog
+	for _, name := range names {
+		catalog, err := loadCatalog(ctx, cloud, cloudPath + name, options)
+		if err == nil && len(request.host) > 0 && catalog.host != request.host {
+			err = fmt.Errorf("catalog is of host %s", catalog.host)
+		}
+		if err != nil {
+			logCloudError(err)
+			log.Printf("catalog %s not loaded: %v\n", name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("host %s, catalog of %s\n", catalog.host,
+			catalog.date.Local().Format("2006-01-02 15:04"))
+		for _, entry := range catalog.paths {
+			var newest = "-"
+			if len(entry.versions) > 0 {
+				newest = entry.versions[len(entry.versions) - 1]
+			}
+			fmt.Printf("  %s (%s, %s, %s, %d versions, %d bytes) %s\n", entry.path,
+				entry.layout, entry.compression, entry.encryption, len(entry.versions),
+				entry.size, newest)
+		}
+		catalogs = append(catalogs, catalog)
+	}
+
+	var restored = true
+	for _, catalog := range catalogs {
+		if request.list || ctx.Err() != nil {
+			break
+		}
+		var items []PathItem
+		for _, entry := range catalog.paths {
+			items = append(items, PathItem{path: entry.path, pathHash: entry.pathHash,
+				hostId: hostId(catalog.host), versions: entry.versions, cloud: cloud,
+				cloudPath: cloudPath, noEncryption: entry.encryption == "none"})
+		}
+		// the paths are laid out under the root as on the host,
+		// hosts may have the same paths
+		var dir = root
+		if len(catalogs) > 1 {
+			dir = filepath.Join(root, safeHostName(catalog.host))
+		}
+		log.Printf("recover paths of host %s to %s\n", catalog.host, dir)
+		var restore = RestoreRequest{all: true, pinned: true, dir: dir, conflict: request.conflict}
+		if len(items) > 0 && !restorePaths(ctx, items, restore, options) {
+			restored = false
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if !restored {
+		return errors.New("not all paths are restored")
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d catalogs not loaded", failed)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"./libs/filippo.io/age"
+)
+
+//------------------------------------------------------------------------------
+// paths with spaces, versions and every encryption
+func TestCatalogRoundTrip(t *testing.T) {
+	var cloud = CloudLocal{t.TempDir()}
+	var ctx = context.Background()
+	var catalog = Catalog{host: "host-1", date: time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC),
+		paths: []CatalogPath{
+			{path: "/data/my docs", pathHash: getStrHash("/data/my docs"), layout: "incremental",
+				compression: "zstd:19", encryption: "password", size: 1024,
+				versions: []string{"a-20240509T120000Z.bin", "a-20240510T120000Z+.bin"}},
+			{path: "/data/photos", pathHash: getStrHash("/data/photos"), layout: "repository",
+				compression: "none", encryption: "age"},
+		}}
+	var tests = []struct {
+		options   Options
+		encrypted bool
+	}{
+		{Options{}, false},
+		{Options{password: "secret"}, true},
+	}
+	for _, test := range tests {
+		data, err := catalog.encode(test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isEncrypted(data) != test.encrypted ||
+			!test.encrypted && !strings.Contains(string(data), "my docs") {
+			t.Fatalf("encrypted %v:\n%s", isEncrypted(data), data)
+		}
+		if err = putCommitted(ctx, cloud, "backup/catalog.bin", data); err != nil {
+			t.Fatal(err)
+		}
+		loaded, err := loadCatalog(ctx, cloud, "backup/catalog.bin", test.options)
+		if err != nil || !reflect.DeepEqual(loaded, catalog) {
+			t.Fatalf("loaded %+v: %v", loaded, err)
+		}
+	}
+	if _, err := loadCatalog(ctx, cloud, "backup/catalog.bin", Options{password: "wrong"}); err == nil {
+		t.Fatal("catalog is loaded with wrong password")
+	}
+
+	var broken = []string{
+		"cloud-backup catalog 2\n",
+		catalogHeader + "\nversion a.bin\n",
+		catalogHeader + "\npath hash archive xz\n",
+		catalogHeader + "\nhost\n",
+	}
+	for _, data := range broken {
+		putCommitted(ctx, cloud, "backup/catalog.bin", []byte(data))
+		if _, err := loadCatalog(ctx, cloud, "backup/catalog.bin", Options{}); err == nil {
+			t.Errorf("loaded %q", data)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestCatalogPath(t *testing.T) {
+	var identity = newIdentity(t)
+	var tests = []struct {
+		item       PathItem
+		layout     string
+		encryption string
+	}{
+		{PathItem{compression: noCompression}, "archive", "none"},
+		{PathItem{compression: noCompression, encryption: true}, "archive", "password"},
+		{PathItem{compression: noCompression, incremental: true, encryption: true,
+			recipients: []age.Recipient{identity.Recipient()}}, "incremental", "age"},
+		{PathItem{compression: noCompression, incremental: true, repository: true}, "repository", "none"},
+	}
+	for index, test := range tests {
+		var entry = catalogPath(test.item)
+		if entry.layout != test.layout || entry.encryption != test.encryption ||
+			entry.compression != "none" {
+			t.Errorf("%d: %+v", index, entry)
+		}
+	}
+	// replaced characters do not make names of other hosts
+	var names = []string{catalogName("vm-1.local"), catalogName("my host/1"), catalogName("my_host_1")}
+	if names[0] != "catalog-vm-1.local.bin" || names[2] != "catalog-my_host_1.bin" ||
+		!strings.HasPrefix(names[1], "catalog-my_host_1-") || names[1] == names[2] {
+		t.Fatalf("catalog names %v", names)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestParseRecoverArgs(t *testing.T) {
+	var tests = []struct {
+		args    string
+		request RecoverRequest
+		ok      bool
+	}{
+		{"--cloud s3", RecoverRequest{cloud: "s3", conflict: conflictOverwrite}, true},
+		{"--cloud local --cloud-dir backup --host h1 --list --to /tmp/r --conflict skip",
+			RecoverRequest{cloud: "local", cloudDir: "backup", host: "h1", list: true, dir: "/tmp/r",
+				conflict: conflictSkip}, true},
+		{"", RecoverRequest{}, false},
+		{"--cloud-dir backup", RecoverRequest{}, false},
+		{"--cloud", RecoverRequest{}, false},
+		{"--cloud s3 --conflict merge", RecoverRequest{}, false},
+		{"--cloud s3 /data", RecoverRequest{}, false},
+	}
+	for _, test := range tests {
+		request, err := parseRecoverArgs(strings.Fields(test.args))
+		if (err == nil) != test.ok || test.ok && request != test.request {
+			t.Errorf("%q: %+v, %v", test.args, request, err)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// catalog of the host is uploaded after backup, recover restores every path
+// by it under the target dir with the layout of the host
+func TestRecover(t *testing.T) {
+	var work = t.TempDir()
+	t.Chdir(work)
+	var sources = t.TempDir()
+	var docs, mail = filepath.Join(sources, "docs"), filepath.Join(sources, "mail")
+	writeTree(t, docs, map[string]string{"a.txt": "a", "sub/b.txt": "b"})
+	writeTree(t, mail, map[string]string{"inbox": "mail"})
+	var localDir = t.TempDir()
+	var cloud = CloudLocal{localDir}
+	var options = Options{stateFile: filepath.Join(work, "state"), workingPath: work + "/",
+		password: "secret", localDir: localDir}
+	var host = hostId(hostName())
+	var paths = []PathItem{
+		{path: docs, pathHash: getStrHash(docs), hostId: host, schedule: Once, encryption: true,
+			compression: fastCompression, retention: Retention{last: 10}, cloud: cloud,
+			cloudPath: "backup/"},
+		{path: mail, pathHash: getStrHash(mail), hostId: host, schedule: Once, incremental: true,
+			fullInterval: defaultFullInterval, compression: noCompression,
+			retention: Retention{last: 10}, cloud: cloud, cloudPath: "backup/"},
+	}
+	var ctx = context.Background()
+	backupPaths(ctx, paths, options, nil)
+	var catalog = filepath.Join(localDir, "backup", catalogName(hostName()))
+	if _, err := os.Stat(catalog); err != nil {
+		t.Fatalf("no catalog: %v", err)
+	}
+
+	var target = t.TempDir()
+	var request = RecoverRequest{cloud: "local", cloudDir: "backup", dir: target,
+		conflict: conflictOverwrite}
+	// list only
+	request.list = true
+	if err := recoverPaths(ctx, request, options); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, target, map[string]string{})
+	// versions newer than the catalog has are not restored
+	var docsVersion = paths[0].versions[len(paths[0].versions) - 1]
+	var newer = versionName(paths[0].pathHash, host, time.Now().Add(time.Hour))
+	if err := cloud.put(ctx, "backup/" + newer, strings.NewReader("broken"), -1); err != nil {
+		t.Fatal(err)
+	}
+	request.list = false
+	if err := recoverPaths(ctx, request, options); err != nil {
+		t.Fatal(err)
+	}
+	var restored = filepath.Join(target, sources)
+	checkTree(t, restored, map[string]string{"docs/": "", "docs/a.txt": "a", "docs/sub/": "",
+		"docs/sub/b.txt": "b", "mail/": "", "mail/inbox": "mail"})
+
+	// neither the working dir nor the target has to exist
+	options.workingPath = ""
+	request.dir = filepath.Join(t.TempDir(), "new")
+	if err := recoverPaths(ctx, request, options); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, filepath.Join(request.dir, sources, "mail"), map[string]string{"inbox": "mail"})
+	request.dir = ""
+	if err := recoverPaths(ctx, request, options); err == nil {
+		t.Fatal("recover without target dir")
+	}
+
+	// every host has own dir if there are several catalogs
+	var other = Catalog{host: "other/host", date: time.Now(),
+		paths: []CatalogPath{catalogPath(paths[0])}}
+	var otherVersion = versionName(paths[0].pathHash, hostId(other.host), time.Now())
+	other.paths[0].versions = []string{otherVersion}
+	data, err := ioutil.ReadFile(filepath.Join(localDir, "backup", docsVersion))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cloud.put(ctx, "backup/" + otherVersion, bytes.NewReader(data), -1); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := other.encode(options)
+	if err == nil {
+		err = cloud.put(ctx, "backup/" + catalogName(other.host), bytes.NewReader(encoded), -1)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.dir = t.TempDir()
+	if err = recoverPaths(ctx, request, options); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, filepath.Join(request.dir, safeHostName(hostName()), sources, "mail"),
+		map[string]string{"inbox": "mail"})
+	checkTree(t, filepath.Join(request.dir, safeHostName(other.host), sources), map[string]string{
+		"docs/": "", "docs/a.txt": "a", "docs/sub/": "", "docs/sub/b.txt": "b"})
+	request.dir = target
+
+	// the catalog of unknown host or wrong password fails
+	request.host = "other"
+	if err := recoverPaths(ctx, request, options); err == nil {
+		t.Fatal("catalog of other host is found")
+	}
+	request.host = ""
+	options.password = "wrong"
+	if err := recoverPaths(ctx, request, options); err == nil {
+		t.Fatal("recover with wrong password")
+	}
+}
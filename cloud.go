@@ -1,15 +1,237 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
-type Cloud interface {	
+// remote file, size is -1 if unknown
+type CloudFile struct {
+	name     string
+	size     int64
+	modified time.Time
+	dir      bool
+}
+
+type Cloud interface {
 	name() string
+	// external tool required, empty if none
 	command() string
-	remove(item string) ([]byte, error)
-	upload(localFile string, remoteFile string) ([]byte, error)
-	download(remoteFile string) ([]byte, error)
+	// put accepts stream of unknown size without local copy
+	streaming() bool
+	// size is -1 if unknown
+	put(ctx context.Context, remotePath string, reader io.Reader, size int64) error
+	get(ctx context.Context, remotePath string) (io.ReadCloser, error)
+	delete(ctx context.Context, remotePath string) error
+	// renames remote file, target is replaced
+	move(ctx context.Context, source string, target string) error
+	stat(ctx context.Context, remotePath string) (CloudFile, error)
+	// entries of remote directory, names are relative to it
+	list(ctx context.Context, remotePath string) ([]CloudFile, error)
+}
+
+// kinds of cloud errors, check with errors.Is
+var (
+	errNotFound    = errors.New("not found")
+	errQuota       = errors.New("quota exceeded")
+	errAuth        = errors.New("authentication failed")
+	errTransient   = errors.New("temporary failure")
+	errUnsupported = errors.New("not supported")
+)
+
+type CloudError struct {
+	op     string
+	path   string
+	kind   error
+	err    error
+	// tool output or response body
+	output []byte
+}
+
+func (this *CloudError) Error() string {
+	return this.op + " " + this.path + ": " + this.err.Error()
+}
+
+func (this *CloudError) Unwrap() error {
+	return this.err
+}
+
+func (this *CloudError) Is(target error) bool {
+	return this.kind != nil && this.kind == target
+}
+
+//------------------------------------------------------------------------------
+// kind is guessed from err if nil
+func newCloudError(op string, path string, kind error, err error, output []byte) error {
+	if err == nil {
+		err = kind
+	}
+	if kind == nil {
+		kind = classifyError(err)
+	}
+	return &CloudError{op, path, kind, err, output}
+}
+
+//------------------------------------------------------------------------------
+func classifyError(err error) error {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, os.ErrNotExist):
+		return errNotFound
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return errQuota
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.EPIPE), errors.Is(err, io.ErrUnexpectedEOF):
+		return errTransient
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return errTransient
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+func classifyStatus(code int) error {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return errAuth
+	case http.StatusNotFound:
+		return errNotFound
+	case http.StatusInsufficientStorage:
+		return errQuota
+	case http.StatusRequestTimeout, http.StatusTooManyRequests, http.StatusInternalServerError,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return errTransient
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// best guess for command line tools, they report errors as text only
+func classifyOutput(output []byte) error {
+	var text = strings.ToLower(string(output))
+	switch {
+	case strings.Contains(text, "not found"), strings.Contains(text, "no such file"):
+		return errNotFound
+	case strings.Contains(text, "quota"), strings.Contains(text, "insufficient storage"),
+		strings.Contains(text, "no space"):
+		return errQuota
+	case strings.Contains(text, "unauthorized"), strings.Contains(text, "authenticat"),
+		strings.Contains(text, "invalid_grant"):
+		return errAuth
+	case strings.Contains(text, "timeout"), strings.Contains(text, "timed out"),
+		strings.Contains(text, "connection reset"), strings.Contains(text, "temporar"):
+		return errTransient
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// drains response and turns unexpected status into error
+func checkResponse(resp *http.Response, op string, remotePath string, codes ...int) error {
+	defer resp.Body.Close()
+	output, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	for _, code := range codes {
+		if resp.StatusCode == code {
+			return nil
+		}
+	}
+	return newCloudError(op, remotePath, classifyStatus(resp.StatusCode),
+		errors.New(resp.Status), output)
+}
+
+//------------------------------------------------------------------------------
+// runs external tool directly, arguments are not interpreted by shell
+func runCommand(ctx context.Context, op string, remotePath string, name string,
+	args ...string) error {
+	var cmd = exec.CommandContext(ctx, name, args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return newCloudError(op, remotePath, classifyOutput(output), err, output)
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// command line tools need a real file: either the reader is the file already
+// or it is copied to the current directory under the given name,
+// returned function removes the copy
+func spoolFile(reader io.Reader, name string) (string, func(), error) {
+	if file, ok := reader.(*os.File); ok && filepath.Base(file.Name()) == name {
+		return file.Name(), func() {}, nil
+	}
+	file, err := os.Create(name)
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = io.Copy(file, reader)
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", nil, err
+	}
+	return name, func() { os.Remove(name) }, nil
+}
+
+// file downloaded by command line tool, removed on close
+type spooledFile struct {
+	*os.File
+}
+
+func (this spooledFile) Close() error {
+	err := this.File.Close()
+	os.Remove(this.Name())
+	return err
+}
+
+//------------------------------------------------------------------------------
+func openSpooled(op string, remotePath string, name string) (io.ReadCloser, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, newCloudError(op, remotePath, nil, err, nil)
+	}
+	return spooledFile{file}, nil
+}
+
+//------------------------------------------------------------------------------
+// remote directories known to exist: every file of a repository would
+// check its directory again otherwise
+type DirCache struct {
+	lock sync.Mutex
+	dirs map[string]bool
+}
+
+//------------------------------------------------------------------------------
+func newDirCache() *DirCache {
+	return &DirCache{dirs: make(map[string]bool)}
+}
+
+//------------------------------------------------------------------------------
+func (this *DirCache) exists(path string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.dirs[path]
+}
+
+//------------------------------------------------------------------------------
+func (this *DirCache) add(path string) {
+	this.lock.Lock()
+	this.dirs[path] = true
+	this.lock.Unlock()
 }
 
 type CloudGDrive struct { }
@@ -22,44 +244,78 @@ func (this CloudGDrive)command() string {
 	return "drive"
 }
 
-func (this CloudGDrive)remove(remoteFileName string) ([]byte, error) {
-	var content = "drive delete -quiet " + remoteFileName
-	var cmd = exec.Command("sh", "-c", content)
-	return cmd.CombinedOutput();
+func (this CloudGDrive)streaming() bool {
+	return false
 }
 
-// item.archive, options.remote_folder
-func (this CloudGDrive)upload(localFile string, remotePath string) ([]byte, error) {
-	var content = "drive push -quiet " + localFile
-	var cmd = exec.Command("sh", "-c", content)
-	return cmd.CombinedOutput();
+// drive pushes files of the inited local folder, so the archive has to be
+// in the current directory and remote directory is defined by it
+func (this CloudGDrive)put(ctx context.Context, remotePath string, reader io.Reader, size int64) error {
+	localFile, cleanup, err := spoolFile(reader, filepath.Base(remotePath))
+	if err != nil {
+		return newCloudError("push", remotePath, nil, err, nil)
+	}
+	defer cleanup()
+	return runCommand(ctx, "push", remotePath, "drive", "push", "-quiet", localFile)
 }
 
-func (this CloudGDrive)download(remotePath string) ([]byte, error) {
-	var content = "drive pull -quiet " + remotePath
-	var cmd = exec.Command("sh", "-c", content)
-	return cmd.CombinedOutput();
+func (this CloudGDrive)get(ctx context.Context, remotePath string) (io.ReadCloser, error) {
+	if err := runCommand(ctx, "pull", remotePath, "drive", "pull", "-quiet", remotePath); err != nil {
+		return nil, err
+	}
+	return openSpooled("pull", remotePath, filepath.Base(remotePath))
+}
+
+func (this CloudGDrive)delete(ctx context.Context, remotePath string) error {
+	return runCommand(ctx, "delete", remotePath, "drive", "delete", "-quiet", remotePath)
+}
+
+// names are relative to the drive folder, directory stays the same
+func (this CloudGDrive)move(ctx context.Context, source string, target string) error {
+	return runCommand(ctx, "rename", source, "drive", "rename", source, filepath.Base(target))
+}
+
+func (this CloudGDrive)stat(ctx context.Context, remotePath string) (CloudFile, error) {
+	return CloudFile{}, newCloudError("stat", remotePath, errUnsupported, nil, nil)
+}
+
+func (this CloudGDrive)list(ctx context.Context, remotePath string) ([]CloudFile, error) {
+	return nil, newCloudError("list", remotePath, errUnsupported, nil, nil)
 }
 
 type CloudYDisk struct { }
 
-func (this CloudYDisk)remove(remoteFileName string) ([]byte, error) {
-	var content = "ydcmd rm " + remoteFileName
-	var cmd = exec.Command("sh", "-c", content)
-	return cmd.CombinedOutput();
+func (this CloudYDisk)put(ctx context.Context, remotePath string, reader io.Reader, size int64) error {
+	localFile, cleanup, err := spoolFile(reader, filepath.Base(remotePath))
+	if err != nil {
+		return newCloudError("put", remotePath, nil, err, nil)
+	}
+	defer cleanup()
+	var dir = filepath.Dir(remotePath) + "/"
+	return runCommand(ctx, "put", remotePath, "ydcmd", "put", localFile, dir)
+}
+
+func (this CloudYDisk)get(ctx context.Context, remotePath string) (io.ReadCloser, error) {
+	if err := runCommand(ctx, "get", remotePath, "ydcmd", "get", "--quiet", remotePath); err != nil {
+		return nil, err
+	}
+	return openSpooled("get", remotePath, filepath.Base(remotePath))
 }
 
-// item.archive, options.remote_folder
-func (this CloudYDisk)upload(localFile string, remotePath string) ([]byte, error) {
-	var content = "ydcmd put " + localFile + "  " + remotePath
-	var cmd = exec.Command("sh", "-c", content)
-	return cmd.CombinedOutput();
+func (this CloudYDisk)delete(ctx context.Context, remotePath string) error {
+	return runCommand(ctx, "rm", remotePath, "ydcmd", "rm", remotePath)
 }
 
-func (this CloudYDisk)download(remotePath string) ([]byte, error) {
-	var content = "ydcmd get --quiet " + remotePath
-	var cmd = exec.Command("sh", "-c", content)
-	return cmd.CombinedOutput();
+func (this CloudYDisk)move(ctx context.Context, source string, target string) error {
+	return runCommand(ctx, "mv", source, "ydcmd", "mv", source, target)
+}
+
+func (this CloudYDisk)stat(ctx context.Context, remotePath string) (CloudFile, error) {
+	return CloudFile{}, newCloudError("stat", remotePath, errUnsupported, nil, nil)
+}
+
+func (this CloudYDisk)list(ctx context.Context, remotePath string) ([]CloudFile, error) {
+	return nil, newCloudError("list", remotePath, errUnsupported, nil, nil)
 }
 
 func (this CloudYDisk)name() string {
@@ -70,15 +326,52 @@ func (this CloudYDisk)command() string {
 	return "ydcmd"
 }
 
+func (this CloudYDisk)streaming() bool {
+	return false
+}
+
 //------------------------------------------------------------------------------
-func getCloudByName(name string) Cloud { 
+// nil if the name is unknown
+func getCloudByName(name string, options Options) (Cloud, error) {
 	switch name {
 	case "gdrive":
-		return CloudGDrive{};
-	case "ydisk": 
-		return CloudYDisk{};
-	}	
-	return nil
+		return CloudGDrive{}, nil
+	case "ydisk":
+		return CloudYDisk{}, nil
+	case "webdav":
+		if len(options.webdavURL) == 0 {
+			return nil, errors.New("webdav-url is not specified")
+		}
+		return newCloudWebDAV(options.webdavURL, options.webdavUser, options.webdavPassword), nil
+	case "s3":
+		if len(options.s3Endpoint) == 0 || len(options.s3Bucket) == 0 {
+			return nil, errors.New("s3-endpoint or s3-bucket is not specified")
+		}
+		return newCloudS3(options.s3Endpoint, options.s3Bucket, options.s3Region,
+			options.s3AccessKey, options.s3SecretKey), nil
+	case "local":
+		if len(options.localDir) == 0 {
+			return nil, errors.New("local-dir is not specified")
+		}
+		if _, err := os.Stat(options.localDir); err != nil {
+			return nil, fmt.Errorf("local-dir %s not accessible: %v", options.localDir, err)
+		}
+		return CloudLocal{options.localDir}, nil
+	case "sftp":
+		if len(options.sftpHost) == 0 || len(options.sftpKeyFile) == 0 {
+			return nil, errors.New("sftp-host or sftp-key-file is not specified")
+		}
+		cloud, err := newCloudSFTP(options.sftpHost, options.sftpPort, options.sftpUser,
+			options.sftpKeyFile, options.sftpKnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("sftp setup failed: %v", err)
+		}
+		return cloud, nil
+	case "rclone":
+		if len(options.rcloneRemote) == 0 {
+			return nil, errors.New("rclone-remote is not specified")
+		}
+		return CloudRclone{options.rcloneRemote, options.rcloneConfig}, nil
+	}
+	return nil, nil
 }
-
-
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// local directory: USB disk, NFS / SMB mount etc.
+type CloudLocal struct {
+	dir string
+}
+
+func (this CloudLocal) name() string {
+	return "Local " + this.dir
+}
+
+// no external tool needed
+func (this CloudLocal) command() string {
+	return ""
+}
+
+func (this CloudLocal) streaming() bool {
+	return true
+}
+
+//------------------------------------------------------------------------------
+// writes reader to the file and flushes it to the disk,
+// target is replaced atomically
+func writeFileSync(reader io.Reader, target string) error {
+	var temp = target + ".tmp"
+	output, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(output, reader); err == nil {
+		err = output.Sync()
+	}
+	if e := output.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(temp, target)
+	}
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+
+	syncDirectory(filepath.Dir(target))
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// makes rename durable
+func syncDirectory(path string) {
+	if dir, err := os.Open(path); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+}
+
+//------------------------------------------------------------------------------
+// io.Copy does not watch context, so reader does
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (this contextReader) Read(p []byte) (int, error) {
+	if err := this.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return this.reader.Read(p)
+}
+
+func (this CloudLocal) put(ctx context.Context, remotePath string, reader io.Reader, size int64) error {
+	var target = filepath.Join(this.dir, remotePath)
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return newCloudError("put", remotePath, nil, err, nil)
+	}
+	if err := writeFileSync(contextReader{ctx, reader}, target); err != nil {
+		return newCloudError("put", remotePath, nil, err, nil)
+	}
+	return nil
+}
+
+func (this CloudLocal) get(ctx context.Context, remotePath string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(this.dir, remotePath))
+	if err != nil {
+		return nil, newCloudError("get", remotePath, nil, err, nil)
+	}
+	return file, nil
+}
+
+func (this CloudLocal) delete(ctx context.Context, remotePath string) error {
+	if err := os.Remove(filepath.Join(this.dir, remotePath)); err != nil {
+		return newCloudError("delete", remotePath, nil, err, nil)
+	}
+	return nil
+}
+
+func (this CloudLocal) move(ctx context.Context, source string, target string) error {
+	var targetPath = filepath.Join(this.dir, target)
+	if err := os.MkdirAll(filepath.Dir(targetPath), 0700); err != nil {
+		return newCloudError("move", target, nil, err, nil)
+	}
+	if err := os.Rename(filepath.Join(this.dir, source), targetPath); err != nil {
+		return newCloudError("move", source, nil, err, nil)
+	}
+	syncDirectory(filepath.Dir(targetPath))
+	return nil
+}
+
+func (this CloudLocal) stat(ctx context.Context, remotePath string) (CloudFile, error) {
+	fi, err := os.Stat(filepath.Join(this.dir, remotePath))
+	if err != nil {
+		return CloudFile{}, newCloudError("stat", remotePath, nil, err, nil)
+	}
+	return CloudFile{remotePath, fi.Size(), fi.ModTime(), fi.IsDir()}, nil
+}
+
+func (this CloudLocal) list(ctx context.Context, remotePath string) ([]CloudFile, error) {
+	entries, err := os.ReadDir(filepath.Join(this.dir, remotePath))
+	if err != nil {
+		return nil, newCloudError("list", remotePath, nil, err, nil)
+	}
+	var files []CloudFile
+	for _, entry := range entries {
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, CloudFile{entry.Name(), fi.Size(), fi.ModTime(), fi.IsDir()})
+	}
+	return files, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//------------------------------------------------------------------------------
+func TestLocalCloud(t *testing.T) {
+	var dir = t.TempDir()
+	checkCloud(t, CloudLocal{dir})
+	// temp files of put are not left behind
+	matches, _ := filepath.Glob(filepath.Join(dir, "backup", "*", "*.tmp"))
+	if len(matches) > 0 {
+		t.Fatalf("temp files left: %v", matches)
+	}
+}
+
+//------------------------------------------------------------------------------
+// full disk is quota, the temp file is removed
+func TestLocalCloudQuota(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	var dir = t.TempDir()
+	if err := os.Symlink("/dev/full", filepath.Join(dir, "a.bin.tmp")); err != nil {
+		t.Fatal(err)
+	}
+	var err = CloudLocal{dir}.put(context.Background(), "a.bin", strings.NewReader("data"), 4)
+	checkKind(t, "put to full disk", err, errQuota)
+	if _, err = os.Lstat(filepath.Join(dir, "a.bin")); !os.IsNotExist(err) {
+		t.Fatalf("target is created: %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// any provider supported by rclone (https://rclone.org): OneDrive, Dropbox,
+// pCloud, Mega etc., remote must be configured with 'rclone config' first
+type CloudRclone struct {
+	remote string
+	config string
+}
+
+func (this CloudRclone) name() string {
+	return "rclone " + this.remote
+}
+
+func (this CloudRclone) command() string {
+	return "rclone"
+}
+
+func (this CloudRclone) streaming() bool {
+	return true
+}
+
+//------------------------------------------------------------------------------
+// arguments are passed as is, no shell involved
+func (this CloudRclone) cmd(ctx context.Context, args ...string) *exec.Cmd {
+	if len(this.config) > 0 {
+		args = append([]string{"--config", this.config}, args...)
+	}
+	return exec.CommandContext(ctx, "rclone", args...)
+}
+
+//------------------------------------------------------------------------------
+// rclone documents its exit codes, output is used for the rest
+func (this CloudRclone) cloudError(op string, remotePath string, err error, output []byte) error {
+	var kind error
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		switch exitErr.ExitCode() {
+		case 3, 4:
+			kind = errNotFound
+		case 5, 8:
+			// 8 is --max-transfer reached, the next run goes on
+			kind = errTransient
+		}
+	}
+	// full storage shows only in the text
+	if outputKind := classifyOutput(output); kind == nil || outputKind == errQuota {
+		kind = outputKind
+	}
+	return newCloudError(op, remotePath, kind, err, output)
+}
+
+//------------------------------------------------------------------------------
+func (this CloudRclone) run(ctx context.Context, op string, remotePath string,
+	args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	var cmd = this.cmd(ctx, args...)
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, this.cloudError(op, remotePath, err, stderr.Bytes())
+	}
+	return output, nil
+}
+
+//------------------------------------------------------------------------------
+func (this CloudRclone) location(remotePath string) string {
+	return this.remote + ":" + remotePath
+}
+
+// rcat streams stdin to the remote
+func (this CloudRclone) put(ctx context.Context, remotePath string, reader io.Reader, size int64) error {
+	var stderr bytes.Buffer
+	var cmd = this.cmd(ctx, "rcat", this.location(remotePath))
+	cmd.Stdin = reader
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return this.cloudError("rcat", remotePath, err, stderr.Bytes())
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// rclone process writing remote file to stdout
+type rcloneReader struct {
+	io.ReadCloser
+	cloud      CloudRclone
+	remotePath string
+	cmd        *exec.Cmd
+	stderr     *bytes.Buffer
+}
+
+func (this rcloneReader) Close() error {
+	this.ReadCloser.Close()
+	if err := this.cmd.Wait(); err != nil {
+		return this.cloud.cloudError("cat", this.remotePath, err, this.stderr.Bytes())
+	}
+	return nil
+}
+
+func (this CloudRclone) get(ctx context.Context, remotePath string) (io.ReadCloser, error) {
+	// cat silently succeeds for missing files
+	if _, err := this.stat(ctx, remotePath); err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	var cmd = this.cmd(ctx, "cat", this.location(remotePath))
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, newCloudError("cat", remotePath, nil, err, nil)
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, newCloudError("cat", remotePath, nil, err, nil)
+	}
+	return rcloneReader{stdout, this, remotePath, cmd, &stderr}, nil
+}
+
+func (this CloudRclone) delete(ctx context.Context, remotePath string) error {
+	_, err := this.run(ctx, "deletefile", remotePath, "deletefile", this.location(remotePath))
+	return err
+}
+
+func (this CloudRclone) move(ctx context.Context, source string, target string) error {
+	_, err := this.run(ctx, "moveto", source, "moveto", this.location(source), this.location(target))
+	return err
+}
+
+//------------------------------------------------------------------------------
+// lsjson item
+type rcloneItem struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+func (this CloudRclone) stat(ctx context.Context, remotePath string) (CloudFile, error) {
+	output, err := this.run(ctx, "lsjson", remotePath, "lsjson", "--stat", this.location(remotePath))
+	if err != nil {
+		return CloudFile{}, err
+	}
+	var item rcloneItem
+	if err = json.Unmarshal(output, &item); err != nil {
+		return CloudFile{}, newCloudError("lsjson", remotePath, nil, err, output)
+	}
+	return CloudFile{remotePath, item.Size, item.ModTime, item.IsDir}, nil
+}
+
+func (this CloudRclone) list(ctx context.Context, remotePath string) ([]CloudFile, error) {
+	// root of the remote is remote: as for put and get, not remote:/
+	var dir = strings.TrimRight(remotePath, "/")
+	if len(dir) > 0 {
+		dir += "/"
+	}
+	output, err := this.run(ctx, "lsjson", remotePath, "lsjson", this.location(dir))
+	if err != nil {
+		return nil, err
+	}
+	var items []rcloneItem
+	if err = json.Unmarshal(output, &items); err != nil {
+		return nil, newCloudError("lsjson", remotePath, nil, err, output)
+	}
+	var files []CloudFile
+	for _, item := range items {
+		files = append(files, CloudFile{item.Path, item.Size, item.ModTime, item.IsDir})
+	}
+	return files, nil
+}
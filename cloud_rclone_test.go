@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the test binary is the fake rclone when it is started with the root set
+const (
+	fakeRcloneRoot   = "FAKE_RCLONE_ROOT"
+	fakeRcloneConfig = "FAKE_RCLONE_CONFIG"
+)
+
+//------------------------------------------------------------------------------
+func TestMain(m *testing.M) {
+	if len(os.Getenv(fakeRcloneRoot)) > 0 {
+		os.Exit(fakeRclone(os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+//------------------------------------------------------------------------------
+func fakeRcloneItem(name string, fi os.FileInfo) rcloneItem {
+	var item = rcloneItem{Path: name, Size: fi.Size(), ModTime: fi.ModTime(), IsDir: fi.IsDir()}
+	if item.IsDir {
+		item.Size = -1
+	}
+	return item
+}
+
+//------------------------------------------------------------------------------
+// commands the client runs on remote: over the root dir, exit codes as
+// documented by rclone
+func fakeRclone(args []string) int {
+	var fail = func(code int, format string, values ...interface{}) int {
+		fmt.Fprintf(os.Stderr, "ERROR : " + format + "\n", values...)
+		return code
+	}
+	var config = os.Getenv(fakeRcloneConfig)
+	if len(args) > 1 && args[0] == "--config" {
+		if args[1] != config {
+			return fail(1, "config file %q not found", args[1])
+		}
+		args = args[2:]
+	} else if len(config) > 0 {
+		return fail(1, "didn't find section in config file")
+	}
+	if len(args) < 2 {
+		return fail(1, "command is expected")
+	}
+	var stat = args[1] == "--stat"
+	var paths []string
+	for _, arg := range args[1:] {
+		if arg == "--stat" {
+			continue
+		}
+		var location = strings.SplitN(arg, ":", 2)
+		if len(location) != 2 || location[0] != "remote" {
+			return fail(1, "didn't find section in config file %q", location[0])
+		}
+		switch {
+		case strings.HasPrefix(location[1], "/"):
+			return fail(1, "%s: path is absolute, root of the remote is remote:", arg)
+		case strings.Contains(location[1], "quota"):
+			return fail(1, "googleapi: Error 403: The user's Drive storage quota has been exceeded")
+		case strings.Contains(location[1], "limit"):
+			return fail(8, "Failed to copy: max transfer limit reached as set by --max-transfer")
+		case strings.Contains(location[1], "flaky"):
+			return fail(5, "Failed to copy: failed to open source object")
+		case strings.Contains(location[1], "auth"):
+			return fail(1, "couldn't fetch token: 401 Unauthorized")
+		}
+		paths = append(paths, filepath.Join(os.Getenv(fakeRcloneRoot), filepath.FromSlash(location[1])))
+	}
+
+	var local = paths[0]
+	switch {
+	case args[0] == "rcat" && len(paths) == 1:
+		if err := os.MkdirAll(filepath.Dir(local), 0700); err != nil {
+			return fail(1, "%v", err)
+		}
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err == nil {
+			err = ioutil.WriteFile(local, data, 0600)
+		}
+		if err != nil {
+			return fail(1, "%v", err)
+		}
+	case args[0] == "cat" && len(paths) == 1:
+		// missing file is no error
+		if file, err := os.Open(local); err == nil {
+			io.Copy(os.Stdout, file)
+			file.Close()
+		}
+	case args[0] == "deletefile" && len(paths) == 1:
+		if err := os.Remove(local); err != nil {
+			return fail(4, "%s: object not found", args[1])
+		}
+	case args[0] == "moveto" && len(paths) == 2:
+		if _, err := os.Stat(local); err != nil {
+			return fail(4, "%s: object not found", args[1])
+		}
+		if err := os.MkdirAll(filepath.Dir(paths[1]), 0700); err != nil {
+			return fail(1, "%v", err)
+		}
+		if err := os.Rename(local, paths[1]); err != nil {
+			return fail(1, "%v", err)
+		}
+	case args[0] == "lsjson" && len(paths) == 1:
+		fi, err := os.Stat(local)
+		if err != nil {
+			return fail(3, "error listing: directory not found")
+		}
+		var output interface{} = fakeRcloneItem(filepath.Base(local), fi)
+		if !stat {
+			entries, err := ioutil.ReadDir(local)
+			if err != nil {
+				return fail(1, "%v", err)
+			}
+			var items = []rcloneItem{}
+			for _, entry := range entries {
+				items = append(items, fakeRcloneItem(entry.Name(), entry))
+			}
+			output = items
+		}
+		json.NewEncoder(os.Stdout).Encode(output)
+	default:
+		return fail(1, "unknown command %q", args)
+	}
+	return 0
+}
+
+//------------------------------------------------------------------------------
+// rclone on the path is the test binary working over a temp dir
+func startFakeRclone(t *testing.T, config string) string {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bin = t.TempDir()
+	if err = os.Symlink(executable, filepath.Join(bin, "rclone")); err != nil {
+		t.Fatal(err)
+	}
+	var root = t.TempDir()
+	t.Setenv("PATH", bin + string(os.PathListSeparator) + os.Getenv("PATH"))
+	t.Setenv(fakeRcloneRoot, root)
+	t.Setenv(fakeRcloneConfig, config)
+	return root
+}
+
+//------------------------------------------------------------------------------
+func TestRcloneCloud(t *testing.T) {
+	for _, config := range []string{"", "/etc/rclone test.conf"} {
+		t.Run(fmt.Sprintf("config=%q", config), func(t *testing.T) {
+			startFakeRclone(t, config)
+			var cloud = CloudRclone{remote: "remote", config: config}
+			checkCloud(t, cloud)
+			// root of the remote
+			if names := listRemote(t, cloud, ""); fmt.Sprint(names) != "[backup/]" {
+				t.Fatalf("list of root: %v", names)
+			}
+			if names := listRemote(t, cloud, "/"); fmt.Sprint(names) != "[backup/]" {
+				t.Fatalf("list of root: %v", names)
+			}
+		})
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestRcloneErrors(t *testing.T) {
+	startFakeRclone(t, "")
+	var cloud = CloudRclone{remote: "remote"}
+	var ctx = context.Background()
+	checkKind(t, "quota", cloud.put(ctx, "backup/quota.bin", strings.NewReader("a"), 1), errQuota)
+	checkKind(t, "limit", cloud.put(ctx, "backup/limit.bin", strings.NewReader("a"), 1), errTransient)
+	_, err := cloud.stat(ctx, "backup/flaky.bin")
+	checkKind(t, "flaky", err, errTransient)
+	_, err = cloud.get(ctx, "backup/auth.bin")
+	checkKind(t, "auth", err, errAuth)
+	_, err = cloud.list(ctx, "backup/none")
+	checkKind(t, "list missing", err, errNotFound)
+	var cloudErr *CloudError
+	if !errors.As(err, &cloudErr) || !strings.Contains(string(cloudErr.output), "directory not found") {
+		t.Fatalf("output is not kept: %v", err)
+	}
+
+	// unknown remote is no kind of them
+	_, err = CloudRclone{remote: "other"}.stat(ctx, "backup")
+	for _, kind := range []error{errNotFound, errQuota, errAuth, errTransient} {
+		if err == nil || errors.Is(err, kind) {
+			t.Fatalf("unknown remote: %v", err)
+		}
+	}
+
+	// process is killed with the context
+	ctx, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	time.Sleep(2 * time.Millisecond)
+	if err = cloud.put(ctx, "backup/a.bin", strings.NewReader("a"), 1); err == nil {
+		t.Fatal("put with cancelled context")
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archives larger than that are uploaded in parts,
+// S3 requires every part but the last to be at least 5 MiB
+const s3PartSize = 16 << 20
+
+// server side copy limit for a single request or part
+const s3CopyPartSize = 5 << 30
+
+// S3 compatible object storage: AWS S3, MinIO, Backblaze B2, Wasabi etc.
+// Path-style addressing is used: endpoint/bucket/key
+type CloudS3 struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	partSize  int64
+	client    *http.Client
+}
+
+//------------------------------------------------------------------------------
+func newCloudS3(endpoint string, bucket string, region string,
+	accessKey string, secretKey string) CloudS3 {
+	if len(region) == 0 {
+		region = "us-east-1"
+	}
+	return CloudS3{
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		partSize:  s3PartSize,
+		client:    &http.Client{},
+	}
+}
+
+func (this CloudS3) name() string {
+	return "S3 " + this.bucket
+}
+
+// no external tool needed
+func (this CloudS3) command() string {
+	return ""
+}
+
+// large archives go in parts
+func (this CloudS3) streaming() bool {
+	return true
+}
+
+//------------------------------------------------------------------------------
+// URI encoding as required by SigV4: everything but unreserved characters
+func s3Escape(str string, keepSlash bool) string {
+	var buffer bytes.Buffer
+	for _, b := range []byte(str) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (b == '/' && keepSlash) {
+			buffer.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buffer, "%%%02X", b)
+		}
+	}
+	return buffer.String()
+}
+
+//------------------------------------------------------------------------------
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+//------------------------------------------------------------------------------
+func sha256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+//------------------------------------------------------------------------------
+// signs request with AWS Signature Version 4
+func (this CloudS3) sign(req *http.Request, payloadHash string, now time.Time) {
+	var amzDate = now.UTC().Format("20060102T150405Z")
+	var date = amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	var names []string
+	var headers = make(map[string]string)
+	headers["host"] = req.URL.Host
+	for key, values := range req.Header {
+		key = strings.ToLower(key)
+		if key == "content-type" || key == "content-md5" || strings.HasPrefix(key, "x-amz-") {
+			headers[key] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	for key := range headers {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	var canonical bytes.Buffer
+	canonical.WriteString(req.Method + "\n")
+	canonical.WriteString(req.URL.EscapedPath() + "\n")
+	canonical.WriteString(req.URL.RawQuery + "\n")
+	for _, key := range names {
+		canonical.WriteString(key + ":" + headers[key] + "\n")
+	}
+	var signedHeaders = strings.Join(names, ";")
+	canonical.WriteString("\n" + signedHeaders + "\n")
+	canonical.WriteString(payloadHash)
+
+	var scope = date + "/" + this.region + "/s3/aws4_request"
+	var stringToSign = "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		sha256Hex(canonical.Bytes())
+
+	key := hmacSHA256([]byte("AWS4"+this.secretKey), date)
+	key = hmacSHA256(key, this.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	var signature = hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+this.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+//------------------------------------------------------------------------------
+// query is a list of key, value pairs, empty key addresses the bucket
+func (this CloudS3) request(ctx context.Context, method string, key string, query []string,
+	header map[string]string, payload []byte) (*http.Response, error) {
+	var pairs []string
+	for n := 0; n+1 < len(query); n += 2 {
+		pairs = append(pairs, s3Escape(query[n], false)+"="+s3Escape(query[n+1], false))
+	}
+	sort.Strings(pairs)
+
+	var path = "/" + this.bucket
+	if len(key) > 0 {
+		path += "/" + strings.TrimLeft(key, "/")
+	}
+	var location = this.endpoint + s3Escape(path, true)
+	if len(pairs) > 0 {
+		location += "?" + strings.Join(pairs, "&")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, location, bytes.NewReader(payload))
+	if err != nil {
+		return nil, newCloudError(method, key, nil, err, nil)
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	this.sign(req, sha256Hex(payload), time.Now())
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return nil, newCloudError(method, key, nil, err, nil)
+	}
+	return resp, nil
+}
+
+// archives up to part size are sent at once, larger ones in parts,
+// so the size does not need to be known in advance
+func (this CloudS3) put(ctx context.Context, remotePath string, reader io.Reader, size int64) error {
+	var buffer = make([]byte, this.partSize)
+	n, err := io.ReadFull(reader, buffer)
+	if err == nil {
+		return this.putMultipart(ctx, remotePath, io.MultiReader(bytes.NewReader(buffer[:n]), reader))
+	}
+	if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return newCloudError("PUT", remotePath, nil, err, nil)
+	}
+
+	resp, err := this.request(ctx, "PUT", remotePath, nil, nil, buffer[:n])
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, "PUT", remotePath, http.StatusOK)
+}
+
+//------------------------------------------------------------------------------
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+//------------------------------------------------------------------------------
+func (this CloudS3) initiateMultipart(ctx context.Context, key string) (string, error) {
+	resp, err := this.request(ctx, "POST", key, []string{"uploads", ""}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", checkResponse(resp, "POST", key, http.StatusOK)
+	}
+	var initiate struct {
+		UploadId string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiate)
+	resp.Body.Close()
+	if err != nil {
+		return "", newCloudError("POST", key, nil, err, nil)
+	}
+	return initiate.UploadId, nil
+}
+
+//------------------------------------------------------------------------------
+// do not leave orphan parts, they are billed
+func (this CloudS3) abortMultipart(key string, uploadId string) {
+	var query = []string{"uploadId", uploadId}
+	if resp, err := this.request(context.Background(), "DELETE", key, query, nil, nil); err == nil {
+		resp.Body.Close()
+	}
+}
+
+//------------------------------------------------------------------------------
+func (this CloudS3) putMultipart(ctx context.Context, key string, reader io.Reader) error {
+	uploadId, err := this.initiateMultipart(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err = this.putParts(ctx, key, reader, uploadId); err != nil {
+		this.abortMultipart(key, uploadId)
+	}
+	return err
+}
+
+//------------------------------------------------------------------------------
+func (this CloudS3) putParts(ctx context.Context, key string, reader io.Reader, uploadId string) error {
+	var complete s3CompleteMultipartUpload
+	var buffer = make([]byte, this.partSize)
+	for number := 1; ; number++ {
+		n, err := io.ReadFull(reader, buffer)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return newCloudError("PUT", key, nil, err, nil)
+		}
+
+		var query = []string{"partNumber", strconv.Itoa(number), "uploadId", uploadId}
+		resp, err := this.request(ctx, "PUT", key, query, nil, buffer[:n])
+		if err != nil {
+			return err
+		}
+		var etag = resp.Header.Get("ETag")
+		if err = checkResponse(resp, "PUT", key, http.StatusOK); err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, s3Part{number, etag})
+		if n < len(buffer) {
+			break
+		}
+	}
+
+	return this.completeMultipart(ctx, key, uploadId, complete)
+}
+
+//------------------------------------------------------------------------------
+func (this CloudS3) completeMultipart(ctx context.Context, key string, uploadId string,
+	complete s3CompleteMultipartUpload) error {
+	payload, err := xml.Marshal(complete)
+	if err != nil {
+		return newCloudError("POST", key, nil, err, nil)
+	}
+	resp, err := this.request(ctx, "POST", key, []string{"uploadId", uploadId}, nil, payload)
+	if err != nil {
+		return err
+	}
+	// completion may fail with 200 status and error in the body
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || bytes.Contains(body, []byte("<Error>")) {
+		return newCloudError("POST", key, classifyStatus(resp.StatusCode),
+			fmt.Errorf("complete multipart upload failed: %s", resp.Status), body)
+	}
+	return nil
+}
+
+func (this CloudS3) get(ctx context.Context, remotePath string) (io.ReadCloser, error) {
+	resp, err := this.request(ctx, "GET", remotePath, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, checkResponse(resp, "GET", remotePath, http.StatusOK)
+	}
+	return resp.Body, nil
+}
+
+func (this CloudS3) delete(ctx context.Context, remotePath string) error {
+	// S3 reports success for missing keys
+	if _, err := this.stat(ctx, remotePath); err != nil {
+		return err
+	}
+	resp, err := this.request(ctx, "DELETE", remotePath, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, "DELETE", remotePath, http.StatusOK, http.StatusNoContent)
+}
+
+//------------------------------------------------------------------------------
+// server side copy, the reply may be an error in spite of 200 status
+func (this CloudS3) copy(ctx context.Context, source string, target string,
+	query []string, header map[string]string) (*http.Response, []byte, error) {
+	if header == nil {
+		header = make(map[string]string)
+	}
+	header["x-amz-copy-source"] = s3Escape("/" + this.bucket + "/" + strings.TrimLeft(source, "/"), true)
+	resp, err := this.request(ctx, "PUT", target, query, header, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || bytes.Contains(body, []byte("<Error>")) {
+		return nil, nil, newCloudError("PUT", target, classifyStatus(resp.StatusCode),
+			fmt.Errorf("copy from %s failed: %s", source, resp.Status), body)
+	}
+	return resp, body, nil
+}
+
+//------------------------------------------------------------------------------
+// objects over 5 GiB cannot be copied at once
+func (this CloudS3) copyMultipart(ctx context.Context, source string, target string,
+	size int64) error {
+	uploadId, err := this.initiateMultipart(ctx, target)
+	if err != nil {
+		return err
+	}
+	var complete s3CompleteMultipartUpload
+	for offset, number := int64(0), 1; offset < size; number++ {
+		var last = offset + s3CopyPartSize - 1
+		if last >= size {
+			last = size - 1
+		}
+		var query = []string{"partNumber", strconv.Itoa(number), "uploadId", uploadId}
+		var header = map[string]string{
+			"x-amz-copy-source-range": fmt.Sprintf("bytes=%d-%d", offset, last),
+		}
+		_, body, err := this.copy(ctx, source, target, query, header)
+		if err != nil {
+			this.abortMultipart(target, uploadId)
+			return err
+		}
+		var result struct {
+			ETag string
+		}
+		xml.Unmarshal(body, &result)
+		complete.Parts = append(complete.Parts, s3Part{number, result.ETag})
+		offset = last + 1
+	}
+	if err = this.completeMultipart(ctx, target, uploadId, complete); err != nil {
+		this.abortMultipart(target, uploadId)
+	}
+	return err
+}
+
+// S3 has no rename: copy then delete
+func (this CloudS3) move(ctx context.Context, source string, target string) error {
+	file, err := this.stat(ctx, source)
+	if err != nil {
+		return err
+	}
+	if file.size > s3CopyPartSize {
+		err = this.copyMultipart(ctx, source, target, file.size)
+	} else {
+		_, _, err = this.copy(ctx, source, target, nil, nil)
+	}
+	if err != nil {
+		return err
+	}
+	return this.delete(ctx, source)
+}
+
+func (this CloudS3) stat(ctx context.Context, remotePath string) (CloudFile, error) {
+	resp, err := this.request(ctx, "HEAD", remotePath, nil, nil, nil)
+	if err != nil {
+		return CloudFile{}, err
+	}
+	if err = checkResponse(resp, "HEAD", remotePath, http.StatusOK); err != nil {
+		return CloudFile{}, err
+	}
+	var file = CloudFile{name: remotePath, size: resp.ContentLength}
+	file.modified, _ = time.Parse(http.TimeFormat, resp.Header.Get("Last-Modified"))
+	return file, nil
+}
+
+//------------------------------------------------------------------------------
+// ListObjectsV2 reply
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key          string
+		Size         int64
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (this CloudS3) list(ctx context.Context, remotePath string) ([]CloudFile, error) {
+	var prefix = strings.Trim(remotePath, "/")
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	var files []CloudFile
+	var token string
+	for {
+		var query = []string{"list-type", "2", "prefix", prefix, "delimiter", "/"}
+		if len(token) > 0 {
+			query = append(query, "continuation-token", token)
+		}
+		resp, err := this.request(ctx, "GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, checkResponse(resp, "GET", remotePath, http.StatusOK)
+		}
+		var reply s3ListBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&reply)
+		resp.Body.Close()
+		if err != nil {
+			return nil, newCloudError("GET", remotePath, nil, err, nil)
+		}
+
+		for _, item := range reply.Contents {
+			files = append(files, CloudFile{name: strings.TrimPrefix(item.Key, prefix),
+				size: item.Size, modified: item.LastModified})
+		}
+		for _, item := range reply.CommonPrefixes {
+			var name = strings.TrimSuffix(strings.TrimPrefix(item.Prefix, prefix), "/")
+			files = append(files, CloudFile{name: name, size: -1, dir: true})
+		}
+		if !reply.IsTruncated {
+			break
+		}
+		token = reply.NextContinuationToken
+	}
+	return files, nil
+}
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"./libs/golang.org/x/crypto/ssh"
+	"./libs/golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP protocol version 3, draft-ietf-secsh-filexfer-02
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpOpenDir  = 11
+	sftpReadDir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+	sftpExtended = 200
+
+	sftpFlagRead     = 0x01
+	sftpFlagWrite    = 0x02
+	sftpFlagCreate   = 0x08
+	sftpFlagTruncate = 0x10
+
+	sftpStatusOK               = 0
+	sftpStatusEOF              = 1
+	sftpStatusNotFound         = 2
+	sftpStatusPermissionDenied = 3
+	sftpStatusNoConnection     = 6
+	sftpStatusConnectionLost   = 7
+
+	sftpAttrSize        = 0x01
+	sftpAttrUidGid      = 0x02
+	sftpAttrPermissions = 0x04
+	sftpAttrTime        = 0x08
+	sftpAttrExtended    = 0x80000000
+
+	// safe for every server
+	sftpChunkSize = 32 * 1024
+	// writes sent before waiting for the reply
+	sftpWindow = 32
+
+	// connections kept for the next operations and for how long
+	sftpMaxIdle     = 4
+	sftpIdleTimeout = time.Minute
+)
+
+// any SSH server with sftp subsystem, key based authentication
+type CloudSFTP struct {
+	address string
+	config  *ssh.ClientConfig
+	idle    *sftpPool
+	dirs    *DirCache
+}
+
+// connections of finished operations, so chunks of repository do not pay
+// a handshake each; closed if nobody takes them for a while
+type sftpPool struct {
+	lock  sync.Mutex
+	conns []*sftpIdle
+}
+
+type sftpIdle struct {
+	conn  *sftpConn
+	timer *time.Timer
+}
+
+//------------------------------------------------------------------------------
+func newCloudSFTP(host string, port int, user string, keyFile string,
+	knownHostsFile string) (CloudSFTP, error) {
+	var cloud CloudSFTP
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return cloud, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return cloud, fmt.Errorf("bad key %s: %v", keyFile, err)
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return cloud, err
+	}
+	cloud.address = net.JoinHostPort(host, strconv.Itoa(port))
+	cloud.config = &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+	cloud.idle = &sftpPool{}
+	cloud.dirs = newDirCache()
+	return cloud, nil
+}
+
+//------------------------------------------------------------------------------
+// idle connection or nil
+func (this *sftpPool) take() *sftpConn {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for len(this.conns) > 0 {
+		var entry = this.conns[len(this.conns) - 1]
+		this.conns = this.conns[:len(this.conns) - 1]
+		// expired one is closed by its timer
+		if entry.timer.Stop() {
+			return entry.conn
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpPool) put(conn *sftpConn) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if len(this.conns) >= sftpMaxIdle {
+		conn.close()
+		return
+	}
+	var entry = &sftpIdle{conn: conn}
+	entry.timer = time.AfterFunc(sftpIdleTimeout, func() {
+		this.lock.Lock()
+		for index, item := range this.conns {
+			if item == entry {
+				this.conns = append(this.conns[:index], this.conns[index + 1:]...)
+				break
+			}
+		}
+		this.lock.Unlock()
+		conn.close()
+	})
+	this.conns = append(this.conns, entry)
+}
+
+func (this CloudSFTP) name() string {
+	return "SFTP " + this.address
+}
+
+// no external tool needed
+func (this CloudSFTP) command() string {
+	return ""
+}
+
+func (this CloudSFTP) streaming() bool {
+	return true
+}
+
+//------------------------------------------------------------------------------
+type sftpError struct {
+	code    uint32
+	message string
+}
+
+func (this sftpError) Error() string {
+	return fmt.Sprintf("sftp error %d: %s", this.code, this.message)
+}
+
+//------------------------------------------------------------------------------
+type sftpConn struct {
+	client     *ssh.Client
+	session    *ssh.Session
+	input      io.WriteCloser
+	output     io.Reader
+	id         uint32
+	extensions map[string]string
+}
+
+//------------------------------------------------------------------------------
+func sftpString(data []byte, str string) []byte {
+	data = binary.BigEndian.AppendUint32(data, uint32(len(str)))
+	return append(data, str...)
+}
+
+//------------------------------------------------------------------------------
+func sftpTakeUint32(data []byte) (uint32, []byte, error) {
+	if len(data) < 4 {
+		return 0, nil, errors.New("sftp packet too short")
+	}
+	return binary.BigEndian.Uint32(data), data[4:], nil
+}
+
+//------------------------------------------------------------------------------
+func sftpTakeString(data []byte) (string, []byte, error) {
+	size, data, err := sftpTakeUint32(data)
+	if err != nil {
+		return "", nil, err
+	}
+	if uint32(len(data)) < size {
+		return "", nil, errors.New("sftp packet too short")
+	}
+	return string(data[:size]), data[size:], nil
+}
+
+//------------------------------------------------------------------------------
+func (this CloudSFTP) connect(ctx context.Context) (*sftpConn, error) {
+	var conn sftpConn
+	var dialer = net.Dialer{Timeout: this.config.Timeout}
+	socket, err := dialer.DialContext(ctx, "tcp", this.address)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(socket, this.address, this.config)
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+	conn.client = ssh.NewClient(sshConn, channels, requests)
+	if conn.session, err = conn.client.NewSession(); err == nil {
+		if conn.input, err = conn.session.StdinPipe(); err == nil {
+			if conn.output, err = conn.session.StdoutPipe(); err == nil {
+				err = conn.session.RequestSubsystem("sftp")
+			}
+		}
+	}
+	if err == nil {
+		err = conn.init()
+	}
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+	return &conn, nil
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpConn) close() {
+	if this.session != nil {
+		this.session.Close()
+	}
+	this.client.Close()
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpConn) writePacket(kind byte, payload []byte) error {
+	var header = binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	_, err := this.input.Write(append(append(header, kind), payload...))
+	return err
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpConn) readPacket() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(this.output, header[:]); err != nil {
+		return 0, nil, err
+	}
+	var size = binary.BigEndian.Uint32(header[:4])
+	if size < 1 || size > 1<<20 {
+		return 0, nil, fmt.Errorf("bad sftp packet size %d", size)
+	}
+	var data = make([]byte, size-1)
+	if _, err := io.ReadFull(this.output, data); err != nil {
+		return 0, nil, err
+	}
+	return header[4], data, nil
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpConn) init() error {
+	if err := this.writePacket(sftpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return err
+	}
+	kind, data, err := this.readPacket()
+	if err != nil {
+		return err
+	}
+	if kind != sftpVersion {
+		return fmt.Errorf("unexpected sftp packet %d", kind)
+	}
+	if _, data, err = sftpTakeUint32(data); err != nil {
+		return err
+	}
+	this.extensions = make(map[string]string)
+	for len(data) > 0 {
+		var name, value string
+		if name, data, err = sftpTakeString(data); err != nil {
+			return err
+		}
+		if value, data, err = sftpTakeString(data); err != nil {
+			return err
+		}
+		this.extensions[name] = value
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// sends request without waiting for the reply
+func (this *sftpConn) send(kind byte, payload []byte) (uint32, error) {
+	this.id++
+	return this.id, this.writePacket(kind, append(binary.BigEndian.AppendUint32(nil, this.id), payload...))
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpConn) receive() (byte, uint32, []byte, error) {
+	kind, data, err := this.readPacket()
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	id, data, err := sftpTakeUint32(data)
+	return kind, id, data, err
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpConn) request(kind byte, payload []byte) (byte, []byte, error) {
+	id, err := this.send(kind, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	reply, replyId, data, err := this.receive()
+	if err == nil && replyId != id {
+		err = fmt.Errorf("unexpected sftp reply id %d", replyId)
+	}
+	return reply, data, err
+}
+
+//------------------------------------------------------------------------------
+// nil for ok status, sftpError otherwise
+func sftpCheckStatus(kind byte, data []byte) error {
+	if kind != sftpStatus {
+		return fmt.Errorf("unexpected sftp packet %d", kind)
+	}
+	code, data, err := sftpTakeUint32(data)
+	if err != nil {
+		return err
+	}
+	if code == sftpStatusOK {
+		return nil
+	}
+	message, _, _ := sftpTakeString(data)
+	return sftpError{code, message}
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpConn) call(kind byte, payload []byte) error {
+	reply, data, err := this.request(kind, payload)
+	if err != nil {
+		return err
+	}
+	return sftpCheckStatus(reply, data)
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpConn) open(path string, flags uint32) (string, error) {
+	var payload = sftpString(nil, path)
+	payload = binary.BigEndian.AppendUint32(payload, flags)
+	// attributes: none
+	payload = binary.BigEndian.AppendUint32(payload, 0)
+	reply, data, err := this.request(sftpOpen, payload)
+	if err != nil {
+		return "", err
+	}
+	if reply != sftpHandle {
+		return "", sftpCheckStatus(reply, data)
+	}
+	handle, _, err := sftpTakeString(data)
+	return handle, err
+}
+
+//------------------------------------------------------------------------------
+// reads ATTRS structure
+func sftpTakeAttrs(data []byte) (CloudFile, []byte, error) {
+	var file = CloudFile{size: -1}
+	var tooShort = errors.New("sftp packet too short")
+	flags, data, err := sftpTakeUint32(data)
+	if err != nil {
+		return file, nil, err
+	}
+	if flags&sftpAttrSize != 0 {
+		if len(data) < 8 {
+			return file, nil, tooShort
+		}
+		file.size = int64(binary.BigEndian.Uint64(data))
+		data = data[8:]
+	}
+	if flags&sftpAttrUidGid != 0 {
+		if len(data) < 8 {
+			return file, nil, tooShort
+		}
+		data = data[8:]
+	}
+	if flags&sftpAttrPermissions != 0 {
+		var mode uint32
+		if mode, data, err = sftpTakeUint32(data); err != nil {
+			return file, nil, err
+		}
+		file.dir = mode&0170000 == 0040000
+	}
+	if flags&sftpAttrTime != 0 {
+		if len(data) < 8 {
+			return file, nil, tooShort
+		}
+		file.modified = time.Unix(int64(binary.BigEndian.Uint32(data[4:])), 0)
+		data = data[8:]
+	}
+	if flags&sftpAttrExtended != 0 {
+		var count uint32
+		if count, data, err = sftpTakeUint32(data); err != nil {
+			return file, nil, err
+		}
+		for ; count > 0; count-- {
+			if _, data, err = sftpTakeString(data); err != nil {
+				return file, nil, err
+			}
+			if _, data, err = sftpTakeString(data); err != nil {
+				return file, nil, err
+			}
+		}
+	}
+	return file, data, nil
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpConn) stat(path string) (CloudFile, error) {
+	reply, data, err := this.request(sftpStat, sftpString(nil, path))
+	if err != nil {
+		return CloudFile{}, err
+	}
+	if reply != sftpAttrs {
+		if err = sftpCheckStatus(reply, data); err == nil {
+			err = fmt.Errorf("unexpected sftp packet %d", reply)
+		}
+		return CloudFile{}, err
+	}
+	file, _, err := sftpTakeAttrs(data)
+	file.name = path
+	return file, err
+}
+
+//------------------------------------------------------------------------------
+// creates every missing directory on the way to remotePath
+func (this *sftpConn) makeDirectories(remotePath string, dirs *DirCache) error {
+	var path string
+	// absolute path stays absolute
+	if strings.HasPrefix(remotePath, "/") {
+		path = "/"
+	}
+	for _, dir := range getList(remotePath, "/") {
+		path += dir
+		if dirs.exists(path) {
+			path += "/"
+			continue
+		}
+		file, err := this.stat(path)
+		if e, ok := err.(sftpError); ok && e.code == sftpStatusNotFound {
+			var payload = binary.BigEndian.AppendUint32(sftpString(nil, path), sftpAttrPermissions)
+			err = this.call(sftpMkdir, binary.BigEndian.AppendUint32(payload, 0700))
+		} else if err == nil && !file.dir {
+			err = fmt.Errorf("%s is not a directory", path)
+		}
+		if err != nil {
+			return err
+		}
+		dirs.add(path)
+		path += "/"
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpConn) rename(source string, target string) error {
+	// plain v3 rename fails if target exists
+	if _, ok := this.extensions["posix-rename@openssh.com"]; ok {
+		var payload = sftpString(nil, "posix-rename@openssh.com")
+		payload = sftpString(sftpString(payload, source), target)
+		return this.call(sftpExtended, payload)
+	}
+	this.call(sftpRemove, sftpString(nil, target))
+	return this.call(sftpRename, sftpString(sftpString(nil, source), target))
+}
+
+//------------------------------------------------------------------------------
+// copies reader to remote file, several writes are kept in flight
+func (this *sftpConn) write(handle string, reader io.Reader) error {
+	var buffer = make([]byte, sftpChunkSize)
+	var offset uint64
+	var pending int
+	var err error
+
+	for err == nil {
+		var n int
+		if n, err = io.ReadFull(reader, buffer); n > 0 {
+			var payload = binary.BigEndian.AppendUint64(sftpString(nil, handle), offset)
+			payload = sftpString(payload, string(buffer[:n]))
+			if _, e := this.send(sftpWrite, payload); e != nil {
+				return e
+			}
+			offset += uint64(n)
+			pending++
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		} else if err != nil {
+			return err
+		}
+
+		for ; pending >= sftpWindow || (err == io.EOF && pending > 0); pending-- {
+			kind, _, data, e := this.receive()
+			if e == nil {
+				e = sftpCheckStatus(kind, data)
+			}
+			if e != nil {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// remote file opened for reading, connection is released along with it
+type sftpReader struct {
+	conn   *sftpConn
+	handle string
+	offset uint64
+	stop   func() bool
+	idle   *sftpPool
+}
+
+func (this *sftpReader) Read(p []byte) (int, error) {
+	if len(p) > sftpChunkSize {
+		p = p[:sftpChunkSize]
+	}
+	var payload = binary.BigEndian.AppendUint64(sftpString(nil, this.handle), this.offset)
+	reply, data, err := this.conn.request(sftpRead, binary.BigEndian.AppendUint32(payload, uint32(len(p))))
+	if err != nil {
+		return 0, err
+	}
+	if reply != sftpData {
+		if err = sftpCheckStatus(reply, data); err == nil {
+			err = fmt.Errorf("unexpected sftp packet %d", reply)
+		}
+		if e, ok := err.(sftpError); ok && e.code == sftpStatusEOF {
+			err = io.EOF
+		}
+		return 0, err
+	}
+	chunk, _, err := sftpTakeString(data)
+	if err != nil {
+		return 0, err
+	}
+	this.offset += uint64(len(chunk))
+	return copy(p, chunk), nil
+}
+
+func (this *sftpReader) Close() error {
+	var live = this.stop()
+	err := this.conn.call(sftpClose, sftpString(nil, this.handle))
+	if live && err == nil {
+		this.idle.put(this.conn)
+	} else {
+		this.conn.close()
+	}
+	return err
+}
+
+//------------------------------------------------------------------------------
+// turns connection and protocol errors into CloudError
+func sftpCloudError(op string, remotePath string, err error) error {
+	var kind error
+	if e, ok := err.(sftpError); ok {
+		switch e.code {
+		case sftpStatusNotFound:
+			kind = errNotFound
+		case sftpStatusPermissionDenied:
+			kind = errAuth
+		case sftpStatusNoConnection, sftpStatusConnectionLost:
+			kind = errTransient
+		}
+	} else if strings.Contains(err.Error(), "unable to authenticate") {
+		kind = errAuth
+	} else if err == io.EOF {
+		kind = errTransient
+	}
+	return newCloudError(op, remotePath, kind, err, nil)
+}
+
+//------------------------------------------------------------------------------
+// idle connection or a fresh one
+func (this CloudSFTP) open(ctx context.Context) (*sftpConn, error) {
+	if conn := this.idle.take(); conn != nil {
+		return conn, nil
+	}
+	return this.connect(ctx)
+}
+
+//------------------------------------------------------------------------------
+// runs action on a connection, closed by context cancel as well; it is kept
+// for the next action unless anything failed
+func (this CloudSFTP) session(ctx context.Context, op string, remotePath string,
+	action func(conn *sftpConn) error) error {
+	conn, err := this.open(ctx)
+	if err != nil {
+		return sftpCloudError(op, remotePath, err)
+	}
+	stop := context.AfterFunc(ctx, conn.close)
+	err = action(conn)
+	if stop() && err == nil {
+		this.idle.put(conn)
+		return nil
+	}
+	conn.close()
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return sftpCloudError(op, remotePath, err)
+	}
+	return nil
+}
+
+// written to temporary file first, so the old one stays intact until done
+func (this CloudSFTP) put(ctx context.Context, remotePath string, reader io.Reader, size int64) error {
+	return this.session(ctx, "put", remotePath, func(conn *sftpConn) error {
+		if err := conn.makeDirectories(path.Dir(remotePath), this.dirs); err != nil {
+			return err
+		}
+		var temp = remotePath + ".tmp"
+		handle, err := conn.open(temp, sftpFlagWrite|sftpFlagCreate|sftpFlagTruncate)
+		if err != nil {
+			return err
+		}
+		if err = conn.write(handle, reader); err != nil {
+			conn.call(sftpClose, sftpString(nil, handle))
+			conn.call(sftpRemove, sftpString(nil, temp))
+			return err
+		}
+		if err = conn.call(sftpClose, sftpString(nil, handle)); err != nil {
+			return err
+		}
+		return conn.rename(temp, remotePath)
+	})
+}
+
+func (this CloudSFTP) get(ctx context.Context, remotePath string) (io.ReadCloser, error) {
+	conn, err := this.open(ctx)
+	if err != nil {
+		return nil, sftpCloudError("get", remotePath, err)
+	}
+	handle, err := conn.open(remotePath, sftpFlagRead)
+	if err != nil {
+		conn.close()
+		return nil, sftpCloudError("get", remotePath, err)
+	}
+	return &sftpReader{conn, handle, 0, context.AfterFunc(ctx, conn.close), this.idle}, nil
+}
+
+func (this CloudSFTP) delete(ctx context.Context, remotePath string) error {
+	return this.session(ctx, "delete", remotePath, func(conn *sftpConn) error {
+		return conn.call(sftpRemove, sftpString(nil, remotePath))
+	})
+}
+
+func (this CloudSFTP) move(ctx context.Context, source string, target string) error {
+	return this.session(ctx, "move", source, func(conn *sftpConn) error {
+		if err := conn.makeDirectories(path.Dir(target), this.dirs); err != nil {
+			return err
+		}
+		return conn.rename(source, target)
+	})
+}
+
+func (this CloudSFTP) stat(ctx context.Context, remotePath string) (CloudFile, error) {
+	var file CloudFile
+	err := this.session(ctx, "stat", remotePath, func(conn *sftpConn) (err error) {
+		file, err = conn.stat(remotePath)
+		return err
+	})
+	return file, err
+}
+
+func (this CloudSFTP) list(ctx context.Context, remotePath string) ([]CloudFile, error) {
+	var files []CloudFile
+	var dir = remotePath
+	// login directory
+	if len(dir) == 0 {
+		dir = "."
+	}
+	err := this.session(ctx, "list", remotePath, func(conn *sftpConn) error {
+		reply, data, err := conn.request(sftpOpenDir, sftpString(nil, dir))
+		if err != nil {
+			return err
+		}
+		if reply != sftpHandle {
+			return sftpCheckStatus(reply, data)
+		}
+		handle, _, err := sftpTakeString(data)
+		if err != nil {
+			return err
+		}
+		defer conn.call(sftpClose, sftpString(nil, handle))
+
+		for {
+			reply, data, err := conn.request(sftpReadDir, sftpString(nil, handle))
+			if err != nil {
+				return err
+			}
+			if reply != sftpName {
+				err = sftpCheckStatus(reply, data)
+				if e, ok := err.(sftpError); ok && e.code == sftpStatusEOF {
+					return nil
+				}
+				return err
+			}
+			count, data, err := sftpTakeUint32(data)
+			for ; err == nil && count > 0; count-- {
+				var name string
+				var file CloudFile
+				if name, data, err = sftpTakeString(data); err != nil {
+					break
+				}
+				// long name
+				if _, data, err = sftpTakeString(data); err != nil {
+					break
+				}
+				if file, data, err = sftpTakeAttrs(data); err == nil && name != "." && name != ".." {
+					file.name = name
+					files = append(files, file)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+	})
+	return files, err
+}
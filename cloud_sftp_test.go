@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"./libs/golang.org/x/crypto/ssh"
+	"./libs/golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSH server with the sftp subsystem over a local dir, v3 packets the client uses
+type sftpServer struct {
+	root        string
+	listener    net.Listener
+	hostKey     ssh.Signer
+	clientKey   ssh.PublicKey
+	// without it v3 rename does not replace the target
+	posixRename bool
+	connections int32
+	lock        sync.Mutex
+	requests    map[byte]int
+}
+
+// reads fields of the request in order, error sticks
+type sftpPacket struct {
+	data []byte
+	err  error
+}
+
+type sftpDirHandle struct {
+	entries []os.FileInfo
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpPacket) uint32() uint32 {
+	if len(this.data) < 4 {
+		this.err = errors.New("short packet")
+		return 0
+	}
+	var value = binary.BigEndian.Uint32(this.data)
+	this.data = this.data[4:]
+	return value
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpPacket) uint64() uint64 {
+	return uint64(this.uint32()) << 32 | uint64(this.uint32())
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpPacket) string() string {
+	var size = this.uint32()
+	if uint32(len(this.data)) < size {
+		this.err = errors.New("short packet")
+		return ""
+	}
+	var value = string(this.data[:size])
+	this.data = this.data[size:]
+	return value
+}
+
+//------------------------------------------------------------------------------
+func appendString(data []byte, str string) []byte {
+	return append(binary.BigEndian.AppendUint32(data, uint32(len(str))), str...)
+}
+
+//------------------------------------------------------------------------------
+func appendAttrs(data []byte, fi os.FileInfo) []byte {
+	var mode = uint32(fi.Mode().Perm()) | 0100000
+	if fi.IsDir() {
+		mode = uint32(fi.Mode().Perm()) | 0040000
+	}
+	data = binary.BigEndian.AppendUint32(data, sftpAttrSize | sftpAttrPermissions | sftpAttrTime)
+	data = binary.BigEndian.AppendUint64(data, uint64(fi.Size()))
+	data = binary.BigEndian.AppendUint32(data, mode)
+	data = binary.BigEndian.AppendUint32(data, uint32(fi.ModTime().Unix()))
+	return binary.BigEndian.AppendUint32(data, uint32(fi.ModTime().Unix()))
+}
+
+//------------------------------------------------------------------------------
+func startSFTPServer(t *testing.T) *sftpServer {
+	var server = &sftpServer{root: t.TempDir(), posixRename: true, requests: make(map[byte]int)}
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	server.hostKey, _ = ssh.NewSignerFromKey(key)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.listener = listener
+	t.Cleanup(func() { listener.Close() })
+
+	var config = &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if server.clientKey != nil && string(key.Marshal()) == string(server.clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(server.hostKey)
+	go func() {
+		for {
+			socket, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serveConn(socket, config)
+		}
+	}()
+	return server
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpServer) serveConn(socket net.Conn, config *ssh.ServerConfig) {
+	conn, channels, requests, err := ssh.NewServerConn(socket, config)
+	if err != nil {
+		socket.Close()
+		return
+	}
+	defer conn.Close()
+	atomic.AddInt32(&this.connections, 1)
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "session only")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				var ok = req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					go func() {
+						this.serveSFTP(channel)
+						channel.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+//------------------------------------------------------------------------------
+// paths are under the root, the absolute ones as well
+func (this *sftpServer) local(remotePath string) string {
+	return filepath.Join(this.root, filepath.FromSlash(remotePath))
+}
+
+//------------------------------------------------------------------------------
+func sftpStatusOf(err error) (uint32, string) {
+	switch {
+	case err == nil:
+		return sftpStatusOK, "ok"
+	case os.IsNotExist(err):
+		return sftpStatusNotFound, "no such file"
+	case os.IsPermission(err):
+		return sftpStatusPermissionDenied, "permission denied"
+	}
+	// SSH_FX_FAILURE
+	return 4, err.Error()
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpServer) serveSFTP(channel io.ReadWriter) {
+	var handles = make(map[string]interface{})
+	var lastHandle int
+	defer func() {
+		for _, handle := range handles {
+			if file, ok := handle.(*os.File); ok {
+				file.Close()
+			}
+		}
+	}()
+	var reply = func(kind byte, data []byte) error {
+		var header = binary.BigEndian.AppendUint32(nil, uint32(len(data) + 1))
+		_, err := channel.Write(append(append(header, kind), data...))
+		return err
+	}
+	for {
+		var header [5]byte
+		if _, err := io.ReadFull(channel, header[:]); err != nil {
+			return
+		}
+		var data = make([]byte, binary.BigEndian.Uint32(header[:4]) - 1)
+		if _, err := io.ReadFull(channel, data); err != nil {
+			return
+		}
+		var kind = header[4]
+		this.lock.Lock()
+		this.requests[kind]++
+		this.lock.Unlock()
+		var packet = &sftpPacket{data: data}
+		if kind == sftpInit {
+			var version = binary.BigEndian.AppendUint32(nil, 3)
+			if this.posixRename {
+				version = appendString(appendString(version, "posix-rename@openssh.com"), "1")
+			}
+			reply(sftpVersion, version)
+			continue
+		}
+
+		var id = packet.uint32()
+		var answer = binary.BigEndian.AppendUint32(nil, id)
+		var statusCode = func(code uint32, message string) error {
+			var data = binary.BigEndian.AppendUint32(answer, code)
+			return reply(sftpStatus, appendString(appendString(data, message), ""))
+		}
+		var status = func(err error) error {
+			return statusCode(sftpStatusOf(err))
+		}
+		var newHandle = func(handle interface{}) error {
+			lastHandle++
+			var name = strconv.Itoa(lastHandle)
+			handles[name] = handle
+			return reply(sftpHandle, appendString(answer, name))
+		}
+		var name = packet.string()
+		var err error
+		switch {
+		case strings.Contains(name, "denied"):
+			err = status(os.ErrPermission)
+		case strings.Contains(name, "lost"):
+			err = statusCode(sftpStatusConnectionLost, "connection lost")
+		case kind == sftpOpen:
+			var flags = packet.uint32()
+			var mode = os.O_RDONLY
+			if flags & sftpFlagWrite != 0 {
+				mode = os.O_WRONLY
+			}
+			if flags & sftpFlagCreate != 0 {
+				mode |= os.O_CREATE
+			}
+			if flags & sftpFlagTruncate != 0 {
+				mode |= os.O_TRUNC
+			}
+			file, e := os.OpenFile(this.local(name), mode, 0600)
+			if e != nil {
+				err = status(e)
+			} else {
+				err = newHandle(file)
+			}
+		case kind == sftpOpenDir:
+			entries, e := ioutil.ReadDir(this.local(name))
+			if e != nil {
+				err = status(e)
+				break
+			}
+			// the way real servers do
+			var dir = &sftpDirHandle{}
+			for _, special := range []string{".", ".."} {
+				if fi, e := os.Stat(this.local(name)); e == nil {
+					dir.entries = append(dir.entries, renamedInfo{fi, special})
+				}
+			}
+			dir.entries = append(dir.entries, entries...)
+			err = newHandle(dir)
+		case kind == sftpClose:
+			handle, ok := handles[name]
+			delete(handles, name)
+			if file, isFile := handle.(*os.File); isFile {
+				err = status(file.Close())
+			} else if ok {
+				err = status(nil)
+			} else {
+				err = status(os.ErrNotExist)
+			}
+		case kind == sftpRead:
+			var offset, size = packet.uint64(), packet.uint32()
+			file, _ := handles[name].(*os.File)
+			if file == nil {
+				err = status(os.ErrNotExist)
+				break
+			}
+			var buffer = make([]byte, size)
+			n, e := file.ReadAt(buffer, int64(offset))
+			if n == 0 && e == io.EOF {
+				err = statusCode(sftpStatusEOF, "eof")
+			} else if n == 0 {
+				err = status(e)
+			} else {
+				err = reply(sftpData, appendString(answer, string(buffer[:n])))
+			}
+		case kind == sftpWrite:
+			var offset, content = packet.uint64(), packet.string()
+			file, _ := handles[name].(*os.File)
+			if file == nil {
+				err = status(os.ErrNotExist)
+				break
+			}
+			_, e := file.WriteAt([]byte(content), int64(offset))
+			err = status(e)
+		case kind == sftpReadDir:
+			dir, _ := handles[name].(*sftpDirHandle)
+			if dir == nil {
+				err = status(os.ErrNotExist)
+				break
+			}
+			if len(dir.entries) == 0 {
+				err = statusCode(sftpStatusEOF, "eof")
+				break
+			}
+			// few names at once, so the client has to ask again
+			var count = len(dir.entries)
+			if count > 2 {
+				count = 2
+			}
+			var names = binary.BigEndian.AppendUint32(answer, uint32(count))
+			for _, fi := range dir.entries[:count] {
+				names = appendString(names, fi.Name())
+				names = appendString(names, fi.Mode().String() + " " + fi.Name())
+				names = appendAttrs(names, fi)
+			}
+			dir.entries = dir.entries[count:]
+			err = reply(sftpName, names)
+		case kind == sftpRemove:
+			fi, e := os.Stat(this.local(name))
+			if e == nil && fi.IsDir() {
+				e = errors.New("is a directory")
+			} else if e == nil {
+				e = os.Remove(this.local(name))
+			}
+			err = status(e)
+		case kind == sftpMkdir:
+			err = status(os.Mkdir(this.local(name), 0700))
+		case kind == sftpStat:
+			fi, e := os.Stat(this.local(name))
+			if e != nil {
+				err = status(e)
+			} else {
+				err = reply(sftpAttrs, appendAttrs(answer, fi))
+			}
+		case kind == sftpRename:
+			var target = packet.string()
+			// v3 rename does not replace
+			if _, e := os.Lstat(this.local(target)); e == nil {
+				err = status(errors.New("target exists"))
+			} else {
+				err = status(os.Rename(this.local(name), this.local(target)))
+			}
+		case kind == sftpExtended && name == "posix-rename@openssh.com" && this.posixRename:
+			var source, target = packet.string(), packet.string()
+			if _, e := os.Stat(this.local(source)); e != nil {
+				err = status(e)
+			} else {
+				err = status(os.Rename(this.local(source), this.local(target)))
+			}
+		default:
+			// SSH_FX_OP_UNSUPPORTED
+			err = statusCode(8, "unsupported")
+		}
+		if err != nil || packet.err != nil {
+			return
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+type renamedInfo struct {
+	os.FileInfo
+	name string
+}
+
+func (this renamedInfo) Name() string {
+	return this.name
+}
+
+//------------------------------------------------------------------------------
+func (this *sftpServer) count(kind byte) int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.requests[kind]
+}
+
+//------------------------------------------------------------------------------
+// PKCS#8 key file of the client, the server accepts it if authorized
+func writeClientKey(t *testing.T, dir string, name string) (string, ssh.PublicKey) {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyFile = filepath.Join(dir, name)
+	var block = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err = ioutil.WriteFile(keyFile, block, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sshKey, _ := ssh.NewPublicKey(public)
+	return keyFile, sshKey
+}
+
+//------------------------------------------------------------------------------
+func writeKnownHosts(t *testing.T, dir string, address string, key ssh.PublicKey) string {
+	var fileName = filepath.Join(dir, "known_hosts")
+	var line = knownhosts.Line([]string{knownhosts.Normalize(address)}, key) + "\n"
+	if err := ioutil.WriteFile(fileName, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+//------------------------------------------------------------------------------
+// client of the server with an authorized key and the known host key
+func newSFTPClient(t *testing.T, server *sftpServer) CloudSFTP {
+	var dir = t.TempDir()
+	keyFile, key := writeClientKey(t, dir, "id_ed25519")
+	server.clientKey = key
+	var address = server.listener.Addr().(*net.TCPAddr)
+	var knownHosts = writeKnownHosts(t, dir, address.String(), server.hostKey.PublicKey())
+	cloud, err := newCloudSFTP("127.0.0.1", address.Port, "backup", keyFile, knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cloud
+}
+
+//------------------------------------------------------------------------------
+func TestSFTPCloud(t *testing.T) {
+	for _, posixRename := range []bool{true, false} {
+		t.Run("posix-rename=" + strconv.FormatBool(posixRename), func(t *testing.T) {
+			var server = startSFTPServer(t)
+			server.posixRename = posixRename
+			var cloud = newSFTPClient(t, server)
+			checkCloud(t, cloud)
+			// absolute paths stay absolute
+			var ctx = context.Background()
+			if err := cloud.put(ctx, "/abs/a.bin", strings.NewReader("a"), 1); err != nil {
+				t.Fatalf("put absolute: %v", err)
+			}
+			if names := listRemote(t, cloud, ""); strings.Join(names, " ") != "abs/ backup/" {
+				t.Fatalf("list of login dir: %v", names)
+			}
+		})
+	}
+}
+
+//------------------------------------------------------------------------------
+// one connection serves operations one after another, dirs are made once
+func TestSFTPReuse(t *testing.T) {
+	var server = startSFTPServer(t)
+	var cloud = newSFTPClient(t, server)
+	var ctx = context.Background()
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := cloud.put(ctx, "backup/x/" + name, strings.NewReader(name), 1); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+		if data := readRemote(t, cloud, "backup/x/" + name); string(data) != name {
+			t.Fatalf("get: %q", data)
+		}
+	}
+	if err := cloud.move(ctx, "backup/x/a", "backup/x/e"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if connections := atomic.LoadInt32(&server.connections); connections != 1 {
+		t.Fatalf("%d connections", connections)
+	}
+	if stats, mkdirs := server.count(sftpStat), server.count(sftpMkdir); stats != 2 || mkdirs != 2 {
+		t.Fatalf("%d stats and %d mkdirs of dirs", stats, mkdirs)
+	}
+
+	// readers in use do not share the connection
+	first, err := cloud.get(ctx, "backup/x/b")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if data := readRemote(t, cloud, "backup/x/c"); string(data) != "c" {
+		t.Fatalf("get: %q", data)
+	}
+	if data, err := ioutil.ReadAll(first); err != nil || string(data) != "b" {
+		t.Fatalf("first get: %q %v", data, err)
+	}
+	first.Close()
+	if connections := atomic.LoadInt32(&server.connections); connections != 2 {
+		t.Fatalf("%d connections", connections)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestSFTPErrors(t *testing.T) {
+	var server = startSFTPServer(t)
+	var cloud = newSFTPClient(t, server)
+	var ctx = context.Background()
+	_, err := cloud.get(ctx, "backup/none")
+	checkKind(t, "get missing", err, errNotFound)
+	_, err = cloud.stat(ctx, "backup/denied")
+	checkKind(t, "permission denied", err, errAuth)
+	_, err = cloud.stat(ctx, "backup/lost")
+	checkKind(t, "connection lost", err, errTransient)
+
+	// the key the server does not know
+	var dir = t.TempDir()
+	var address = server.listener.Addr().(*net.TCPAddr)
+	keyFile, _ := writeClientKey(t, dir, "other")
+	var knownHosts = writeKnownHosts(t, dir, address.String(), server.hostKey.PublicKey())
+	other, err := newCloudSFTP("127.0.0.1", address.Port, "backup", keyFile, knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.stat(ctx, "backup")
+	checkKind(t, "unknown client key", err, errAuth)
+
+	// host key is not the known one
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	signer, _ := ssh.NewSignerFromKey(key)
+	knownHosts = writeKnownHosts(t, dir, address.String(), signer.PublicKey())
+	other, err = newCloudSFTP("127.0.0.1", address.Port, "backup", keyFile, knownHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.stat(ctx, "backup")
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		t.Fatalf("host key mismatch is accepted: %v", err)
+	}
+
+	// nothing listens
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	var port = listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	cloud.address = net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	cloud.idle = &sftpPool{}
+	_, err = cloud.stat(ctx, "backup")
+	checkKind(t, "closed port", err, errTransient)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+//------------------------------------------------------------------------------
+// error of the cloud is CloudError of the given kind
+func checkKind(t *testing.T, what string, err error, kind error) {
+	t.Helper()
+	var cloudErr *CloudError
+	if !errors.As(err, &cloudErr) {
+		t.Fatalf("%s: %v is not a cloud error", what, err)
+	}
+	if !errors.Is(err, kind) {
+		t.Fatalf("%s: %v is not %v", what, err, kind)
+	}
+}
+
+//------------------------------------------------------------------------------
+func readRemote(t *testing.T, cloud Cloud, remotePath string) []byte {
+	t.Helper()
+	reader, err := cloud.get(context.Background(), remotePath)
+	if err != nil {
+		t.Fatalf("get %s: %v", remotePath, err)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if e := reader.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		t.Fatalf("read %s: %v", remotePath, err)
+	}
+	return data
+}
+
+//------------------------------------------------------------------------------
+// names of the remote dir, dirs end with slash
+func listRemote(t *testing.T, cloud Cloud, remotePath string) []string {
+	t.Helper()
+	files, err := cloud.list(context.Background(), remotePath)
+	if err != nil {
+		t.Fatalf("list %s: %v", remotePath, err)
+	}
+	var names []string
+	for _, file := range files {
+		if file.dir {
+			names = append(names, file.name + "/")
+		} else {
+			names = append(names, file.name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+//------------------------------------------------------------------------------
+// every operation of the Cloud interface the way backup uses them
+func checkCloud(t *testing.T, cloud Cloud) {
+	var ctx = context.Background()
+	var large = bytes.Repeat([]byte("0123456789abcdef"), 1 << 16)
+	if err := cloud.put(ctx, "backup/x/a.bin", bytes.NewReader(large), int64(len(large))); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	// stream of unknown size
+	if err := cloud.put(ctx, "backup/x/b.bin", strings.NewReader("bb"), -1); err != nil {
+		t.Fatalf("put stream: %v", err)
+	}
+	if err := cloud.put(ctx, "backup/x/sub/c.bin", strings.NewReader("c"), 1); err != nil {
+		t.Fatalf("put to new dir: %v", err)
+	}
+
+	file, err := cloud.stat(ctx, "backup/x/a.bin")
+	if err != nil || file.size != int64(len(large)) || file.dir {
+		t.Fatalf("stat: %+v %v", file, err)
+	}
+	if names := listRemote(t, cloud, "backup/x"); fmt.Sprint(names) != "[a.bin b.bin sub/]" {
+		t.Fatalf("list: %v", names)
+	}
+	if names := listRemote(t, cloud, "backup/x/"); fmt.Sprint(names) != "[a.bin b.bin sub/]" {
+		t.Fatalf("list with slash: %v", names)
+	}
+	if data := readRemote(t, cloud, "backup/x/a.bin"); !bytes.Equal(data, large) {
+		t.Fatalf("get: %d bytes of %d", len(data), len(large))
+	}
+
+	// rename to a new dir and over an existing file
+	if err = cloud.move(ctx, "backup/x/b.bin", "backup/y/b.bin"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if data := readRemote(t, cloud, "backup/y/b.bin"); string(data) != "bb" {
+		t.Fatalf("moved: %q", data)
+	}
+	_, err = cloud.stat(ctx, "backup/x/b.bin")
+	checkKind(t, "stat of moved", err, errNotFound)
+	if err = cloud.put(ctx, "backup/x/d.bin", strings.NewReader("ddd"), 3); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err = cloud.move(ctx, "backup/x/d.bin", "backup/y/b.bin"); err != nil {
+		t.Fatalf("move over: %v", err)
+	}
+	if data := readRemote(t, cloud, "backup/y/b.bin"); string(data) != "ddd" {
+		t.Fatalf("moved over: %q", data)
+	}
+	// put replaces the file
+	if err = cloud.put(ctx, "backup/y/b.bin", strings.NewReader("e"), 1); err != nil {
+		t.Fatalf("put over: %v", err)
+	}
+	if data := readRemote(t, cloud, "backup/y/b.bin"); string(data) != "e" {
+		t.Fatalf("put over: %q", data)
+	}
+
+	if err = cloud.delete(ctx, "backup/x/a.bin"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	checkKind(t, "delete missing", cloud.delete(ctx, "backup/x/a.bin"), errNotFound)
+	_, err = cloud.get(ctx, "backup/x/a.bin")
+	checkKind(t, "get missing", err, errNotFound)
+	_, err = cloud.stat(ctx, "backup/x/a.bin")
+	checkKind(t, "stat missing", err, errNotFound)
+	checkKind(t, "move missing", cloud.move(ctx, "backup/x/a.bin", "backup/x/z.bin"), errNotFound)
+	if names := listRemote(t, cloud, "backup/x"); fmt.Sprint(names) != "[sub/]" {
+		t.Fatalf("list after delete: %v", names)
+	}
+	// missing dir is empty or not found, repository accepts both
+	files, err := cloud.list(ctx, "backup/none")
+	if err != nil {
+		checkKind(t, "list missing", err, errNotFound)
+	} else if len(files) > 0 {
+		t.Fatalf("list missing: %v", files)
+	}
+}
+
+//------------------------------------------------------------------------------
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+var _ net.Error = timeoutError{}
+
+//------------------------------------------------------------------------------
+func TestClassifyError(t *testing.T) {
+	var tests = []struct {
+		err  error
+		kind error
+	}{
+		{nil, nil},
+		{&os.PathError{Op: "open", Path: "x", Err: syscall.ENOENT}, errNotFound},
+		{&os.PathError{Op: "write", Path: "x", Err: syscall.ENOSPC}, errQuota},
+		{&os.PathError{Op: "write", Path: "x", Err: syscall.EDQUOT}, errQuota},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, errTransient},
+		{&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, errTransient},
+		{syscall.EPIPE, errTransient},
+		{fmt.Errorf("body: %w", io.ErrUnexpectedEOF), errTransient},
+		{&net.OpError{Op: "read", Err: timeoutError{}}, errTransient},
+		{errors.New("something else"), nil},
+	}
+	for _, test := range tests {
+		if kind := classifyError(test.err); kind != test.kind {
+			t.Errorf("%v: %v, expected %v", test.err, kind, test.kind)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestClassifyStatus(t *testing.T) {
+	var tests = []struct {
+		code int
+		kind error
+	}{
+		{http.StatusOK, nil},
+		{http.StatusUnauthorized, errAuth},
+		{http.StatusForbidden, errAuth},
+		{http.StatusNotFound, errNotFound},
+		{http.StatusInsufficientStorage, errQuota},
+		{http.StatusRequestEntityTooLarge, nil},
+		{http.StatusTooManyRequests, errTransient},
+		{http.StatusInternalServerError, errTransient},
+		{http.StatusBadGateway, errTransient},
+		{http.StatusServiceUnavailable, errTransient},
+		{http.StatusGatewayTimeout, errTransient},
+		{http.StatusConflict, nil},
+	}
+	for _, test := range tests {
+		if kind := classifyStatus(test.code); kind != test.kind {
+			t.Errorf("%d: %v, expected %v", test.code, kind, test.kind)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestClassifyOutput(t *testing.T) {
+	var tests = []struct {
+		output string
+		kind   error
+	}{
+		{"ERROR : file.bin: object not found", errNotFound},
+		{"stat x: No such file or directory", errNotFound},
+		{"Error 403: The user's Drive storage quota has been exceeded", errQuota},
+		{"507 Insufficient Storage", errQuota},
+		{"write: no space left on device", errQuota},
+		{"401 Unauthorized", errAuth},
+		{"oauth2: cannot fetch token: invalid_grant", errAuth},
+		{"dial tcp: i/o timeout", errTransient},
+		{"read: connection reset by peer", errTransient},
+		{"Temporary failure in name resolution", errTransient},
+		{"syntax error", nil},
+	}
+	for _, test := range tests {
+		if kind := classifyOutput([]byte(test.output)); kind != test.kind {
+			t.Errorf("%q: %v, expected %v", test.output, kind, test.kind)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestCloudError(t *testing.T) {
+	var cause = &os.PathError{Op: "open", Path: "a.bin", Err: syscall.ENOENT}
+	var err = newCloudError("get", "a.bin", nil, cause, nil)
+	checkKind(t, "guessed kind", err, errNotFound)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("cause is not unwrapped: %v", err)
+	}
+	if err.Error() != "get a.bin: open a.bin: no such file or directory" {
+		t.Fatalf("message: %s", err.Error())
+	}
+	// explicit kind wins, no cause gives the kind as the message
+	err = newCloudError("list", "dir", errUnsupported, nil, nil)
+	checkKind(t, "explicit kind", err, errUnsupported)
+	if errors.Is(err, errNotFound) || err.Error() != "list dir: not supported" {
+		t.Fatalf("explicit kind: %v", err)
+	}
+	// unknown kind is none of them
+	err = newCloudError("put", "x", nil, errors.New("strange"), []byte("output"))
+	for _, kind := range []error{errNotFound, errQuota, errAuth, errTransient, errUnsupported} {
+		if errors.Is(err, kind) {
+			t.Fatalf("unknown error is %v", kind)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestDirCache(t *testing.T) {
+	var dirs = newDirCache()
+	if dirs.exists("a/b") {
+		t.Fatal("empty cache has a dir")
+	}
+	dirs.add("a/b")
+	if !dirs.exists("a/b") || dirs.exists("a") {
+		t.Fatal("cache keeps exact paths only")
+	}
+}
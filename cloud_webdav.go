@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// WebDAV storage: Yandex Disk (https://webdav.yandex.ru), Nextcloud, ownCloud
+// or any other RFC 4918 server
+type CloudWebDAV struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+	dirs     *DirCache
+}
+
+//------------------------------------------------------------------------------
+func newCloudWebDAV(url string, user string, password string) CloudWebDAV {
+	return CloudWebDAV{
+		url:      strings.TrimRight(url, "/"),
+		user:     user,
+		password: password,
+		client:   &http.Client{},
+		dirs:     newDirCache(),
+	}
+}
+
+func (this CloudWebDAV) name() string {
+	return "WebDAV"
+}
+
+// no external tool needed
+func (this CloudWebDAV) command() string {
+	return ""
+}
+
+// chunked transfer encoding is used for unknown size
+func (this CloudWebDAV) streaming() bool {
+	return true
+}
+
+//------------------------------------------------------------------------------
+func (this CloudWebDAV) location(remotePath string) string {
+	var path = url.URL{Path: strings.TrimLeft(remotePath, "/")}
+	return this.url + "/" + path.EscapedPath()
+}
+
+//------------------------------------------------------------------------------
+func (this CloudWebDAV) request(ctx context.Context, method string, remotePath string,
+	body io.Reader, size int64, header map[string]string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, this.location(remotePath), body)
+	if err != nil {
+		return nil, newCloudError(method, remotePath, nil, err, nil)
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if len(this.user) > 0 {
+		req.SetBasicAuth(this.user, this.password)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return nil, newCloudError(method, remotePath, nil, err, nil)
+	}
+	return resp, nil
+}
+
+//------------------------------------------------------------------------------
+// PROPFIND reply
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				Length       int64  `xml:"getcontentlength"`
+				Modified     string `xml:"getlastmodified"`
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+//------------------------------------------------------------------------------
+// file names are server side paths
+func (this CloudWebDAV) propfind(ctx context.Context, remotePath string,
+	depth string) ([]CloudFile, error) {
+	resp, err := this.request(ctx, "PROPFIND", remotePath, nil, 0, map[string]string{"Depth": depth})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, checkResponse(resp, "PROPFIND", remotePath, http.StatusMultiStatus)
+	}
+	defer resp.Body.Close()
+
+	var reply davMultistatus
+	if err = xml.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, newCloudError("PROPFIND", remotePath, nil, err, nil)
+	}
+	var files []CloudFile
+	for _, response := range reply.Responses {
+		var file = CloudFile{name: response.Href, size: -1}
+		// href may be absolute URL or path
+		if href, err := url.Parse(response.Href); err == nil {
+			file.name = href.Path
+		}
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			var prop = propstat.Prop
+			file.dir = prop.ResourceType.Collection != nil
+			if !file.dir {
+				file.size = prop.Length
+			}
+			file.modified, _ = time.Parse(http.TimeFormat, prop.Modified)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+//------------------------------------------------------------------------------
+// creates every missing collection on the way to remotePath
+func (this CloudWebDAV) makeCollections(ctx context.Context, remotePath string) error {
+	var path string
+	for _, dir := range getList(remotePath, "/") {
+		path += dir + "/"
+		if this.dirs.exists(path) {
+			continue
+		}
+		_, err := this.propfind(ctx, path, "0")
+		if err == nil {
+			this.dirs.add(path)
+			continue
+		}
+		if !errors.Is(err, errNotFound) {
+			return err
+		}
+
+		resp, err := this.request(ctx, "MKCOL", path, nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		// 405 - collection already exists
+		if err = checkResponse(resp, "MKCOL", path, http.StatusCreated,
+			http.StatusMethodNotAllowed); err != nil {
+			return err
+		}
+		this.dirs.add(path)
+	}
+	return nil
+}
+
+func (this CloudWebDAV) put(ctx context.Context, remotePath string, reader io.Reader, size int64) error {
+	if err := this.makeCollections(ctx, path.Dir(remotePath)); err != nil {
+		return err
+	}
+	resp, err := this.request(ctx, "PUT", remotePath, reader, size, nil)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, "PUT", remotePath, http.StatusOK, http.StatusCreated,
+		http.StatusNoContent)
+}
+
+func (this CloudWebDAV) get(ctx context.Context, remotePath string) (io.ReadCloser, error) {
+	resp, err := this.request(ctx, "GET", remotePath, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, checkResponse(resp, "GET", remotePath, http.StatusOK)
+	}
+	return resp.Body, nil
+}
+
+func (this CloudWebDAV) delete(ctx context.Context, remotePath string) error {
+	resp, err := this.request(ctx, "DELETE", remotePath, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, "DELETE", remotePath, http.StatusOK, http.StatusNoContent)
+}
+
+func (this CloudWebDAV) move(ctx context.Context, source string, target string) error {
+	if err := this.makeCollections(ctx, path.Dir(target)); err != nil {
+		return err
+	}
+	var header = map[string]string{"Destination": this.location(target), "Overwrite": "T"}
+	resp, err := this.request(ctx, "MOVE", source, nil, 0, header)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, "MOVE", source, http.StatusCreated, http.StatusNoContent)
+}
+
+func (this CloudWebDAV) stat(ctx context.Context, remotePath string) (CloudFile, error) {
+	files, err := this.propfind(ctx, remotePath, "0")
+	if err != nil {
+		return CloudFile{}, err
+	}
+	if len(files) == 0 {
+		return CloudFile{}, newCloudError("PROPFIND", remotePath, errNotFound, nil, nil)
+	}
+	files[0].name = remotePath
+	return files[0], nil
+}
+
+func (this CloudWebDAV) list(ctx context.Context, remotePath string) ([]CloudFile, error) {
+	var dir = strings.TrimRight(remotePath, "/") + "/"
+	files, err := this.propfind(ctx, dir, "1")
+	if err != nil {
+		return nil, err
+	}
+
+	var self = strings.TrimRight(this.serverPath(dir), "/")
+	var result []CloudFile
+	for _, file := range files {
+		var name = strings.TrimRight(file.name, "/")
+		// the collection itself is reported too
+		if name == self {
+			continue
+		}
+		file.name = path.Base(name)
+		result = append(result, file)
+	}
+	return result, nil
+}
+
+//------------------------------------------------------------------------------
+// path of remotePath on the server as it is reported in href
+func (this CloudWebDAV) serverPath(remotePath string) string {
+	location, err := url.Parse(this.location(remotePath))
+	if err != nil {
+		return remotePath
+	}
+	return location.Path
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// RFC 4918 server over a local dir, just what the client uses
+type davServer struct {
+	root      string
+	prefix    string
+	user      string
+	password  string
+	// hrefs are absolute URLs as some servers send them
+	absolute  bool
+	propfinds int32
+}
+
+//------------------------------------------------------------------------------
+func (this *davServer) local(serverPath string) string {
+	return filepath.Join(this.root, filepath.FromSlash(strings.TrimPrefix(serverPath, this.prefix)))
+}
+
+//------------------------------------------------------------------------------
+func (this *davServer) href(req *http.Request, serverPath string, dir bool) string {
+	if dir && !strings.HasSuffix(serverPath, "/") {
+		serverPath += "/"
+	}
+	var location = url.URL{Path: serverPath}
+	if this.absolute {
+		return "http://" + req.Host + location.EscapedPath()
+	}
+	return location.EscapedPath()
+}
+
+//------------------------------------------------------------------------------
+func davResponse(output *bytes.Buffer, href string, fi os.FileInfo) {
+	output.WriteString("<D:response><D:href>")
+	xml.EscapeText(output, []byte(href))
+	output.WriteString("</D:href><D:propstat><D:prop>")
+	if fi.IsDir() {
+		output.WriteString("<D:resourcetype><D:collection/></D:resourcetype>")
+	} else {
+		fmt.Fprintf(output, "<D:resourcetype/><D:getcontentlength>%d</D:getcontentlength>", fi.Size())
+	}
+	fmt.Fprintf(output, "<D:getlastmodified>%s</D:getlastmodified>",
+		fi.ModTime().UTC().Format(http.TimeFormat))
+	output.WriteString("</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>")
+	// properties the client does not ask for are reported missing
+	output.WriteString("<D:propstat><D:prop><D:quota-used-bytes/></D:prop>")
+	output.WriteString("<D:status>HTTP/1.1 404 Not Found</D:status></D:propstat></D:response>")
+}
+
+//------------------------------------------------------------------------------
+func (this *davServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if user, password, ok := req.BasicAuth(); !ok || user != this.user || password != this.password {
+		http.Error(w, "login", http.StatusUnauthorized)
+		return
+	}
+	if strings.Contains(req.URL.Path, "busy") {
+		http.Error(w, "try later", http.StatusServiceUnavailable)
+		return
+	}
+	var local = this.local(req.URL.Path)
+	var parentExists = func(name string) bool {
+		fi, err := os.Stat(filepath.Dir(name))
+		return err == nil && fi.IsDir()
+	}
+
+	switch req.Method {
+	case "PROPFIND":
+		atomic.AddInt32(&this.propfinds, 1)
+		fi, err := os.Stat(local)
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		var output bytes.Buffer
+		output.WriteString(`<?xml version="1.0" encoding="utf-8"?><D:multistatus xmlns:D="DAV:">`)
+		davResponse(&output, this.href(req, req.URL.Path, fi.IsDir()), fi)
+		if fi.IsDir() && req.Header.Get("Depth") == "1" {
+			entries, _ := os.ReadDir(local)
+			for _, entry := range entries {
+				if info, err := entry.Info(); err == nil {
+					davResponse(&output, this.href(req, path.Join(req.URL.Path, entry.Name()),
+						entry.IsDir()), info)
+				}
+			}
+		}
+		output.WriteString("</D:multistatus>")
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusMultiStatus)
+		w.Write(output.Bytes())
+	case "MKCOL":
+		if _, err := os.Stat(local); err == nil {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		} else if !parentExists(local) {
+			w.WriteHeader(http.StatusConflict)
+		} else if err = os.Mkdir(local, 0700); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	case "PUT":
+		if strings.Contains(req.URL.Path, "full") {
+			http.Error(w, "no space", http.StatusInsufficientStorage)
+			return
+		}
+		if !parentExists(local) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		data, err := ioutil.ReadAll(req.Body)
+		if err == nil {
+			err = ioutil.WriteFile(local, data, 0600)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	case "GET":
+		file, err := os.Open(local)
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		defer file.Close()
+		io.Copy(w, file)
+	case "DELETE":
+		if _, err := os.Stat(local); err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		os.RemoveAll(local)
+		w.WriteHeader(http.StatusNoContent)
+	case "MOVE":
+		destination, err := url.Parse(req.Header.Get("Destination"))
+		if err != nil || !strings.HasPrefix(destination.Path, this.prefix) {
+			http.Error(w, "bad destination", http.StatusBadGateway)
+			return
+		}
+		var target = this.local(destination.Path)
+		if _, err = os.Stat(local); err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		if !parentExists(target) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		_, err = os.Stat(target)
+		var existed = err == nil
+		if existed && req.Header.Get("Overwrite") == "F" {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if err = os.Rename(local, target); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		} else if existed {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			w.WriteHeader(http.StatusCreated)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+//------------------------------------------------------------------------------
+func startDavServer(t *testing.T) (*davServer, *httptest.Server) {
+	var dav = &davServer{root: t.TempDir(), prefix: "/dav", user: "user", password: "pass word"}
+	var server = httptest.NewServer(dav)
+	t.Cleanup(server.Close)
+	return dav, server
+}
+
+//------------------------------------------------------------------------------
+func TestWebDAVCloud(t *testing.T) {
+	for _, absolute := range []bool{false, true} {
+		t.Run(fmt.Sprintf("absolute=%v", absolute), func(t *testing.T) {
+			dav, server := startDavServer(t)
+			dav.absolute = absolute
+			var cloud = newCloudWebDAV(server.URL + "/dav/", dav.user, dav.password)
+			checkCloud(t, cloud)
+
+			// names are escaped
+			var ctx = context.Background()
+			if err := cloud.put(ctx, "backup/a b/c%d.bin", strings.NewReader("x"), 1); err != nil {
+				t.Fatalf("put: %v", err)
+			}
+			if names := listRemote(t, cloud, "backup/a b"); fmt.Sprint(names) != "[c%d.bin]" {
+				t.Fatalf("list: %v", names)
+			}
+			if _, err := os.Stat(filepath.Join(dav.root, "backup", "a b", "c%d.bin")); err != nil {
+				t.Fatalf("escaped put: %v", err)
+			}
+		})
+	}
+}
+
+//------------------------------------------------------------------------------
+// collections are looked up once per client
+func TestWebDAVDirCache(t *testing.T) {
+	dav, server := startDavServer(t)
+	var cloud = newCloudWebDAV(server.URL + "/dav", dav.user, dav.password)
+	var ctx = context.Background()
+	if err := cloud.put(ctx, "backup/x/a.bin", strings.NewReader("a"), 1); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if count := atomic.LoadInt32(&dav.propfinds); count != 2 {
+		t.Fatalf("%d lookups of new dirs", count)
+	}
+	for _, name := range []string{"b.bin", "c.bin"} {
+		if err := cloud.put(ctx, "backup/x/" + name, strings.NewReader("b"), 1); err != nil {
+			t.Fatalf("put: %v", err)
+		}
+	}
+	if err := cloud.move(ctx, "backup/x/b.bin", "backup/x/d.bin"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if count := atomic.LoadInt32(&dav.propfinds); count != 2 {
+		t.Fatalf("%d lookups of known dirs", count)
+	}
+	// the other client does not know them
+	cloud = newCloudWebDAV(server.URL + "/dav", dav.user, dav.password)
+	if err := cloud.put(ctx, "backup/x/e.bin", strings.NewReader("e"), 1); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if count := atomic.LoadInt32(&dav.propfinds); count != 4 {
+		t.Fatalf("%d lookups by new client", count)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestWebDAVErrors(t *testing.T) {
+	dav, server := startDavServer(t)
+	var ctx = context.Background()
+	var cloud = newCloudWebDAV(server.URL + "/dav", dav.user, dav.password)
+	if err := cloud.put(ctx, "backup/a.bin", strings.NewReader("a"), 1); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	checkKind(t, "full", cloud.put(ctx, "backup/full.bin", strings.NewReader("a"), 1), errQuota)
+	_, err := cloud.get(ctx, "backup/busy.bin")
+	checkKind(t, "busy", err, errTransient)
+	// parent is missing
+	_, err = cloud.get(ctx, "none/a.bin")
+	checkKind(t, "get missing", err, errNotFound)
+
+	var wrong = newCloudWebDAV(server.URL + "/dav", dav.user, "wrong")
+	_, err = wrong.get(ctx, "backup/a.bin")
+	checkKind(t, "wrong password", err, errAuth)
+	_, err = wrong.stat(ctx, "backup/a.bin")
+	checkKind(t, "stat with wrong password", err, errAuth)
+	checkKind(t, "put with wrong password", wrong.put(ctx, "backup/b.bin",
+		strings.NewReader("b"), 1), errAuth)
+
+	server.Close()
+	_, err = cloud.stat(ctx, "backup/a.bin")
+	checkKind(t, "server down", err, errTransient)
+}
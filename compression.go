@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"./libs/github.com/klauspost/compress/zstd"
+	"./libs/github.com/ulikunitz/xz"
+)
+
+// compression algorithms, the one of archive is found by its magic bytes
+// on restore, so it can be changed at any time
+const (
+	compressionXz   = "xz"
+	compressionZstd = "zstd"
+	compressionGzip = "gzip"
+	compressionLz4  = "lz4"
+	compressionNone = "none"
+)
+
+// level is -1 for the default one of algorithm
+type Compression struct {
+	algorithm string
+	level     int
+}
+
+// magic bytes of compressed streams
+var compressionMagic = []struct {
+	algorithm string
+	magic     []byte
+}{
+	{compressionXz, []byte{0xfd, '7', 'z', 'X', 'Z', 0}},
+	{compressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{compressionGzip, []byte{0x1f, 0x8b}},
+	{compressionLz4, []byte{0x04, 0x22, 0x4d, 0x18}},
+}
+
+func (this Compression) String() string {
+	if this.level < 0 {
+		return this.algorithm
+	}
+	return this.algorithm + ":" + strconv.Itoa(this.level)
+}
+
+//------------------------------------------------------------------------------
+// algorithm[:level], e.g. zstd:19
+func parseCompression(value string) (Compression, error) {
+	var pair = strings.SplitN(strings.TrimSpace(value), ":", 2)
+	var compression = Compression{algorithm: pair[0], level: -1}
+	var min, max int
+	switch compression.algorithm {
+	case compressionXz:
+		min, max = 0, 9
+	case compressionZstd:
+		min, max = 1, 22
+	case compressionGzip:
+		min, max = 1, 9
+	case compressionLz4, compressionNone:
+		if len(pair) > 1 {
+			return compression, fmt.Errorf("%s has no levels", compression.algorithm)
+		}
+		return compression, nil
+	default:
+		return compression, fmt.Errorf("unknown compression %s", compression.algorithm)
+	}
+	if len(pair) > 1 {
+		level, err := strconv.Atoi(pair[1])
+		if err != nil || level < min || level > max {
+			return compression, fmt.Errorf("%s level is %d-%d", compression.algorithm, min, max)
+		}
+		compression.level = level
+	}
+	return compression, nil
+}
+
+//------------------------------------------------------------------------------
+// nil writer for no compression
+func compressWriter(output io.Writer, compression Compression) (io.WriteCloser, error) {
+	var level = compression.level
+	switch compression.algorithm {
+	case compressionXz:
+		// xz preset levels differ by dictionary size only
+		var dictSizes = []int{256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+			8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20}
+		if level < 0 {
+			level = 2
+		}
+		var config = xz.WriterConfig{DictCap: dictSizes[level]}
+		return config.NewWriter(output)
+	case compressionZstd:
+		if level < 0 {
+			level = 3
+		}
+		return zstd.NewWriter(output, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	case compressionGzip:
+		if level < 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(output, level)
+	case compressionLz4:
+		return newLz4Writer(output), nil
+	}
+	return nil, nil
+}
+
+//------------------------------------------------------------------------------
+func detectCompression(header []byte) string {
+	for _, item := range compressionMagic {
+		if bytes.HasPrefix(header, item.magic) {
+			return item.algorithm
+		}
+	}
+	return compressionNone
+}
+
+//------------------------------------------------------------------------------
+// algorithm is detected by magic bytes, data without known magic is
+// returned as is
+func decompressReader(input io.Reader) (io.ReadCloser, error) {
+	var buffered = bufio.NewReader(input)
+	header, _ := buffered.Peek(6)
+	switch detectCompression(header) {
+	case compressionXz:
+		reader, err := xz.NewReader(buffered)
+		return ioutil.NopCloser(reader), err
+	case compressionZstd:
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	case compressionGzip:
+		return gzip.NewReader(buffered)
+	case compressionLz4:
+		reader, err := newLz4Reader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(reader), nil
+	}
+	return ioutil.NopCloser(buffered), nil
+}
+
+//------------------------------------------------------------------------------
+func compressData(data []byte, compression Compression) ([]byte, error) {
+	var output bytes.Buffer
+	writer, err := compressWriter(&output, compression)
+	if err != nil {
+		return nil, err
+	}
+	if writer == nil {
+		return nil, errors.New("no compression")
+	}
+	if _, err = writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
+
+//------------------------------------------------------------------------------
+func decompressData(data []byte) ([]byte, error) {
+	reader, err := decompressReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
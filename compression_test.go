@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// settings of the tests: xz at level 1 is much faster than the default one
+var (
+	noCompression   = Compression{compressionNone, -1}
+	fastCompression = Compression{compressionXz, 1}
+)
+
+//------------------------------------------------------------------------------
+func TestParseCompression(t *testing.T) {
+	var tests = []struct {
+		value       string
+		compression Compression
+		ok          bool
+	}{
+		{"xz", Compression{compressionXz, -1}, true},
+		{"xz:9", Compression{compressionXz, 9}, true},
+		{" zstd:19 ", Compression{compressionZstd, 19}, true},
+		{"gzip:1", Compression{compressionGzip, 1}, true},
+		{"lz4", Compression{compressionLz4, -1}, true},
+		{"none", Compression{compressionNone, -1}, true},
+		{"xz:10", Compression{}, false},
+		{"zstd:0", Compression{}, false},
+		{"gzip:x", Compression{}, false},
+		{"lz4:1", Compression{}, false},
+		{"bzip2", Compression{}, false},
+	}
+	for _, test := range tests {
+		compression, err := parseCompression(test.value)
+		if (err == nil) != test.ok || test.ok && compression != test.compression {
+			t.Errorf("%q: %+v, %v", test.value, compression, err)
+		}
+		if test.ok && strings.TrimSpace(test.value) != compression.String() {
+			t.Errorf("%q: string %q", test.value, compression.String())
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// reader finds the algorithm by magic bytes, the settings are not needed
+func TestCompressData(t *testing.T) {
+	var data = bytes.Repeat([]byte("compressible data "), 10000)
+	for _, value := range []string{"xz:1", "zstd:1", "gzip", "lz4"} {
+		compression, _ := parseCompression(value)
+		compressed, err := compressData(data, compression)
+		if err != nil {
+			t.Fatalf("%s: %v", value, err)
+		}
+		if len(compressed) >= len(data) / 10 {
+			t.Errorf("%s: %d bytes", value, len(compressed))
+		}
+		if detected := detectCompression(compressed); detected != compression.algorithm {
+			t.Errorf("%s: detected %s", value, detected)
+		}
+		decompressed, err := decompressData(compressed)
+		if err != nil || !bytes.Equal(decompressed, data) {
+			t.Errorf("%s: %d bytes, %v", value, len(decompressed), err)
+		}
+	}
+	if _, err := compressData(data, noCompression); err == nil {
+		t.Error("none compresses")
+	}
+	if decompressed, err := decompressData(data); err != nil || !bytes.Equal(decompressed, data) {
+		t.Errorf("plain data: %v", err)
+	}
+}
+
+//------------------------------------------------------------------------------
+// archive of one algorithm is restored by the path set to another one
+func TestArchiveCompression(t *testing.T) {
+	var source = filepath.Join(t.TempDir(), "data")
+	writeTree(t, source, map[string]string{"a.txt": strings.Repeat("a", 100000)})
+	var ctx = context.Background()
+	var options = Options{password: "secret"}
+	for _, value := range []string{"zstd", "gzip:9", "lz4", "none"} {
+		compression, _ := parseCompression(value)
+		var item = PathItem{path: source, encryption: true, compression: compression}
+		var archive bytes.Buffer
+		if _, err := writeArchive(ctx, &item, options, &archive); err != nil {
+			t.Fatalf("%s: %v", value, err)
+		}
+		item.compression = fastCompression
+		var dir = t.TempDir()
+		if err := readArchive(ctx, item, options, bytes.NewReader(archive.Bytes()),
+			extractTo(ctx, dir)); err != nil {
+			t.Fatalf("%s: %v", value, err)
+		}
+		checkTree(t, dir, map[string]string{"data/": "", "data/a.txt": strings.Repeat("a", 100000)})
+	}
+}
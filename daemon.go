@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// failed path is retried after that, not in a loop
+const daemonRetryDelay = time.Hour
+
+// the clock is checked at least that often: sleep is counted by the
+// monotonic clock, which stops while the machine is suspended
+const daemonMaxSleep = 10 * time.Minute
+
+//------------------------------------------------------------------------------
+// time the daemon backs up the path at, zero if never
+func daemonNextBackup(item PathItem, current time.Time, options Options) time.Time {
+	var next = nextBackup(&item, current, options)
+	if !next.IsZero() && item.failDate.After(item.date) {
+		if retry := item.failDate.Add(daemonRetryDelay); retry.After(next) {
+			next = retry
+		}
+	}
+	return next
+}
+
+//------------------------------------------------------------------------------
+// listings of repositories and keys derived from the password are not
+// reused after reload: cloud settings or the password may be changed
+func resetRunCaches() {
+	repositories = make(map[string]*Repository)
+	runRecipient = nil
+	derivedKeysLock.Lock()
+	derivedKeys = make(map[string][]byte)
+	derivedKeysLock.Unlock()
+}
+
+//------------------------------------------------------------------------------
+// stays resident and backs up every path when it is due: config is reloaded
+// on SIGHUP, SIGTERM and SIGINT abort the current archive and stop;
+// unfinished upload is only a .part file removed by the next run
+func runDaemon(configPath string, logger *RunLogger, paths []PathItem,
+	options Options) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var reload = make(chan bool, 1)
+	var signals = make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for sig := range signals {
+			if sig != syscall.SIGHUP {
+				cancel()
+				return
+			}
+			select {
+			case reload <- true:
+			default:
+			}
+		}
+	}()
+
+	log.Println("daemon started")
+	var planned time.Time
+	for ctx.Err() == nil {
+		var current = time.Now()
+		var due = func(item PathItem) bool {
+			var next = daemonNextBackup(item, current, options)
+			return !next.IsZero() && !next.After(current)
+		}
+		for _, item := range paths {
+			if !due(item) {
+				continue
+			}
+			if backupPaths(ctx, paths, options, due); ctx.Err() == nil {
+				getTotalBackupSize(paths)
+			}
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		var next time.Time
+		var nextPath string
+		for _, item := range paths {
+			var itemNext = daemonNextBackup(item, time.Now(), options)
+			if !itemNext.IsZero() && (next.IsZero() || itemNext.Before(next)) {
+				next, nextPath = itemNext, item.path
+			}
+		}
+		var sleep = daemonMaxSleep
+		if !next.IsZero() {
+			if !next.Equal(planned) {
+				log.Printf("next backup of %s at %s\n", nextPath, next.Format("2006-01-02 15:04"))
+				planned = next
+			}
+			if wait := time.Until(next); wait < sleep {
+				// a path that is due but not backed up is not retried in a loop
+				sleep = wait
+				if sleep < time.Minute {
+					sleep = time.Minute
+				}
+			}
+		}
+
+		var timer = time.NewTimer(sleep)
+		select {
+		case <-ctx.Done():
+		case <-reload:
+			log.Println("reload config")
+			// a broken config keeps the running one
+			newOptions, newPaths, err := loadConfig(configPath, logger)
+			if err == nil {
+				err = checkWorkingPath(newOptions)
+			}
+			if err != nil {
+				log.Printf("config not reloaded: %v\n", err)
+			} else {
+				options, paths = newOptions, newPaths
+				resetRunCaches()
+				planned = time.Time{}
+			}
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	log.Println("daemon stopped")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// log of the daemon running in another goroutine
+type logBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (this *logBuffer) Write(p []byte) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.buffer.Write(p)
+}
+
+//------------------------------------------------------------------------------
+func (this *logBuffer) wait(t *testing.T, text string) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 10 * time.Second; time.Sleep(10 * time.Millisecond) {
+		this.lock.Lock()
+		var found = strings.Contains(this.buffer.String(), text)
+		this.lock.Unlock()
+		if found {
+			return
+		}
+	}
+	t.Fatalf("no %q in log", text)
+}
+
+//------------------------------------------------------------------------------
+func TestDaemonNextBackup(t *testing.T) {
+	var cron, _ = parseCron("0 3 * * *")
+	var current = parseTestTime(t, "2024-05-10 10:00", time.UTC)
+	var date = parseTestTime(t, "2024-05-09 03:00", time.UTC)
+	var tests = []struct {
+		name     string
+		item     PathItem
+		next     string
+	}{
+		{"scheduled", PathItem{cron: cron, date: date}, "2024-05-10 03:00"},
+		{"retry after failure", PathItem{cron: cron, date: date, failDate: current}, "2024-05-10 11:00"},
+		{"failure before backup", PathItem{cron: cron, date: date, failDate: date.Add(-time.Hour)},
+			"2024-05-10 03:00"},
+		{"schedule after retry", PathItem{every: 6 * time.Hour, date: current,
+			failDate: current.Add(time.Minute)}, "2024-05-10 16:00"},
+		{"never", PathItem{schedule: Once, date: date, failDate: current}, ""},
+	}
+	for _, test := range tests {
+		var next = daemonNextBackup(test.item, current, Options{})
+		var text string
+		if !next.IsZero() {
+			text = next.Format("2006-01-02 15:04")
+		}
+		if text != test.next {
+			t.Errorf("%s: %q, expected %q", test.name, text, test.next)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// SIGHUP loads the paths of the new config, SIGTERM stops the daemon
+func TestDaemonSignals(t *testing.T) {
+	var work = t.TempDir()
+	t.Chdir(work)
+	var source = filepath.Join(t.TempDir(), "data")
+	writeTree(t, source, map[string]string{"a.txt": "a"})
+	var cloudDir = t.TempDir()
+	var configPath = filepath.Join(work, "cloud-backup.ini")
+	var config = "[config]\nworking-dir = " + work + "\nstate-file = " + work + "/state\n" +
+		"cloud = local\nlocal-dir = " + cloudDir + "\ncompression = none\n"
+	ioutil.WriteFile(configPath, []byte(config), 0600)
+
+	var output logBuffer
+	log.SetOutput(&output)
+	defer log.SetOutput(os.Stderr)
+	var logger RunLogger
+	options, paths, err := loadConfig(configPath, &logger)
+	if err != nil || len(paths) != 0 {
+		t.Fatalf("%d paths: %v", len(paths), err)
+	}
+	var stopped = make(chan bool)
+	go func() {
+		runDaemon(configPath, &logger, paths, options)
+		stopped <- true
+	}()
+	output.wait(t, "daemon started")
+
+	ioutil.WriteFile(configPath, []byte(config + "\n[path \"data\"]\nsource = " + source + "\n"), 0600)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	output.wait(t, "reload config")
+	output.wait(t, "back up " + source)
+	output.wait(t, "Total backup size")
+
+	// broken config keeps the running one
+	var broken = "\n[path \"data\"]\nsource = " + source + "\nkeep-last = two\n"
+	ioutil.WriteFile(configPath, []byte(config + broken), 0600)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	output.wait(t, "config not reloaded")
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	select {
+	case <-stopped:
+	case <-time.After(10 * time.Second):
+		t.Fatal("daemon is not stopped")
+	}
+	output.wait(t, "daemon stopped")
+	if names, _ := filepath.Glob(filepath.Join(cloudDir, getStrHash(source) + "-*.bin")); len(names) != 1 {
+		t.Fatalf("archives %v", names)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"sync"
+
+	"./libs/filippo.io/age"
+	"./libs/golang.org/x/crypto/chacha20poly1305"
+	"./libs/golang.org/x/crypto/scrypt"
+)
+
+// native encryption is age format: key is derived from the password by scrypt,
+// data is authenticated in 64 KB chunks, so a tampered or truncated archive
+// is rejected before the broken part reaches tar; archive can be decrypted
+// by hand with age -d
+const (
+	encryptionGpg = "gpg"
+	encryptionAge = "age"
+)
+
+// age stanza of repository data: file key wrapped with the key derived from
+// the password and salt of the run, so thousands of chunks cost one scrypt
+const (
+	repositoryStanza     = "cloud-backup-scrypt"
+	repositoryWorkFactor = 18
+)
+
+// keys derived by this process, by salt, work factor and password
+var derivedKeys = make(map[string][]byte)
+var derivedKeysLock sync.Mutex
+
+// repository recipient of this run
+var runRecipient *RepositoryRecipient
+
+var errNotEncrypted = errors.New("data is not encrypted, but keys are configured")
+
+//------------------------------------------------------------------------------
+func deriveKey(password string, salt []byte, logN int) ([]byte, error) {
+	derivedKeysLock.Lock()
+	defer derivedKeysLock.Unlock()
+
+	var cacheKey = string(salt) + "/" + strconv.Itoa(logN) + "/" + password
+	if key, ok := derivedKeys[cacheKey]; ok {
+		return key, nil
+	}
+	key, err := scrypt.Key([]byte(password), append([]byte(repositoryStanza), salt...),
+		1 << logN, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	derivedKeys[cacheKey] = key
+	return key, nil
+}
+
+type RepositoryRecipient struct {
+	password string
+	salt     []byte
+}
+
+func newRepositoryRecipient(password string) (*RepositoryRecipient, error) {
+	if len(password) == 0 {
+		return nil, errors.New("password is empty")
+	}
+	var salt = make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &RepositoryRecipient{password, salt}, nil
+}
+
+func (this *RepositoryRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) {
+	key, err := deriveKey(this.password, this.salt, repositoryWorkFactor)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	// the key wraps many file keys, nonce has to be random
+	var nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	var stanza = age.Stanza{
+		Type: repositoryStanza,
+		Args: []string{base64.RawStdEncoding.EncodeToString(this.salt),
+			strconv.Itoa(repositoryWorkFactor), base64.RawStdEncoding.EncodeToString(nonce)},
+		Body: aead.Seal(nil, nonce, fileKey, nil),
+	}
+	return []*age.Stanza{&stanza}, nil
+}
+
+type RepositoryIdentity struct {
+	password string
+}
+
+func (this RepositoryIdentity) Unwrap(stanzas []*age.Stanza) ([]byte, error) {
+	for _, stanza := range stanzas {
+		if stanza.Type != repositoryStanza {
+			continue
+		}
+		if len(stanza.Args) != 3 {
+			return nil, errors.New("bad repository key block")
+		}
+		salt, err := base64.RawStdEncoding.DecodeString(stanza.Args[0])
+		if err != nil {
+			return nil, err
+		}
+		logN, err := strconv.Atoi(stanza.Args[1])
+		if err != nil || logN < 1 || logN > 22 {
+			return nil, errors.New("bad work factor of repository key")
+		}
+		nonce, err := base64.RawStdEncoding.DecodeString(stanza.Args[2])
+		if err != nil || len(nonce) != chacha20poly1305.NonceSize {
+			return nil, errors.New("bad nonce of repository key")
+		}
+		key, err := deriveKey(this.password, salt, logN)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := chacha20poly1305.New(key)
+		if err != nil {
+			return nil, err
+		}
+		fileKey, err := aead.Open(nil, nonce, stanza.Body, nil)
+		if err != nil {
+			return nil, errors.New("wrong password")
+		}
+		return fileKey, nil
+	}
+	return nil, age.ErrIncorrectIdentity
+}
+
+//------------------------------------------------------------------------------
+// public keys if there are any, otherwise password recipient in age format,
+// nil means OpenPGP with the password
+func encryptionRecipients(recipients []age.Recipient, options Options,
+	repository bool) ([]age.Recipient, error) {
+	if len(recipients) > 0 || options.encryptionFormat != encryptionAge {
+		return recipients, nil
+	}
+	if !repository {
+		recipient, err := age.NewScryptRecipient(options.password)
+		if err != nil {
+			return nil, err
+		}
+		return []age.Recipient{recipient}, nil
+	}
+	if runRecipient == nil {
+		var err error
+		if runRecipient, err = newRepositoryRecipient(options.password); err != nil {
+			return nil, err
+		}
+	}
+	return []age.Recipient{runRecipient}, nil
+}
+
+//------------------------------------------------------------------------------
+// private keys of identity file and the password ones
+func decryptionIdentities(options Options) []age.Identity {
+	var identities = append([]age.Identity{}, options.identities...)
+	if len(options.password) > 0 {
+		if identity, err := age.NewScryptIdentity(options.password); err == nil {
+			identities = append(identities, identity)
+		}
+		identities = append(identities, RepositoryIdentity{options.password})
+	}
+	return identities
+}
+
+//------------------------------------------------------------------------------
+// with any key configured plain repository data and catalogs are refused,
+// otherwise whoever can write to the cloud could slip in their own
+func isEncryptionRequired(options Options) bool {
+	return isRepositoryEncrypted(options) || len(options.identities) > 0
+}
+
+//------------------------------------------------------------------------------
+// the same for archives, unless encryption is turned off for the path
+func isArchiveEncryptionRequired(item PathItem, options Options) bool {
+	return item.encryption || !item.noEncryption && isEncryptionRequired(options)
+}
+
+//------------------------------------------------------------------------------
+// encrypted data is decrypted, plain one is passed only when no key is set
+func openData(data []byte, options Options) ([]byte, error) {
+	if !isEncrypted(data) {
+		if isEncryptionRequired(options) {
+			return nil, stageFailure(stageEncryption, errNotEncrypted)
+		}
+		return data, nil
+	}
+	data, err := decryptData(data, options)
+	return data, stageFailure(stageEncryption, err)
+}
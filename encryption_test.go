@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"./libs/filippo.io/age"
+)
+
+//------------------------------------------------------------------------------
+func newIdentity(t *testing.T) *age.X25519Identity {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return identity
+}
+
+//------------------------------------------------------------------------------
+// keys as they are given in the config and in the files
+func TestLoadRecipients(t *testing.T) {
+	var first, second, third = newIdentity(t), newIdentity(t), newIdentity(t)
+	var dir = t.TempDir()
+	var keys = filepath.Join(dir, "keys.txt")
+	var content = "# backup keys\n" + second.Recipient().String() + "\n\n" + third.Recipient().String() + "\n"
+	ioutil.WriteFile(keys, []byte(content), 0600)
+	recipients, err := loadRecipients([]string{first.Recipient().String(), keys})
+	if err != nil || len(recipients) != 3 {
+		t.Fatalf("%d recipients: %v", len(recipients), err)
+	}
+
+	for _, list := range [][]string{{"age1bad"}, {filepath.Join(dir, "none")}} {
+		if _, err = loadRecipients(list); err == nil {
+			t.Errorf("%v is accepted", list)
+		}
+	}
+
+	var identityFile = filepath.Join(dir, "key.txt")
+	ioutil.WriteFile(identityFile, []byte("# created\n" + first.String() + "\n"), 0600)
+	identities, err := loadIdentities(identityFile)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("%d identities: %v", len(identities), err)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestIsEncrypted(t *testing.T) {
+	var identity = newIdentity(t)
+	var ageData bytes.Buffer
+	writer, _ := encryptWriter(&ageData, []age.Recipient{identity.Recipient()}, "")
+	writer.Write([]byte("data"))
+	writer.Close()
+	var gpgData bytes.Buffer
+	writer, _ = encryptWriter(&gpgData, nil, "secret")
+	writer.Write([]byte("data"))
+	writer.Close()
+
+	var tests = []struct {
+		data      []byte
+		encrypted bool
+	}{
+		{ageData.Bytes(), true},
+		{gpgData.Bytes(), true},
+		{[]byte("data/\x00\x00"), false},
+		// xz stream
+		{[]byte{0xfd, '7', 'z', 'X', 'Z', 0}, false},
+		{nil, false},
+	}
+	for index, test := range tests {
+		if encrypted := isEncrypted(test.data); encrypted != test.encrypted {
+			t.Errorf("%d: %v", index, encrypted)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// only the identity restores the archive, the host keeps no secret
+func TestArchiveRecipients(t *testing.T) {
+	var identity, other = newIdentity(t), newIdentity(t)
+	var source = filepath.Join(t.TempDir(), "data")
+	writeTree(t, source, map[string]string{"a.txt": "a"})
+	var item = PathItem{path: source, encryption: true, compression: fastCompression,
+		recipients: []age.Recipient{identity.Recipient()}}
+	var ctx = context.Background()
+	var archive bytes.Buffer
+	if _, err := writeArchive(ctx, &item, Options{}, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(archive.String(), ageHeader) {
+		t.Fatalf("archive is not age: %q", archive.Bytes()[:10])
+	}
+
+	var tests = []struct {
+		options Options
+		ok      bool
+	}{
+		{Options{identities: []age.Identity{identity}}, true},
+		{Options{identities: []age.Identity{other, identity}}, true},
+		{Options{identities: []age.Identity{other}}, false},
+		{Options{password: "secret"}, false},
+	}
+	for index, test := range tests {
+		var dir = t.TempDir()
+		var err = readArchive(ctx, item, test.options, bytes.NewReader(archive.Bytes()),
+			extractTo(ctx, dir))
+		if (err == nil) != test.ok || !test.ok && stageOf(err) != stageEncryption {
+			t.Fatalf("%d: %v", index, err)
+		}
+		if test.ok {
+			checkTree(t, dir, map[string]string{"data/": "", "data/a.txt": "a"})
+		}
+	}
+
+	// encryption and compression are found by the data, not by the path settings
+	var plain = PathItem{path: source}
+	var dir = t.TempDir()
+	var options = Options{identities: []age.Identity{identity}}
+	if err := readArchive(ctx, plain, options, bytes.NewReader(archive.Bytes()),
+		extractTo(ctx, dir)); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dir, map[string]string{"data/": "", "data/a.txt": "a"})
+}
+
+//------------------------------------------------------------------------------
+func TestRepositoryRecipients(t *testing.T) {
+	var identity = newIdentity(t)
+	var options = Options{recipients: []age.Recipient{identity.Recipient()}}
+	var data = []byte("chunk data")
+	var id = chunkId(data, ChunkKeys{})
+	payload, err := encodeChunk(data, noCompression, options)
+	if err != nil || !bytes.HasPrefix(payload, []byte(ageHeader)) {
+		t.Fatalf("chunk is not encrypted: %v", err)
+	}
+	if _, err = decodeChunk(payload, id, options); err == nil {
+		t.Fatal("chunk is decoded without identity")
+	}
+	options.identities = []age.Identity{identity}
+	if decoded, err := decodeChunk(payload, id, options); err != nil || !bytes.Equal(decoded, data) {
+		t.Fatalf("decoded %q: %v", decoded, err)
+	}
+}
+
+//------------------------------------------------------------------------------
+// password archive in age format is the plain scrypt recipient of age
+func TestArchivePassword(t *testing.T) {
+	var source = filepath.Join(t.TempDir(), "data")
+	writeTree(t, source, map[string]string{"a.txt": "a"})
+	var item = PathItem{path: source, encryption: true, compression: fastCompression}
+	var options = Options{password: "secret", encryptionFormat: encryptionAge}
+	var ctx = context.Background()
+	var archive bytes.Buffer
+	if _, err := writeArchive(ctx, &item, options, &archive); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(archive.String(), ageHeader) {
+		t.Fatalf("archive is not age: %q", archive.Bytes()[:10])
+	}
+	identity, _ := age.NewScryptIdentity("secret")
+	if _, err := age.Decrypt(bytes.NewReader(archive.Bytes()), identity); err != nil {
+		t.Fatalf("age -d fails: %v", err)
+	}
+
+	var dir = t.TempDir()
+	if err := readArchive(ctx, item, options, bytes.NewReader(archive.Bytes()),
+		extractTo(ctx, dir)); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dir, map[string]string{"data/": "", "data/a.txt": "a"})
+	options.password = "wrong"
+	err := readArchive(ctx, item, options, bytes.NewReader(archive.Bytes()),
+		extractTo(ctx, t.TempDir()))
+	if err == nil || stageOf(err) != stageEncryption {
+		t.Fatalf("wrong password: %v", err)
+	}
+}
+
+//------------------------------------------------------------------------------
+// chunks of one run share the salt, so the key is derived once
+func TestRepositoryStanza(t *testing.T) {
+	runRecipient = nil
+	defer func() { runRecipient = nil }()
+	var options = Options{password: "secret", encryptionFormat: encryptionAge}
+	var first, second = []byte("first chunk"), []byte("second chunk")
+	firstPayload, err := encodeChunk(first, noCompression, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondPayload, err := encodeChunk(second, noCompression, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(firstPayload, []byte("-> " + repositoryStanza + " ")) {
+		t.Fatalf("no %s stanza: %q", repositoryStanza, firstPayload[:64])
+	}
+	var header = func(payload []byte) string {
+		var line = bytes.SplitN(payload, []byte("\n"), 3)[1]
+		var args = strings.Fields(string(line))
+		// nonce differs, salt and work factor do not
+		return strings.Join(args[:4], " ")
+	}
+	if header(firstPayload) != header(secondPayload) {
+		t.Errorf("salt differs: %s, %s", header(firstPayload), header(secondPayload))
+	}
+
+	decoded, err := decodeChunk(secondPayload, chunkId(second, testChunkKeys(t, "secret")), options)
+	if err != nil || !bytes.Equal(decoded, second) {
+		t.Fatalf("decoded %q: %v", decoded, err)
+	}
+	options.password = "wrong"
+	if _, err = decodeChunk(firstPayload, chunkId(first, testChunkKeys(t, "secret")), options); err == nil {
+		t.Fatal("chunk is decoded with wrong password")
+	}
+
+	// broken stanzas are rejected, not passed to scrypt
+	var tests = []struct {
+		args []string
+	}{
+		{[]string{"c2FsdA"}},
+		{[]string{"c2FsdA", "40", "AAAAAAAAAAAAAAAA"}},
+		{[]string{"c2FsdA", "18", "short"}},
+		{[]string{"!", "18", "AAAAAAAAAAAAAAAA"}},
+	}
+	for index, test := range tests {
+		var stanza = age.Stanza{Type: repositoryStanza, Args: test.args}
+		if _, err := (RepositoryIdentity{"secret"}).Unwrap([]*age.Stanza{&stanza}); err == nil {
+			t.Errorf("%d: accepted", index)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// with keys configured plain data in the cloud dir is not trusted: archives,
+// chunks, snapshots and catalogs have to be encrypted
+func TestRefusePlainData(t *testing.T) {
+	var identity = newIdentity(t)
+	var source = filepath.Join(t.TempDir(), "data")
+	writeTree(t, source, map[string]string{"a.txt": "a"})
+	var ctx = context.Background()
+	var plainItem = PathItem{path: source, compression: noCompression}
+	var archive bytes.Buffer
+	if _, err := writeArchive(ctx, &plainItem, Options{}, &archive); err != nil {
+		t.Fatal(err)
+	}
+	var data = []byte("chunk data")
+	chunk, _ := encodeChunk(data, noCompression, Options{})
+	var snapshot = Snapshot{path: source, hash: "hash"}
+	snapshotData, _ := snapshot.encode(Options{})
+	var catalog = Catalog{host: "host", date: time.Now()}
+	catalogData, _ := catalog.encode(Options{})
+	var cloud = CloudLocal{t.TempDir()}
+	putCommitted(ctx, cloud, "snapshot.snap", snapshotData)
+	putCommitted(ctx, cloud, "catalog.bin", catalogData)
+
+	var tests = []struct {
+		name    string
+		options Options
+		refused bool
+	}{
+		{"no keys", Options{}, false},
+		{"password", Options{password: "secret"}, true},
+		{"recipients", Options{recipients: []age.Recipient{identity.Recipient()}}, true},
+		{"identity", Options{identities: []age.Identity{identity}}, true},
+	}
+	for _, test := range tests {
+		var check = func(what string, err error) {
+			t.Helper()
+			if (err != nil) != test.refused || test.refused && !errors.Is(err, errNotEncrypted) {
+				t.Errorf("%s, %s: %v", test.name, what, err)
+			}
+		}
+		var item = PathItem{path: source}
+		check("archive", readArchive(ctx, item, test.options, bytes.NewReader(archive.Bytes()),
+			extractTo(ctx, t.TempDir())))
+		_, err := decodeChunk(chunk, chunkId(data, testChunkKeys(t, test.options.password)), test.options)
+		check("chunk", err)
+		_, err = loadSnapshot(ctx, cloud, "snapshot.snap", test.options)
+		check("snapshot", err)
+		_, err = loadCatalog(ctx, cloud, "catalog.bin", test.options)
+		check("catalog", err)
+
+		// unless encryption is turned off for the path
+		item.noEncryption = true
+		if err = readArchive(ctx, item, test.options, bytes.NewReader(archive.Bytes()),
+			extractTo(ctx, t.TempDir())); err != nil {
+			t.Errorf("%s, path without encryption: %v", test.name, err)
+		}
+	}
+}
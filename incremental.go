@@ -0,0 +1,281 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// tar entry of delta archive listing removed files, one name per line,
+// it is placed beside the backed up directory
+const deletedEntry = ".cloud-backup-deleted"
+
+// full backup is made at least that often in incremental mode
+const defaultFullInterval = 30 * 24 * time.Hour
+
+// state of a file at the last backup
+type ManifestEntry struct {
+	size  int64
+	mtime int64
+	inode uint64
+	mode  os.FileMode
+	// md5 of content or of link target
+	hash string
+}
+
+// entries by tar name
+type Manifest map[string]ManifestEntry
+
+// what an incremental archive carries
+type Delta struct {
+	changed map[string]bool
+	deleted []string
+}
+
+//------------------------------------------------------------------------------
+// manifest is kept beside the state file
+func manifestFile(item *PathItem, options Options) string {
+	return options.stateFile + "." + item.pathHash + ".manifest"
+}
+
+//------------------------------------------------------------------------------
+// size,mtime,inode,mode,hash,name - name is the last as it may have commas;
+// nil manifest if there is no file
+func loadManifest(fileName string) (Manifest, error) {
+	file, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var manifest = make(Manifest)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1 << 20)
+	for scanner.Scan() {
+		list := strings.SplitN(scanner.Text(), ",", 6)
+		if len(list) < 6 {
+			return nil, fmt.Errorf("bad manifest line: %s", scanner.Text())
+		}
+		var entry ManifestEntry
+		entry.size, _ = strconv.ParseInt(list[0], 10, 64)
+		entry.mtime, _ = strconv.ParseInt(list[1], 10, 64)
+		entry.inode, _ = strconv.ParseUint(list[2], 10, 64)
+		mode, _ := strconv.ParseUint(list[3], 8, 32)
+		entry.mode = os.FileMode(mode)
+		entry.hash = list[4]
+		manifest[list[5]] = entry
+	}
+	return manifest, scanner.Err()
+}
+
+//------------------------------------------------------------------------------
+// replaced atomically, a broken manifest means a wrong delta
+func saveManifest(fileName string, manifest Manifest) error {
+	var names []string
+	for name := range manifest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var temp = fileName + ".tmp"
+	file, err := os.Create(temp)
+	if err != nil {
+		return err
+	}
+	var writer = bufio.NewWriter(file)
+	for _, name := range names {
+		var entry = manifest[name]
+		fmt.Fprintf(writer, "%d,%d,%d,%o,%s,%s\n",
+			entry.size, entry.mtime, entry.inode, uint32(entry.mode), entry.hash, name)
+	}
+	err = writer.Flush()
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(temp, fileName)
+	}
+	if err != nil {
+		os.Remove(temp)
+	}
+	return err
+}
+
+//------------------------------------------------------------------------------
+func contentHash(fileName string, fi os.FileInfo) (string, error) {
+	var hash = md5.New()
+	switch {
+	case fi.Mode() & os.ModeSymlink != 0:
+		link, err := os.Readlink(fileName)
+		if err != nil {
+			return "", err
+		}
+		hash.Write([]byte(link))
+	case fi.Mode().IsRegular():
+		file, err := os.Open(fileName)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(hash, file)
+		file.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+//------------------------------------------------------------------------------
+// current state of the tree, content is read only for files
+// which metadata differs from the previous manifest
+func scanSource(ctx context.Context, item *PathItem, previous Manifest) (Manifest, error) {
+	var manifest = make(Manifest)
+	err := walkSource(ctx, item, func(name string, fileName string, fi os.FileInfo) error {
+		var entry = ManifestEntry{
+			size:  fi.Size(),
+			mtime: fi.ModTime().UnixNano(),
+			mode:  fi.Mode(),
+		}
+		if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+			entry.inode = uint64(stat.Ino)
+		}
+		if fi.IsDir() {
+			entry.size = 0
+			entry.mtime = 0
+		}
+
+		old, found := previous[name]
+		if found && old.size == entry.size && old.mtime == entry.mtime &&
+			old.inode == entry.inode && old.mode == entry.mode {
+			entry.hash = old.hash
+		} else if !fi.IsDir() {
+			var err error
+			if entry.hash, err = contentHash(fileName, fi); err != nil {
+				return err
+			}
+		}
+		manifest[name] = entry
+		return nil
+	})
+	return manifest, stageFailure(stageTar, err)
+}
+
+//------------------------------------------------------------------------------
+// touched files with the same content are not changed
+func compareManifests(previous Manifest, current Manifest) *Delta {
+	var delta = Delta{changed: make(map[string]bool)}
+	for name, entry := range current {
+		old, found := previous[name]
+		if !found || old.hash != entry.hash || old.mode != entry.mode {
+			delta.changed[name] = true
+		}
+	}
+	for name := range previous {
+		if _, found := current[name]; !found {
+			delta.deleted = append(delta.deleted, name)
+		}
+	}
+	sort.Strings(delta.deleted)
+	return &delta
+}
+
+//------------------------------------------------------------------------------
+func writeDeleted(writer *tar.Writer, deleted []string) error {
+	var content = strings.Join(deleted, "\n")
+	var header = tar.Header{
+		Name:     deletedEntry,
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		Size:     int64(len(content)),
+		ModTime:  time.Unix(0, 0),
+	}
+	if err := writer.WriteHeader(&header); err != nil {
+		return err
+	}
+	_, err := io.WriteString(writer, content)
+	return err
+}
+
+//------------------------------------------------------------------------------
+// removes files listed in deletion entry of delta archive, only the ones
+// restored from the archives before it are touched
+func applyDeleted(reader io.Reader, target *RestoreTarget) error {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+	for _, name := range getList(string(content), "\n") {
+		if _, err = extractPath(target.dir, name); err != nil {
+			return err
+		}
+		if err = target.remove(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// decides between full and delta archive for incremental path,
+// false if nothing changed since the last backup
+func prepareIncremental(ctx context.Context, item *PathItem, options Options) (bool, error) {
+	item.delta = nil
+	previous, err := loadManifest(manifestFile(item, options))
+	if err != nil {
+		log.Printf("manifest not loaded, full backup: %v\n", err)
+		previous = nil
+	}
+	if item.manifest, err = scanSource(ctx, item, previous); err != nil {
+		return false, err
+	}
+	// tar hash of a delta says nothing about the source
+	item.dataHash = ""
+
+	versions, err := listVersions(ctx, *item, options)
+	if err != nil {
+		return false, err
+	}
+	var lastFull time.Time
+	for _, version := range versions {
+		if !version.delta {
+			lastFull = version.date
+			break
+		}
+	}
+	if previous == nil || lastFull.IsZero() || time.Since(lastFull) >= item.fullInterval {
+		log.Printf("full backup, the last one: %v\n", lastFull)
+		return true, nil
+	}
+
+	var delta = compareManifests(previous, item.manifest)
+	if len(delta.changed) == 0 && len(delta.deleted) == 0 {
+		log.Printf("source not changed, skipping ")
+		return false, nil
+	}
+	log.Printf("incremental backup: %d changed, %d deleted\n", len(delta.changed), len(delta.deleted))
+	item.delta = delta
+	return true, nil
+}
+
+//------------------------------------------------------------------------------
+// manifest is saved only when the archive made from it is in the cloud
+func commitIncremental(item *PathItem, options Options) {
+	if err := saveManifest(manifestFile(item, options), item.manifest); err != nil {
+		log.Printf("manifest not saved, next backup is bigger: %v\n", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// names may have commas
+func TestManifestRoundTrip(t *testing.T) {
+	var manifest = Manifest{
+		"data/a,b.txt": {size: 10, mtime: 1715372400000000000, inode: 42, mode: 0640, hash: "x"},
+		"data/":        {mode: os.ModeDir | 0750},
+		"data/link":    {size: 5, mode: os.ModeSymlink | 0777, hash: "y"},
+	}
+	var fileName = filepath.Join(t.TempDir(), "manifest")
+	if err := saveManifest(fileName, manifest); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadManifest(fileName)
+	if err != nil || len(loaded) != len(manifest) {
+		t.Fatalf("loaded %v %v", loaded, err)
+	}
+	for name, entry := range manifest {
+		if loaded[name] != entry {
+			t.Errorf("%s: %+v, expected %+v", name, loaded[name], entry)
+		}
+	}
+	if loaded, err = loadManifest(fileName + ".none"); loaded != nil || err != nil {
+		t.Fatalf("missing manifest: %v %v", loaded, err)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestCompareManifests(t *testing.T) {
+	var previous = Manifest{
+		"data/same":    {size: 1, mtime: 1, hash: "a", mode: 0600},
+		"data/touched": {size: 1, mtime: 1, hash: "b", mode: 0600},
+		"data/edited":  {size: 1, mtime: 1, hash: "c", mode: 0600},
+		"data/chmod":   {size: 1, mtime: 1, hash: "d", mode: 0600},
+		"data/gone":    {size: 1, mtime: 1, hash: "e", mode: 0600},
+	}
+	var current = Manifest{
+		"data/same":    {size: 1, mtime: 1, hash: "a", mode: 0600},
+		"data/touched": {size: 1, mtime: 2, hash: "b", mode: 0600},
+		"data/edited":  {size: 1, mtime: 2, hash: "x", mode: 0600},
+		"data/chmod":   {size: 1, mtime: 1, hash: "d", mode: 0644},
+		"data/new":     {size: 1, mtime: 1, hash: "f", mode: 0600},
+	}
+	var delta = compareManifests(previous, current)
+	var changed []string
+	for name := range delta.changed {
+		changed = append(changed, name)
+	}
+	sort.Strings(changed)
+	if strings.Join(changed, " ") != "data/chmod data/edited data/new" ||
+		strings.Join(delta.deleted, " ") != "data/gone" {
+		t.Fatalf("changed %v, deleted %v", changed, delta.deleted)
+	}
+}
+
+//------------------------------------------------------------------------------
+// one run of proccessPathItem at the given time, false if nothing is uploaded
+func backupIncremental(t *testing.T, item *PathItem, options Options, date time.Time) bool {
+	t.Helper()
+	var ctx = context.Background()
+	item.archive = versionName(item.pathHash, item.hostId, date)
+	upload, err := prepareIncremental(ctx, item, options)
+	if err != nil || !upload {
+		if err != nil {
+			t.Fatalf("prepare: %v", err)
+		}
+		return false
+	}
+	if item.delta != nil {
+		item.archive = deltaVersionName(item.pathHash, item.hostId, date)
+	}
+	if upload, err = createArchive(ctx, item, options); err == nil && upload {
+		err = uploadArchive(ctx, item, options)
+	}
+	if err != nil || !upload {
+		t.Fatalf("archive %s: %v %v", item.archive, upload, err)
+	}
+	commitIncremental(item, options)
+	return true
+}
+
+//------------------------------------------------------------------------------
+// every version restores the tree as it was at its backup
+func TestIncrementalChain(t *testing.T) {
+	var work = t.TempDir()
+	t.Chdir(work)
+	var source = filepath.Join(t.TempDir(), "data")
+	var options = Options{stateFile: filepath.Join(work, "state"), workingPath: work + "/",
+		password: "secret"}
+	var item = PathItem{path: source, pathHash: getStrHash(source), incremental: true,
+		fullInterval: defaultFullInterval, encryption: true, compression: fastCompression,
+		retention: Retention{last: 10}, cloud: CloudLocal{t.TempDir()}, cloudPath: "backup/"}
+
+	var now = time.Now().Truncate(time.Second)
+	var steps = []struct {
+		change func()
+		delta  bool
+		tree   map[string]string
+	}{
+		{func() {
+			writeTree(t, source, map[string]string{"a.txt": "a", "sub/b.txt": "b", "sub/c.txt": "c"})
+		}, false, map[string]string{"data/": "", "data/a.txt": "a", "data/sub/": "",
+			"data/sub/b.txt": "b", "data/sub/c.txt": "c"}},
+		{func() {
+			writeTree(t, source, map[string]string{"a.txt": "a2", "d.txt": "d"})
+			os.Remove(filepath.Join(source, "sub", "c.txt"))
+		}, true, map[string]string{"data/": "", "data/a.txt": "a2", "data/d.txt": "d", "data/sub/": "",
+			"data/sub/b.txt": "b"}},
+		{func() {
+			os.RemoveAll(filepath.Join(source, "sub"))
+		}, true, map[string]string{"data/": "", "data/a.txt": "a2", "data/d.txt": "d"}},
+	}
+	var names []string
+	for index, step := range steps {
+		step.change()
+		var date = now.Add(time.Duration(index - len(steps)) * time.Hour)
+		if !backupIncremental(t, &item, options, date) {
+			t.Fatalf("step %d: nothing uploaded", index)
+		}
+		if (item.delta != nil) != step.delta {
+			t.Fatalf("step %d: delta %v", index, item.delta != nil)
+		}
+		names = append(names, item.archive)
+	}
+	// touch is not a change
+	var fileName = filepath.Join(source, "a.txt")
+	os.Chtimes(fileName, now, now)
+	if backupIncremental(t, &item, options, now) {
+		t.Fatal("touched file is uploaded")
+	}
+
+	for index, step := range steps {
+		var dir = t.TempDir()
+		var restore = options
+		restore.workingPath = dir + "/"
+		if err := restoreArchive(context.Background(), item, names[index],
+			newRestoreTarget(dir, conflictOverwrite), restore); err != nil {
+			t.Fatalf("restore %s: %v", names[index], err)
+		}
+		checkTree(t, dir, step.tree)
+	}
+
+	// the full archive is made when the last one is too old
+	item.fullInterval = time.Hour
+	writeTree(t, source, map[string]string{"e.txt": "e"})
+	if !backupIncremental(t, &item, options, now) || item.delta != nil {
+		t.Fatalf("full backup is not made: %v", item.delta)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"./libs/github.com/cloudfoundry/bytefmt"
+)
+
+// entry of archive listing, fields are as printed by ls --json
+type ListEntry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Size  int64  `json:"size"`
+	Mode  string `json:"mode"`
+	// RFC 3339, archives of old format and manifests have no mtimes of dirs
+	Mtime string `json:"mtime,omitempty"`
+	// user:group, manifests have no owners
+	Owner string `json:"owner,omitempty"`
+	Link  string `json:"link,omitempty"`
+}
+
+//------------------------------------------------------------------------------
+func entryType(mode os.FileMode, hardLink bool) string {
+	switch {
+	case hardLink:
+		return "hardlink"
+	case mode.IsDir():
+		return "dir"
+	case mode & os.ModeSymlink != 0:
+		return "symlink"
+	case mode.IsRegular():
+		return "file"
+	}
+	return "other"
+}
+
+//------------------------------------------------------------------------------
+func headerEntry(header *tar.Header) ListEntry {
+	var mode = header.FileInfo().Mode()
+	var entry = ListEntry{
+		Name: header.Name,
+		Type: entryType(mode, header.Typeflag == tar.TypeLink),
+		Size: header.Size,
+		Mode: mode.String(),
+		Link: header.Linkname,
+	}
+	if header.ModTime.Unix() != 0 {
+		entry.Mtime = header.ModTime.UTC().Format(time.RFC3339)
+	}
+	var user, group = header.Uname, header.Gname
+	if len(user) == 0 {
+		user = strconv.Itoa(header.Uid)
+	}
+	if len(group) == 0 {
+		group = strconv.Itoa(header.Gid)
+	}
+	entry.Owner = user + ":" + group
+	return entry
+}
+
+//------------------------------------------------------------------------------
+// entries of tar stream are added to the listing, the ones deleted by delta
+// are removed from it
+func listTar(ctx context.Context, input io.Reader, include []string,
+	entries map[string]ListEntry) error {
+	var reader = tar.NewReader(input)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = ctx.Err()
+		}
+		if err != nil {
+			return stageFailure(stageTar, err)
+		}
+		if header.Name == deletedEntry {
+			content, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return stageFailure(stageTar, err)
+			}
+			for _, name := range getList(string(content), "\n") {
+				name = strings.TrimSuffix(name, "/")
+				for key := range entries {
+					if strings.TrimSuffix(key, "/") == name || strings.HasPrefix(key, name + "/") {
+						delete(entries, key)
+					}
+				}
+			}
+			continue
+		}
+		if len(include) == 0 || isIncluded(include, header.Name) {
+			entries[header.Name] = headerEntry(header)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// the local manifest describes the newest version of incremental path,
+// nil if there is none
+func manifestListing(item PathItem, include []string, options Options) map[string]ListEntry {
+	var fileName = manifestFile(&item, options)
+	manifest, err := loadManifest(fileName)
+	if err != nil {
+		log.Printf("manifest not loaded: %v\n", err)
+	}
+	if manifest == nil {
+		return nil
+	}
+	log.Printf("list %s\n", fileName)
+	var entries = make(map[string]ListEntry)
+	for name, value := range manifest {
+		if value.mode.IsDir() {
+			name += "/"
+		}
+		if len(include) > 0 && !isIncluded(include, name) {
+			continue
+		}
+		var entry = ListEntry{
+			Name: name,
+			Type: entryType(value.mode, false),
+			Size: value.size,
+			Mode: value.mode.String(),
+		}
+		if value.mtime != 0 {
+			entry.Mtime = time.Unix(0, value.mtime).UTC().Format(time.RFC3339)
+		}
+		entries[name] = entry
+	}
+	return entries
+}
+
+//------------------------------------------------------------------------------
+// contents of the version (delta is listed with the archives before it),
+// sorted by names; archives are streamed, nothing is written to disk
+func listArchive(ctx context.Context, item PathItem, request RestoreRequest,
+	options Options) ([]ListEntry, error) {
+	include, err := includePatterns(request.include, item)
+	if err != nil {
+		return nil, err
+	}
+	chain, newest, err := findChain(ctx, item, request.version, options)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]ListEntry
+	// the state knows if the manifest is saved for the newest version
+	var last = len(item.versions) - 1
+	if item.incremental && newest && last >= 0 && item.versions[last] == chain[len(chain) - 1].name {
+		entries = manifestListing(item, include, options)
+	}
+	if entries == nil {
+		entries = make(map[string]ListEntry)
+		err = readChain(ctx, item, chain, func(reader io.Reader) error {
+			return listTar(ctx, reader, include, entries)
+		}, options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var list []ListEntry
+	for _, entry := range entries {
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+//------------------------------------------------------------------------------
+// ls --json prints only the listing to stdout, the log goes to stderr
+func isJsonListing(args []string) bool {
+	if len(args) < 2 || args[0] != "ls" && args[0] != "browse" {
+		return false
+	}
+	request, err := parseRestoreArgs(args[1:], true)
+	return err == nil && request.json
+}
+
+//------------------------------------------------------------------------------
+// listing of every item, json is one array of all of them
+func printArchives(ctx context.Context, items []PathItem, request RestoreRequest,
+	options Options) error {
+	var all []ListEntry
+	for _, item := range items {
+		list, err := listArchive(ctx, item, request, options)
+		if err != nil {
+			return err
+		}
+		if request.json {
+			all = append(all, list...)
+		} else if err = printListing(list, false); err != nil {
+			return err
+		}
+	}
+	if request.json {
+		return printListing(all, true)
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// ls -l like lines and the total or json array
+func printListing(list []ListEntry, asJson bool) error {
+	if asJson {
+		if list == nil {
+			list = []ListEntry{}
+		}
+		var encoder = json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(list)
+	}
+	var total int64
+	for _, entry := range list {
+		var mtime = "-"
+		if date, err := time.Parse(time.RFC3339, entry.Mtime); err == nil {
+			mtime = date.Local().Format("2006-01-02 15:04")
+		}
+		var name = entry.Name
+		if entry.Type == "symlink" {
+			name += " -> " + entry.Link
+		} else if entry.Type == "hardlink" {
+			name += " link to " + entry.Link
+		}
+		fmt.Printf("%s %-17s %12d %16s %s\n", entry.Mode, entry.Owner, entry.Size, mtime, name)
+		total += entry.Size
+	}
+	fmt.Printf("%d entries, %s\n", len(list), bytefmt.ByteSize(uint64(total)))
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+func listingNames(list []ListEntry) string {
+	var names []string
+	for _, entry := range list {
+		names = append(names, entry.Name)
+	}
+	return strings.Join(names, " ")
+}
+
+//------------------------------------------------------------------------------
+// stdout of the function
+func captureOutput(t *testing.T, function func()) string {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout = os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+	var output = make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(reader)
+		output <- data
+	}()
+	function()
+	writer.Close()
+	return string(<-output)
+}
+
+//------------------------------------------------------------------------------
+// delta removes the deleted entries, the selection applies to both
+func TestListTar(t *testing.T) {
+	var date = time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	var full = craftTar(t, []tar.Header{
+		{Name: "data/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: date, Uname: "user", Gname: "staff"},
+		{Name: "data/a.txt", Typeflag: tar.TypeReg, Linkname: "aaa", ModTime: date, Uid: 1000, Gid: 100},
+		{Name: "data/link", Typeflag: tar.TypeSymlink, Linkname: "a.txt"},
+		{Name: "data/hard", Typeflag: tar.TypeLink, Linkname: "data/a.txt"},
+		{Name: "data/sub/", Typeflag: tar.TypeDir},
+		{Name: "data/sub/b.conf", Typeflag: tar.TypeReg, Linkname: "b"},
+	})
+	var delta = craftTar(t, []tar.Header{
+		{Name: deletedEntry, Typeflag: tar.TypeReg, Linkname: "data/sub\ndata/link"},
+		{Name: "data/c.conf", Typeflag: tar.TypeReg, Linkname: "c"},
+	})
+	var ctx = context.Background()
+	var entries = make(map[string]ListEntry)
+	if err := listTar(ctx, bytes.NewReader(full), nil, entries); err != nil {
+		t.Fatal(err)
+	}
+	var expected = map[string]ListEntry{
+		"data/": {Name: "data/", Type: "dir", Mode: "drwxr-xr-x", Mtime: "2024-05-10T12:00:00Z",
+			Owner: "user:staff"},
+		"data/a.txt": {Name: "data/a.txt", Type: "file", Size: 3, Mode: "-rw-r--r--",
+			Mtime: "2024-05-10T12:00:00Z", Owner: "1000:100"},
+		"data/link": {Name: "data/link", Type: "symlink", Mode: "Lrw-r--r--", Owner: "0:0", Link: "a.txt"},
+		"data/hard": {Name: "data/hard", Type: "hardlink", Mode: "-rw-r--r--", Owner: "0:0",
+			Link: "data/a.txt"},
+	}
+	for name, entry := range expected {
+		if entries[name] != entry {
+			t.Errorf("%s: %+v", name, entries[name])
+		}
+	}
+
+	if err := listTar(ctx, bytes.NewReader(delta), nil, entries); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, " ") != "data/ data/a.txt data/c.conf data/hard" {
+		t.Fatalf("after delta %v", names)
+	}
+
+	entries = make(map[string]ListEntry)
+	for _, input := range [][]byte{full, delta} {
+		if err := listTar(ctx, bytes.NewReader(input), []string{"*.conf"}, entries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(entries) != 1 || entries["data/c.conf"].Size != 1 {
+		t.Fatalf("selected %v", entries)
+	}
+}
+
+//------------------------------------------------------------------------------
+// every version of the chain is listed as it was backed up, the newest one
+// by the manifest
+func TestListArchive(t *testing.T) {
+	var work = t.TempDir()
+	t.Chdir(work)
+	var source = filepath.Join(t.TempDir(), "data")
+	var options = Options{stateFile: filepath.Join(work, "state"), workingPath: work + "/",
+		password: "secret"}
+	var item = PathItem{path: source, pathHash: getStrHash(source), incremental: true,
+		fullInterval: defaultFullInterval, encryption: true, compression: fastCompression,
+		retention: Retention{last: 10}, cloud: CloudLocal{t.TempDir()}, cloudPath: "backup/"}
+	var now = time.Now().Truncate(time.Second)
+	writeTree(t, source, map[string]string{"a.txt": "a", "sub/b.conf": "b"})
+	backupIncremental(t, &item, options, now.Add(-2 * time.Hour))
+	var first = item.archive
+	os.RemoveAll(filepath.Join(source, "sub"))
+	writeTree(t, source, map[string]string{"c.conf": "cc"})
+	backupIncremental(t, &item, options, now.Add(-time.Hour))
+
+	var ctx = context.Background()
+	var tests = []struct {
+		version string
+		include []string
+		names   string
+	}{
+		{first, nil, "data/ data/a.txt data/sub/ data/sub/b.conf"},
+		{first, []string{source + "/sub"}, "data/sub/ data/sub/b.conf"},
+		{item.archive, nil, "data/ data/a.txt data/c.conf"},
+		{"", []string{"*.conf"}, "data/c.conf"},
+	}
+	for _, test := range tests {
+		var request = RestoreRequest{version: test.version, include: test.include}
+		list, err := listArchive(ctx, item, request, options)
+		if err != nil {
+			t.Fatalf("%s: %v", test.version, err)
+		}
+		if names := listingNames(list); names != test.names {
+			t.Errorf("%s %v: %s", test.version, test.include, names)
+		}
+	}
+
+	// the same without the manifest, by the archives
+	os.Remove(manifestFile(&item, options))
+	list, err := listArchive(ctx, item, RestoreRequest{}, options)
+	if err != nil || listingNames(list) != "data/ data/a.txt data/c.conf" {
+		t.Fatalf("without manifest %s: %v", listingNames(list), err)
+	}
+	if list[2].Size != 2 || list[2].Type != "file" || len(list[2].Mtime) == 0 {
+		t.Fatalf("entry %+v", list[2])
+	}
+	if _, err = listArchive(ctx, item, RestoreRequest{include: []string{"["}}, options); err == nil {
+		t.Fatal("bad pattern is accepted")
+	}
+
+	// several items make one json array, text has a total of each
+	var items = []PathItem{item, item}
+	var decoded []ListEntry
+	var output = captureOutput(t, func() {
+		err = printArchives(ctx, items, RestoreRequest{json: true}, options)
+	})
+	if err != nil || json.Unmarshal([]byte(output), &decoded) != nil || len(decoded) != 6 {
+		t.Fatalf("json of items %v:\n%s", err, output)
+	}
+	output = captureOutput(t, func() { err = printArchives(ctx, items, RestoreRequest{}, options) })
+	if err != nil || strings.Count(output, "3 entries") != 2 {
+		t.Fatalf("listing of items %v:\n%s", err, output)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestPrintListing(t *testing.T) {
+	var list = []ListEntry{
+		{Name: "data/", Type: "dir", Mode: "drwxr-xr-x", Owner: "user:staff"},
+		{Name: "data/a.txt", Type: "file", Size: 2048, Mode: "-rw-r--r--",
+			Mtime: "2024-05-10T12:00:00Z", Owner: "user:staff"},
+		{Name: "data/link", Type: "symlink", Mode: "Lrwxrwxrwx", Link: "a.txt"},
+	}
+	var output = captureOutput(t, func() { printListing(list, false) })
+	var lines = strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 4 || !strings.HasSuffix(lines[2], "data/link -> a.txt") ||
+		lines[3] != "3 entries, 2K" {
+		t.Fatalf("listing:\n%s", output)
+	}
+
+	var decoded []ListEntry
+	output = captureOutput(t, func() { printListing(list, true) })
+	if err := json.Unmarshal([]byte(output), &decoded); err != nil || len(decoded) != 3 ||
+		decoded[1] != list[1] {
+		t.Fatalf("json %v:\n%s", err, output)
+	}
+	if output = captureOutput(t, func() { printListing(nil, true) }); strings.TrimSpace(output) != "[]" {
+		t.Fatalf("empty json %q", output)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestIsJsonListing(t *testing.T) {
+	var tests = []struct {
+		args []string
+		json bool
+	}{
+		{[]string{"ls", "/data", "--json"}, true},
+		{[]string{"browse", "/data", "20240510", "--json"}, true},
+		{[]string{"ls", "/data"}, false},
+		{[]string{"ls", "--json"}, false},
+		{[]string{"restore", "/data", "--json"}, false},
+		{[]string{"ls", "/data", "--json", "--bad"}, false},
+		{[]string{}, false},
+	}
+	for _, test := range tests {
+		if json := isJsonListing(test.args); json != test.json {
+			t.Errorf("%v: %v", test.args, json)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"./libs/ext-logger"
+)
+
+// log of the run goes to stdout and the log file of the config,
+// the file is replaced when the daemon reloads the config
+type RunLogger struct {
+	lock   sync.Mutex
+	logger *ext_logger.ExtLogger
+	stderr bool	// stdout is for data, e.g. of ls --json
+}
+
+//------------------------------------------------------------------------------
+// log goes only to stderr from now on
+func (this *RunLogger) setStderr() {
+	this.lock.Lock()
+	this.stderr = true
+	this.lock.Unlock()
+}
+
+//------------------------------------------------------------------------------
+func (this *RunLogger) setFile(fileName string) error {
+	if len(fileName) > 0 {
+		// ext logger exits if it cannot open the file
+		file, err := os.OpenFile(fileName, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+		file.Close()
+	}
+	var logger = new(ext_logger.ExtLogger)
+	logger.SetFile(fileName)
+
+	this.lock.Lock()
+	var previous = this.logger
+	this.logger = logger
+	this.lock.Unlock()
+	if previous != nil {
+		previous.Close()
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// io.Writer for log package
+func (this *RunLogger) Write(p []byte) (int, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.stderr {
+		return os.Stderr.Write(p)
+	}
+	if this.logger == nil {
+		return os.Stdout.Write(p)
+	}
+	this.logger.Write(p)
+	return len(p), nil
+}
+
+//------------------------------------------------------------------------------
+func (this *RunLogger) Close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.logger != nil {
+		this.logger.Close()
+		this.logger = nil
+	}
+}
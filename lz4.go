@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+// LZ4 frame format, the one lz4 command line tool reads and writes:
+// independent 4 MB blocks with content checksum
+
+const (
+	lz4Magic    = 0x184D2204
+	lz4BlockMax = 4 << 20
+	lz4HashLog  = 16
+	lz4Window   = 65535
+	// the last match starts that far from the end of block,
+	// the last literals are at least that long
+	lz4MatchLimit   = 12
+	lz4LastLiterals = 5
+)
+
+const (
+	xxhPrime1 uint32 = 2654435761
+	xxhPrime2 uint32 = 2246822519
+	xxhPrime3 uint32 = 3266489917
+	xxhPrime4 uint32 = 668265263
+	xxhPrime5 uint32 = 374761393
+)
+
+var errLz4Corrupted = errors.New("corrupted lz4 data")
+
+// xxHash32 with zero seed, the checksum of LZ4 frames
+type xxh32 struct {
+	v      [4]uint32
+	total  uint64
+	mem    [16]byte
+	memLen int
+}
+
+func newXxh32() *xxh32 {
+	// prime1 + prime2 and -prime1 modulo 2^32
+	return &xxh32{v: [4]uint32{606290984, xxhPrime2, 0, 1640531535}}
+}
+
+func xxhRound(acc uint32, input uint32) uint32 {
+	return bits.RotateLeft32(acc + input * xxhPrime2, 13) * xxhPrime1
+}
+
+func (this *xxh32) stripe(p []byte) {
+	for index := range this.v {
+		this.v[index] = xxhRound(this.v[index], binary.LittleEndian.Uint32(p[index * 4:]))
+	}
+}
+
+func (this *xxh32) Write(p []byte) (int, error) {
+	var n = len(p)
+	this.total += uint64(n)
+	if this.memLen > 0 {
+		var copied = copy(this.mem[this.memLen:], p)
+		this.memLen += copied
+		p = p[copied:]
+		if this.memLen < 16 {
+			return n, nil
+		}
+		this.stripe(this.mem[:])
+		this.memLen = 0
+	}
+	for len(p) >= 16 {
+		this.stripe(p)
+		p = p[16:]
+	}
+	this.memLen = copy(this.mem[:], p)
+	return n, nil
+}
+
+func (this *xxh32) Sum32() uint32 {
+	var hash uint32
+	if this.total >= 16 {
+		hash = bits.RotateLeft32(this.v[0], 1) + bits.RotateLeft32(this.v[1], 7) +
+			bits.RotateLeft32(this.v[2], 12) + bits.RotateLeft32(this.v[3], 18)
+	} else {
+		hash = xxhPrime5
+	}
+	hash += uint32(this.total)
+	var rest = this.mem[:this.memLen]
+	for ; len(rest) >= 4; rest = rest[4:] {
+		hash = bits.RotateLeft32(hash + binary.LittleEndian.Uint32(rest) * xxhPrime3, 17) * xxhPrime4
+	}
+	for _, b := range rest {
+		hash = bits.RotateLeft32(hash + uint32(b) * xxhPrime5, 11) * xxhPrime1
+	}
+	hash ^= hash >> 15
+	hash *= xxhPrime2
+	hash ^= hash >> 13
+	hash *= xxhPrime3
+	hash ^= hash >> 16
+	return hash
+}
+
+//------------------------------------------------------------------------------
+func lz4Length(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+//------------------------------------------------------------------------------
+// literals followed by a match, the last sequence has literals only
+func lz4Sequence(dst []byte, literals []byte, offset int, matchLen int) []byte {
+	var token byte = 15 << 4
+	if len(literals) < 15 {
+		token = byte(len(literals)) << 4
+	}
+	if matchLen > 0 {
+		if matchLen - 4 < 15 {
+			token |= byte(matchLen - 4)
+		} else {
+			token |= 15
+		}
+	}
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4Length(dst, len(literals) - 15)
+	}
+	dst = append(dst, literals...)
+	if matchLen == 0 {
+		return dst
+	}
+	dst = append(dst, byte(offset), byte(offset >> 8))
+	if matchLen - 4 >= 15 {
+		dst = lz4Length(dst, matchLen - 4 - 15)
+	}
+	return dst
+}
+
+//------------------------------------------------------------------------------
+// greedy compression with a hash table of 4 byte sequences,
+// nil if the block does not get smaller
+func lz4CompressBlock(src []byte) []byte {
+	var table = make([]int32, 1 << lz4HashLog)
+	var dst = make([]byte, 0, len(src))
+	var anchor, index int
+	for index < len(src) - lz4MatchLimit {
+		var sequence = binary.LittleEndian.Uint32(src[index:])
+		var hash = (sequence * xxhPrime1) >> (32 - lz4HashLog)
+		// positions are stored plus one, zero is empty
+		var ref = int(table[hash]) - 1
+		table[hash] = int32(index + 1)
+		if ref < 0 || index - ref > lz4Window || binary.LittleEndian.Uint32(src[ref:]) != sequence {
+			index++
+			continue
+		}
+		var length = 4
+		for index + length < len(src) - lz4LastLiterals && src[ref + length] == src[index + length] {
+			length++
+		}
+		dst = lz4Sequence(dst, src[anchor:index], index - ref, length)
+		index += length
+		anchor = index
+		if len(dst) >= len(src) {
+			return nil
+		}
+	}
+	dst = lz4Sequence(dst, src[anchor:], 0, 0)
+	if len(dst) >= len(src) {
+		return nil
+	}
+	return dst
+}
+
+//------------------------------------------------------------------------------
+// appends decoded block to dst, matches may refer to dst content
+// (previous blocks of linked frame)
+func lz4DecompressBlock(dst []byte, src []byte) ([]byte, error) {
+	var readLength = func(index int, n int) (int, int, error) {
+		for {
+			if index >= len(src) {
+				return 0, 0, errLz4Corrupted
+			}
+			var b = src[index]
+			index++
+			n += int(b)
+			if b != 255 {
+				return index, n, nil
+			}
+		}
+	}
+	var start = len(dst)
+	var index int
+	var err error
+	for index < len(src) {
+		var token = src[index]
+		index++
+		var literals = int(token >> 4)
+		if literals == 15 {
+			if index, literals, err = readLength(index, literals); err != nil {
+				return nil, err
+			}
+		}
+		if literals > len(src) - index {
+			return nil, errLz4Corrupted
+		}
+		dst = append(dst, src[index:index + literals]...)
+		index += literals
+		if index == len(src) {
+			break
+		}
+		if index + 2 > len(src) {
+			return nil, errLz4Corrupted
+		}
+		var offset = int(src[index]) | int(src[index + 1]) << 8
+		index += 2
+		var length = int(token & 15)
+		if length == 15 {
+			if index, length, err = readLength(index, length); err != nil {
+				return nil, err
+			}
+		}
+		length += 4
+		if offset == 0 || offset > len(dst) || len(dst) - start + length > lz4BlockMax {
+			return nil, errLz4Corrupted
+		}
+		var position = len(dst) - offset
+		if offset >= length {
+			dst = append(dst, dst[position:position + length]...)
+			continue
+		}
+		// overlapping match repeats the last bytes
+		for counter := 0; counter < length; counter++ {
+			dst = append(dst, dst[position + counter])
+		}
+	}
+	return dst, nil
+}
+
+// frame writer
+type Lz4Writer struct {
+	output  io.Writer
+	buffer  []byte
+	hash    *xxh32
+	started bool
+}
+
+func newLz4Writer(output io.Writer) *Lz4Writer {
+	return &Lz4Writer{output: output, hash: newXxh32()}
+}
+
+func (this *Lz4Writer) writeHeader() error {
+	this.started = true
+	// version 1, independent blocks, content checksum; 4 MB blocks
+	var descriptor = []byte{0x64, 0x70}
+	var hash = newXxh32()
+	hash.Write(descriptor)
+	var header = make([]byte, 4, 7)
+	binary.LittleEndian.PutUint32(header, lz4Magic)
+	header = append(header, descriptor...)
+	header = append(header, byte(hash.Sum32() >> 8))
+	_, err := this.output.Write(header)
+	return err
+}
+
+func (this *Lz4Writer) writeBlock() error {
+	if !this.started {
+		if err := this.writeHeader(); err != nil {
+			return err
+		}
+	}
+	var data = lz4CompressBlock(this.buffer)
+	var size = uint32(len(data))
+	if data == nil {
+		// stored as is
+		data = this.buffer
+		size = uint32(len(data)) | 1 << 31
+	}
+	var prefix [4]byte
+	binary.LittleEndian.PutUint32(prefix[:], size)
+	if _, err := this.output.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := this.output.Write(data)
+	this.buffer = this.buffer[:0]
+	return err
+}
+
+func (this *Lz4Writer) Write(p []byte) (int, error) {
+	var n = len(p)
+	this.hash.Write(p)
+	for len(p) > 0 {
+		var free = lz4BlockMax - len(this.buffer)
+		if free > len(p) {
+			free = len(p)
+		}
+		this.buffer = append(this.buffer, p[:free]...)
+		p = p[free:]
+		if len(this.buffer) == lz4BlockMax {
+			if err := this.writeBlock(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (this *Lz4Writer) Close() error {
+	var err error
+	if len(this.buffer) > 0 {
+		err = this.writeBlock()
+	} else if !this.started {
+		err = this.writeHeader()
+	}
+	if err != nil {
+		return err
+	}
+	var end [8]byte
+	binary.LittleEndian.PutUint32(end[4:], this.hash.Sum32())
+	_, err = this.output.Write(end[:])
+	return err
+}
+
+// frame reader, linked blocks and block checksums are understood too
+type Lz4Reader struct {
+	input    io.Reader
+	linked   bool
+	checksum bool
+	content  bool
+	history  []byte
+	data     []byte
+	hash     *xxh32
+	done     bool
+}
+
+func newLz4Reader(input io.Reader) (*Lz4Reader, error) {
+	var header [6]byte
+	if _, err := io.ReadFull(input, header[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[:]) != lz4Magic {
+		return nil, errors.New("not lz4 frame")
+	}
+	var flags, blockDescriptor = header[4], header[5]
+	if flags >> 6 != 1 || flags & 1 != 0 {
+		return nil, errors.New("unsupported lz4 frame")
+	}
+	var descriptor = []byte{flags, blockDescriptor}
+	if flags & 0x08 != 0 {
+		// content size is not needed
+		var size [8]byte
+		if _, err := io.ReadFull(input, size[:]); err != nil {
+			return nil, err
+		}
+		descriptor = append(descriptor, size[:]...)
+	}
+	var check [1]byte
+	if _, err := io.ReadFull(input, check[:]); err != nil {
+		return nil, err
+	}
+	var hash = newXxh32()
+	hash.Write(descriptor)
+	if byte(hash.Sum32() >> 8) != check[0] {
+		return nil, errLz4Corrupted
+	}
+	return &Lz4Reader{
+		input:    input,
+		linked:   flags & 0x20 == 0,
+		checksum: flags & 0x10 != 0,
+		content:  flags & 0x04 != 0,
+		hash:     newXxh32(),
+	}, nil
+}
+
+func (this *Lz4Reader) readBlock() error {
+	var prefix [4]byte
+	if _, err := io.ReadFull(this.input, prefix[:]); err != nil {
+		return err
+	}
+	var size = binary.LittleEndian.Uint32(prefix[:])
+	if size == 0 {
+		this.done = true
+		if this.content {
+			// the frame is cut if the checksum is missing
+			if _, err := io.ReadFull(this.input, prefix[:]); err != nil {
+				if err == io.EOF {
+					err = errLz4Corrupted
+				}
+				return err
+			}
+			if binary.LittleEndian.Uint32(prefix[:]) != this.hash.Sum32() {
+				return errors.New("lz4 checksum mismatch")
+			}
+		}
+		return io.EOF
+	}
+	var stored = size & (1 << 31) != 0
+	size &^= 1 << 31
+	if size > lz4BlockMax {
+		return errLz4Corrupted
+	}
+	var block = make([]byte, size)
+	if _, err := io.ReadFull(this.input, block); err != nil {
+		return err
+	}
+	if this.checksum {
+		if _, err := io.ReadFull(this.input, prefix[:]); err != nil {
+			return err
+		}
+		// checksum of the block as stored
+		var hash = newXxh32()
+		hash.Write(block)
+		if binary.LittleEndian.Uint32(prefix[:]) != hash.Sum32() {
+			return errLz4Corrupted
+		}
+	}
+	if stored {
+		this.data = block
+	} else {
+		// linked blocks refer to the last 64 KB of the previous ones
+		decoded, err := lz4DecompressBlock(this.history, block)
+		if err != nil {
+			return err
+		}
+		this.data = decoded[len(this.history):]
+	}
+	if this.linked {
+		this.history = append(this.history, this.data...)
+		if len(this.history) > lz4Window {
+			this.history = append([]byte{}, this.history[len(this.history) - lz4Window:]...)
+		}
+	}
+	this.hash.Write(this.data)
+	return nil
+}
+
+func (this *Lz4Reader) Read(p []byte) (int, error) {
+	for len(this.data) == 0 {
+		if this.done {
+			return 0, io.EOF
+		}
+		if err := this.readBlock(); err != nil {
+			if err == io.ErrUnexpectedEOF || (err == io.EOF && !this.done) {
+				err = errLz4Corrupted
+			}
+			return 0, err
+		}
+	}
+	var n = copy(p, this.data)
+	this.data = this.data[n:]
+	return n, nil
+}
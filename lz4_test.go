@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+//------------------------------------------------------------------------------
+// the generator of the inputs of testdata/lz4-*.lz4
+func lz4Random(n int) []byte {
+	var x uint32 = 1
+	var data = make([]byte, n)
+	for index := range data {
+		x = (x * 1103515245 + 12345) & 0x7fffffff
+		data[index] = byte(x >> 16)
+	}
+	return data
+}
+
+//------------------------------------------------------------------------------
+// random pattern repeated with shifts and counters, runs of zeros:
+// long literals, long and overlapping matches
+func lz4Sample(n int) []byte {
+	var pattern = lz4Random(512)
+	var data []byte
+	for index := 0; len(data) < n; index++ {
+		var shift = index * 53 % 112
+		data = append(data, pattern[shift:shift + 400]...)
+		data = append(data, fmt.Sprintf("%d\n", index)...)
+		if index % 50 == 0 {
+			data = append(data, make([]byte, 300)...)
+		}
+	}
+	return data[:n]
+}
+
+//------------------------------------------------------------------------------
+func lz4Decode(frame []byte) ([]byte, error) {
+	reader, err := newLz4Reader(bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+//------------------------------------------------------------------------------
+func lz4Encode(t *testing.T, data []byte, chunk int) []byte {
+	var output bytes.Buffer
+	var writer = newLz4Writer(&output)
+	for len(data) > 0 {
+		var n = chunk
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := writer.Write(data[:n]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[n:]
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return output.Bytes()
+}
+
+//------------------------------------------------------------------------------
+func TestXxh32(t *testing.T) {
+	var tests = []struct {
+		input string
+		hash  uint32
+	}{
+		{"", 0x02cc5d05},
+		{"a", 0x550d7456},
+		{"abc", 0x32d153ff},
+		{"Nobody inspects the spammish repetition", 0xe2293b2f},
+	}
+	for _, test := range tests {
+		var hash = newXxh32()
+		hash.Write([]byte(test.input))
+		if hash.Sum32() != test.hash {
+			t.Errorf("%q: %08x, expected %08x", test.input, hash.Sum32(), test.hash)
+		}
+	}
+	// the sum does not depend on how the input is split
+	var data = lz4Random(1000)
+	var whole = newXxh32()
+	whole.Write(data)
+	for _, chunk := range []int{1, 3, 15, 16, 17, 999} {
+		var hash = newXxh32()
+		for rest := data; len(rest) > 0; {
+			var n = chunk
+			if n > len(rest) {
+				n = len(rest)
+			}
+			hash.Write(rest[:n])
+			rest = rest[n:]
+		}
+		if hash.Sum32() != whole.Sum32() {
+			t.Errorf("chunks of %d: %08x, expected %08x", chunk, hash.Sum32(), whole.Sum32())
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// frames written by lz4 1.9.4 command line tool:
+// lz4 -c, lz4 -B4 -BD --content-size -BX -c, lz4 -9 -B4 -BX -c,
+// lz4 --no-frame-crc -c and lz4 -c of empty file
+func TestLz4Reference(t *testing.T) {
+	var tests = []struct {
+		file  string
+		input []byte
+	}{
+		{"lz4-default.lz4", lz4Sample(70000)},
+		{"lz4-linked.lz4", lz4Sample(70000)},
+		{"lz4-hc.lz4", lz4Sample(70000)},
+		{"lz4-stored.lz4", lz4Random(300)},
+		{"lz4-empty.lz4", nil},
+	}
+	for _, test := range tests {
+		frame, err := ioutil.ReadFile(filepath.Join("testdata", test.file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := lz4Decode(frame)
+		if err != nil {
+			t.Errorf("%s: %v", test.file, err)
+		} else if !bytes.Equal(data, test.input) {
+			t.Errorf("%s: %d bytes decoded, expected %d", test.file, len(data), len(test.input))
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// block and content checksums, headers and truncation
+func TestLz4Corrupted(t *testing.T) {
+	linked, err := ioutil.ReadFile(filepath.Join("testdata", "lz4-linked.lz4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadFile(filepath.Join("testdata", "lz4-default.lz4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var change = func(frame []byte, index int) []byte {
+		var changed = append([]byte{}, frame...)
+		if index < 0 {
+			index += len(changed)
+		}
+		changed[index] ^= 0x40
+		return changed
+	}
+	var tests = []struct {
+		name  string
+		frame []byte
+	}{
+		{"magic", change(plain, 0)},
+		{"descriptor", change(linked, 5)},
+		{"header checksum", change(linked, 14)},
+		{"block with checksum", change(linked, 100)},
+		{"block checksum", change(linked, 15 + 4 + 2282)},
+		{"content checksum", change(linked, -1)},
+		{"block", change(plain, 200)},
+		{"content checksum only", change(plain, -2)},
+		{"truncated header", plain[:6]},
+		{"truncated block", plain[:len(plain) / 2]},
+		{"no end mark", plain[:len(plain) - 8]},
+		{"no content checksum", plain[:len(plain) - 4]},
+	}
+	for _, test := range tests {
+		if data, err := lz4Decode(test.frame); err == nil {
+			t.Errorf("%s: %d bytes decoded", test.name, len(data))
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestLz4RoundTrip(t *testing.T) {
+	var tests = []struct {
+		name  string
+		data  []byte
+		chunk int
+	}{
+		{"empty", nil, 1},
+		{"one byte", []byte{'a'}, 1},
+		{"shorter than match limit", lz4Sample(12), 1},
+		{"match limit", lz4Sample(13), 5},
+		{"zeros", make([]byte, 100000), 4096},
+		{"sample", lz4Sample(70000), 7777},
+		{"random", lz4Random(100000), 65536},
+		{"two blocks", lz4Sample(lz4BlockMax + 1), 1 << 20},
+		{"random after sample", append(lz4Sample(lz4BlockMax), lz4Random(1000)...), lz4BlockMax},
+	}
+	for _, test := range tests {
+		var frame = lz4Encode(t, test.data, test.chunk)
+		data, err := lz4Decode(frame)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(data, test.data) {
+			t.Errorf("%s: %d bytes decoded, expected %d", test.name, len(data), len(test.data))
+		}
+		// random data is stored: header, block size, end mark and checksum
+		if len(frame) > len(test.data) + 19 * (len(test.data) / lz4BlockMax + 1) {
+			t.Errorf("%s: %d bytes in frame of %d", test.name, len(frame), len(test.data))
+		}
+	}
+	if frame := lz4Encode(t, make([]byte, 100000), 4096); len(frame) > 1000 {
+		t.Errorf("zeros are not compressed: %d bytes", len(frame))
+	}
+}
+
+//------------------------------------------------------------------------------
+// frames are read by the command line tool
+func TestLz4CommandLine(t *testing.T) {
+	if _, err := exec.LookPath("lz4"); err != nil {
+		t.Skip("lz4 is not installed")
+	}
+	for _, data := range [][]byte{nil, lz4Sample(70000), lz4Random(1000)} {
+		var cmd = exec.Command("lz4", "-d", "-c")
+		cmd.Stdin = bytes.NewReader(lz4Encode(t, data, 4096))
+		output, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("lz4 -d: %v", err)
+		}
+		if !bytes.Equal(output, data) {
+			t.Errorf("lz4 -d: %d bytes, expected %d", len(output), len(data))
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestLz4DecompressBlock(t *testing.T) {
+	var tests = []struct {
+		name   string
+		block  []byte
+		result string
+	}{
+		{"literals", []byte{0x30, 'a', 'b', 'c'}, "abc"},
+		{"overlapping match", []byte{0x22, 'a', 'b', 2, 0, 0x10, 'c'}, "ababababc"},
+		{"long literals", append([]byte{0xf0, 1}, bytes.Repeat([]byte{'x'}, 16)...),
+			"xxxxxxxxxxxxxxxx"},
+		{"long match", []byte{0x1f, 'z', 1, 0, 2, 0x10, '.'}, "zzzzzzzzzzzzzzzzzzzzzz."},
+		{"zero offset", []byte{0x10, 'a', 0, 0, 0x10, 'b'}, ""},
+		{"offset before start", []byte{0x10, 'a', 2, 0, 0x10, 'b'}, ""},
+		{"literals past end", []byte{0x50, 'a', 'b'}, ""},
+		{"cut offset", []byte{0x10, 'a', 1}, ""},
+		{"cut length", []byte{0xf0, 255}, ""},
+	}
+	for _, test := range tests {
+		data, err := lz4DecompressBlock(nil, test.block)
+		if len(test.result) == 0 {
+			if err != errLz4Corrupted {
+				t.Errorf("%s: %q %v", test.name, data, err)
+			}
+		} else if err != nil || string(data) != test.result {
+			t.Errorf("%s: %q %v, expected %q", test.name, data, err, test.result)
+		}
+	}
+}
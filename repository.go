@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"./libs/github.com/cloudfoundry/bytefmt"
+	"./libs/golang.org/x/crypto/hkdf"
+)
+
+// repository mode: tar stream of a path is split into chunks by content,
+// every chunk is stored once under its hash in chunkDir and a backup is
+// a small snapshot listing the chunks, so the same data is uploaded once
+// for all paths, versions and hosts sharing the cloud directory
+const (
+	chunkDir       = "chunks/"
+	snapshotDir    = "snapshots/"
+	snapshotHeader = "cloud-backup snapshot 1"
+)
+
+// chunk sizes, cut points are found between min and max
+const (
+	chunkMin = 512 << 10
+	chunkAvg = 1 << 20
+	chunkMax = 8 << 20
+)
+
+// FastCDC normalized chunking: cut is harder to find before the average size
+// and easier after it, so chunk sizes stay close to the average
+const (
+	chunkMaskSmall = uint64(1 << 22 - 1) << (64 - 22)
+	chunkMaskLarge = uint64(1 << 18 - 1) << (64 - 18)
+)
+
+// stored chunk starts with the flag unless it is encrypted
+const (
+	chunkRaw = 'r'
+	chunkXz  = 'x'
+	// any compression, found by magic bytes
+	chunkCompressed = 'c'
+)
+
+// unreferenced chunks younger than that are kept,
+// they may belong to a backup still running
+const chunkGracePeriod = 24 * time.Hour
+
+// salt of the scrypt key chunk keys are expanded from, it is the same
+// on every host, so hosts with the same password share the chunks
+const chunkKeySalt = "chunk keys"
+
+// random values for gear hash without password, the same on every host
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	// splitmix64
+	var state uint64 = 0x636c6f75642d6263
+	for index := range table {
+		state += 0x9e3779b97f4a7c15
+		var z = state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[index] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// keys of chunk ids and cut points, empty id key means plain sha256
+type ChunkKeys struct {
+	id   []byte
+	gear *[256]uint64
+}
+
+// chunks in the cloud: stored size by id
+type Repository struct {
+	chunks map[string]int64
+}
+
+// repositories listed by this process, by cloud and directory
+var repositories = make(map[string]*Repository)
+
+type SnapshotChunk struct {
+	id   string
+	size int64
+}
+
+// backup of a path in repository
+type Snapshot struct {
+	path   string
+	// md5 of the tar stream without mtimes, to detect changes
+	hash   string
+	// md5 of the tar stream as stored, empty for old snapshots
+	// stored without mtimes
+	stream string
+	chunks []SnapshotChunk
+}
+
+//------------------------------------------------------------------------------
+// size of the next chunk at the start of data
+func chunkBoundary(data []byte, gear *[256]uint64) int {
+	if len(data) <= chunkMin {
+		return len(data)
+	}
+	var limit = len(data)
+	if limit > chunkMax {
+		limit = chunkMax
+	}
+	var normal = chunkAvg
+	if normal > limit {
+		normal = limit
+	}
+	var hash uint64
+	var index = chunkMin
+	for ; index < normal; index++ {
+		hash = (hash << 1) + gear[data[index]]
+		if hash & chunkMaskSmall == 0 {
+			return index + 1
+		}
+	}
+	for ; index < limit; index++ {
+		hash = (hash << 1) + gear[data[index]]
+		if hash & chunkMaskLarge == 0 {
+			return index + 1
+		}
+	}
+	return limit
+}
+
+// splits written stream into chunks, emit must not keep the data
+type Chunker struct {
+	buffer []byte
+	gear   *[256]uint64
+	emit   func(data []byte) error
+}
+
+func (this *Chunker) Write(p []byte) (int, error) {
+	this.buffer = append(this.buffer, p...)
+	// a cut is known only when there is enough data for the largest chunk
+	for len(this.buffer) >= chunkMax {
+		var size = chunkBoundary(this.buffer, this.gear)
+		if err := this.emit(this.buffer[:size]); err != nil {
+			return 0, err
+		}
+		this.buffer = this.buffer[size:]
+	}
+	return len(p), nil
+}
+
+func (this *Chunker) Close() error {
+	for len(this.buffer) > 0 {
+		var size = chunkBoundary(this.buffer, this.gear)
+		if err := this.emit(this.buffer[:size]); err != nil {
+			return err
+		}
+		this.buffer = this.buffer[size:]
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// keys of the id hash and of the gear table are expanded from the scrypt key
+// of the password, so names and sizes of chunks can be matched with a known
+// file only by those who know the password; without password the id is plain
+// sha256 and cut points are fixed
+func chunkKeys(password string) (ChunkKeys, error) {
+	if len(password) == 0 {
+		return ChunkKeys{gear: &gearTable}, nil
+	}
+	key, err := deriveKey(password, []byte(chunkKeySalt), repositoryWorkFactor)
+	if err != nil {
+		return ChunkKeys{}, err
+	}
+	var keys = ChunkKeys{id: make([]byte, sha256.Size), gear: new([256]uint64)}
+	if _, err = io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("chunk id")), keys.id); err != nil {
+		return ChunkKeys{}, err
+	}
+	var table = make([]byte, 8 * len(keys.gear))
+	if _, err = io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("gear table")), table); err != nil {
+		return ChunkKeys{}, err
+	}
+	for index := range keys.gear {
+		keys.gear[index] = binary.LittleEndian.Uint64(table[8 * index:])
+	}
+	return keys, nil
+}
+
+//------------------------------------------------------------------------------
+// keyed hash of the content, the same data has the same id in every path,
+// version and host using the password; without it anyone who can list
+// the repository can confirm it holds a file they have
+func chunkId(data []byte, keys ChunkKeys) string {
+	if len(keys.id) == 0 {
+		var sum = sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	var mac = hmac.New(sha256.New, keys.id)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//------------------------------------------------------------------------------
+// repository is encrypted with the global settings, not with the ones of path
+func isRepositoryEncrypted(options Options) bool {
+	return len(options.password) > 0 || len(options.recipients) > 0
+}
+
+//------------------------------------------------------------------------------
+func encryptData(data []byte, options Options) ([]byte, error) {
+	var output bytes.Buffer
+	recipients, err := encryptionRecipients(options.recipients, options, true)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := encryptWriter(&output, recipients, options.password)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return output.Bytes(), nil
+}
+
+//------------------------------------------------------------------------------
+func decryptData(data []byte, options Options) ([]byte, error) {
+	reader, err := decryptReader(bytes.NewReader(data), options)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+//------------------------------------------------------------------------------
+// flag and data, compressed if it gets smaller, encrypted if there is
+// a password or recipients: encryption is the same for the whole repository
+func encodeChunk(data []byte, compression Compression, options Options) ([]byte, error) {
+	var body = append([]byte{chunkRaw}, data...)
+	if compression.algorithm != compressionNone {
+		compressed, err := compressData(data, compression)
+		if err != nil {
+			return nil, stageFailure(stageCompression, err)
+		}
+		if len(compressed) + 1 < len(body) {
+			body = append([]byte{chunkCompressed}, compressed...)
+		}
+	}
+	if !isRepositoryEncrypted(options) {
+		return body, nil
+	}
+	encrypted, err := encryptData(body, options)
+	return encrypted, stageFailure(stageEncryption, err)
+}
+
+//------------------------------------------------------------------------------
+// reverse of encodeChunk, content is checked against chunk id
+func decodeChunk(payload []byte, id string, options Options) ([]byte, error) {
+	payload, err := openData(payload, options)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) == 0 {
+		return nil, stageFailure(stageInput, errors.New("empty chunk " + id))
+	}
+	var data []byte
+	switch payload[0] {
+	case chunkRaw:
+		data = payload[1:]
+	case chunkXz, chunkCompressed:
+		if data, err = decompressData(payload[1:]); err != nil {
+			return nil, stageFailure(stageCompression, err)
+		}
+	default:
+		return nil, stageFailure(stageInput, errors.New("unknown format of chunk " + id))
+	}
+	keys, err := chunkKeys(options.password)
+	if err != nil {
+		return nil, err
+	}
+	if chunkId(data, keys) != id {
+		return nil, stageFailure(stageInput, errors.New("corrupted chunk " + id))
+	}
+	return data, nil
+}
+
+//------------------------------------------------------------------------------
+// chunks are listed once per run, clouds that cannot list
+// cannot hold repository
+func openRepository(ctx context.Context, item PathItem, options Options) (*Repository, error) {
+	var key = item.cloud.name() + " " + item.cloudPath
+	if repository, ok := repositories[key]; ok {
+		return repository, nil
+	}
+	chunks, err := listChunks(ctx, item)
+	if err != nil {
+		return nil, err
+	}
+	var repository = Repository{chunks: chunks}
+	repositories[key] = &repository
+	return &repository, nil
+}
+
+//------------------------------------------------------------------------------
+// stored size by id of the chunks in the cloud
+func listChunks(ctx context.Context, item PathItem) (map[string]int64, error) {
+	var chunks = make(map[string]int64)
+	files, err := item.cloud.list(ctx, item.cloudPath + chunkDir)
+	switch {
+	case errors.Is(err, errUnsupported):
+		return nil, fmt.Errorf("%s cannot list files, repository is not supported: %w",
+			item.cloud.name(), err)
+	case errors.Is(err, errNotFound):
+	case err != nil:
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.dir && !strings.HasSuffix(file.name, ".part") {
+			chunks[file.name] = file.size
+		}
+	}
+	return chunks, nil
+}
+
+//------------------------------------------------------------------------------
+// chunks are listed again before the snapshot refers to them: the ones
+// reused from the earlier listing may be collected by another host since;
+// the number of the snapshot chunks which are gone
+func refreshRepository(ctx context.Context, item PathItem, repository *Repository,
+	snapshot Snapshot) (int, error) {
+	chunks, err := listChunks(ctx, item)
+	if err != nil {
+		return 0, err
+	}
+	repository.chunks = chunks
+	var missing = make(map[string]bool)
+	for _, chunk := range snapshot.chunks {
+		if _, ok := chunks[chunk.id]; !ok {
+			missing[chunk.id] = true
+		}
+	}
+	return len(missing), nil
+}
+
+//------------------------------------------------------------------------------
+// uploaded under temporary name as archives are
+func putCommitted(ctx context.Context, cloud Cloud, remotePath string, data []byte) error {
+	var temp = partName(remotePath)
+	if err := cloud.put(ctx, temp, bytes.NewReader(data), int64(len(data))); err != nil {
+		return err
+	}
+	return commitFile(ctx, cloud, temp, remotePath, int64(len(data)))
+}
+
+//------------------------------------------------------------------------------
+// path,hash and chunk lines after the header
+func (this *Snapshot) encode(options Options) ([]byte, error) {
+	var output bytes.Buffer
+	fmt.Fprintln(&output, snapshotHeader)
+	fmt.Fprintf(&output, "path %s\n", this.path)
+	fmt.Fprintf(&output, "hash %s\n", this.hash)
+	fmt.Fprintf(&output, "stream %s\n", this.stream)
+	for _, chunk := range this.chunks {
+		fmt.Fprintf(&output, "chunk %s %d\n", chunk.id, chunk.size)
+	}
+	if !isRepositoryEncrypted(options) {
+		return output.Bytes(), nil
+	}
+	return encryptData(output.Bytes(), options)
+}
+
+//------------------------------------------------------------------------------
+func loadSnapshot(ctx context.Context, cloud Cloud, remotePath string,
+	options Options) (Snapshot, error) {
+	var snapshot Snapshot
+	reader, err := cloud.get(ctx, remotePath)
+	if err != nil {
+		return snapshot, err
+	}
+	data, err := ioutil.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		return snapshot, err
+	}
+	if data, err = openData(data, options); err != nil {
+		return snapshot, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1 << 20)
+	if !scanner.Scan() || scanner.Text() != snapshotHeader {
+		return snapshot, errors.New("bad snapshot " + remotePath)
+	}
+	for scanner.Scan() {
+		list := strings.SplitN(scanner.Text(), " ", 2)
+		if len(list) != 2 {
+			return snapshot, fmt.Errorf("bad snapshot line: %s", scanner.Text())
+		}
+		switch list[0] {
+		case "path":
+			snapshot.path = list[1]
+		case "hash":
+			snapshot.hash = list[1]
+		case "stream":
+			snapshot.stream = list[1]
+		case "chunk":
+			fields := strings.Fields(list[1])
+			if len(fields) != 2 {
+				return snapshot, fmt.Errorf("bad snapshot line: %s", scanner.Text())
+			}
+			size, _ := strconv.ParseInt(fields[1], 10, 64)
+			snapshot.chunks = append(snapshot.chunks, SnapshotChunk{fields[0], size})
+		}
+	}
+	return snapshot, scanner.Err()
+}
+
+//------------------------------------------------------------------------------
+// tar stream of the source is chunked, chunks missing in the repository
+// are uploaded; snapshot and its stored size
+func chunkSource(ctx context.Context, item *PathItem, repository *Repository,
+	options Options) (Snapshot, int64, error) {
+	var snapshot = Snapshot{path: item.path}
+	var stored, uploaded int64
+	var newChunks, reused int
+	keys, err := chunkKeys(options.password)
+	if err != nil {
+		return snapshot, 0, err
+	}
+	var chunker = Chunker{gear: keys.gear, emit: func(data []byte) error {
+		var id = chunkId(data, keys)
+		size, found := repository.chunks[id]
+		if !found {
+			payload, err := encodeChunk(data, item.compression, options)
+			if err != nil {
+				return err
+			}
+			err = retryTransient(ctx, func() error {
+				return putCommitted(ctx, item.cloud, item.cloudPath + chunkDir + id, payload)
+			})
+			if err != nil {
+				return stageFailure(stageOutput, err)
+			}
+			size = int64(len(payload))
+			repository.chunks[id] = size
+			uploaded += size
+			newChunks++
+		} else {
+			reused++
+		}
+		stored += size
+		snapshot.chunks = append(snapshot.chunks, SnapshotChunk{id, size})
+		return nil
+	}}
+
+	var hash, stream = md5.New(), md5.New()
+	err = writeTar(ctx, item, io.MultiWriter(stream, &chunker), hash)
+	if err == nil {
+		err = chunker.Close()
+	}
+	if err != nil {
+		return snapshot, 0, err
+	}
+	snapshot.hash = hex.EncodeToString(hash.Sum(nil))
+	snapshot.stream = hex.EncodeToString(stream.Sum(nil))
+	log.Printf("  chunks: %d new, %d deduplicated\n", newChunks, reused)
+	log.Printf("  uploaded: %s\n", bytefmt.ByteSize(uint64(uploaded)))
+	return snapshot, stored, nil
+}
+
+//------------------------------------------------------------------------------
+// uploads chunks missing in the cloud and the snapshot of the path,
+// false if the source has not changed
+func repositoryBackup(ctx context.Context, item *PathItem, options Options) (bool, error) {
+	repository, err := openRepository(ctx, *item, options)
+	if err != nil {
+		return false, err
+	}
+	log.Printf("chunk %s -> %s %s\n", item.path, item.cloud.name(), item.cloudPath + chunkDir)
+	log.Printf("  encryption: %v\n", isRepositoryEncrypted(options))
+
+	var snapshot Snapshot
+	var stored int64
+	// garbage collection of another host may remove the reused chunks,
+	// then the source is chunked again to upload them
+	for attempt := 1; ; attempt++ {
+		if snapshot, stored, err = chunkSource(ctx, item, repository, options); err != nil {
+			logCloudError(err)
+			return false, err
+		}
+		log.Printf("  data hash: %s\n", snapshot.hash)
+		if snapshot.hash == item.dataHash {
+			log.Printf("source not changed, skipping ")
+			return false, nil
+		}
+		missing, err := refreshRepository(ctx, *item, repository, snapshot)
+		if err != nil {
+			logCloudError(err)
+			return false, err
+		}
+		if missing == 0 {
+			break
+		}
+		if attempt > 1 {
+			return false, fmt.Errorf("%d chunks are removed from the cloud during backup", missing)
+		}
+		log.Printf("%d reused chunks are removed from the cloud, upload them again\n", missing)
+	}
+	log.Printf("previous hash (%s) is different, save snapshot\n", item.dataHash)
+
+	data, err := snapshot.encode(options)
+	if err != nil {
+		return false, stageFailure(stageEncryption, err)
+	}
+	log.Printf("upload %s\n", item.archive)
+	err = retryTransient(ctx, func() error {
+		return putCommitted(ctx, item.cloud, item.cloudPath + item.archive, data)
+	})
+	if err != nil {
+		logCloudError(err)
+		deleteArchive(ctx, *item, partName(item.archive), options)
+		return false, err
+	}
+	item.dataHash = snapshot.hash
+	item.archiveSize = stored
+	item.versions = append(item.versions, item.archive)
+	log.Printf("  size: %s\n", bytefmt.ByteSize(uint64(stored)))
+	return true, nil
+}
+
+//------------------------------------------------------------------------------
+// tar stream of snapshot item.archive is passed to process, chunks are
+// downloaded one by one
+func restoreSnapshot(ctx context.Context, item PathItem, process func(io.Reader) error,
+	options Options) error {
+	log.Printf("download %s\n", item.archive)
+	snapshot, err := loadSnapshot(ctx, item.cloud, item.cloudPath + item.archive, options)
+	if err != nil {
+		logCloudError(err)
+		log.Printf("download snapshot failed %v\n", err)
+		return err
+	}
+	log.Printf("  chunks: %d\n", len(snapshot.chunks))
+
+	reader, writer := io.Pipe()
+	go func() {
+		var err error
+		for _, chunk := range snapshot.chunks {
+			var input io.ReadCloser
+			if input, err = item.cloud.get(ctx, item.cloudPath + chunkDir + chunk.id); err != nil {
+				break
+			}
+			var payload, data []byte
+			payload, err = ioutil.ReadAll(input)
+			input.Close()
+			if err != nil {
+				break
+			}
+			if data, err = decodeChunk(payload, chunk.id, options); err != nil {
+				break
+			}
+			if _, err = writer.Write(data); err != nil {
+				break
+			}
+		}
+		writer.CloseWithError(stageFailure(stageInput, err))
+	}()
+
+	var hash = md5.New()
+	var input = io.TeeReader(reader, hash)
+	err = process(input)
+	if err == nil {
+		// padding after the end marker is a part of the hash
+		_, err = io.Copy(ioutil.Discard, input)
+	}
+	reader.CloseWithError(err)
+	var expected = snapshot.stream
+	if len(expected) == 0 {
+		expected = snapshot.hash
+	}
+	if err == nil && hex.EncodeToString(hash.Sum(nil)) != expected {
+		err = stageFailure(stageTar, errors.New("restored data does not match snapshot"))
+	}
+	if err != nil {
+		logCloudError(err)
+	}
+	return err
+}
+
+//------------------------------------------------------------------------------
+// removes chunks no snapshot in the cloud refers to, snapshots of all paths
+// and hosts are read, nothing is removed if any of them cannot be
+func collectGarbage(ctx context.Context, item PathItem, options Options) error {
+	repository, err := openRepository(ctx, item, options)
+	if err != nil {
+		return err
+	}
+	snapshots, err := item.cloud.list(ctx, item.cloudPath + snapshotDir)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	var used = make(map[string]bool)
+	for _, file := range snapshots {
+		if file.dir || !strings.HasSuffix(file.name, ".snap") {
+			continue
+		}
+		snapshot, err := loadSnapshot(ctx, item.cloud, item.cloudPath + snapshotDir + file.name, options)
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", file.name, err)
+		}
+		for _, chunk := range snapshot.chunks {
+			used[chunk.id] = true
+		}
+	}
+
+	chunks, err := item.cloud.list(ctx, item.cloudPath + chunkDir)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return err
+	}
+	var removed int
+	for _, file := range chunks {
+		var id = strings.TrimSuffix(file.name, ".part")
+		// age is unknown for some clouds, such chunks are kept
+		if file.dir || used[id] || file.modified.IsZero() ||
+			time.Since(file.modified) < chunkGracePeriod {
+			continue
+		}
+		err := item.cloud.delete(ctx, item.cloudPath + chunkDir + file.name)
+		if err != nil && !errors.Is(err, errNotFound) {
+			return err
+		}
+		if id == file.name {
+			delete(repository.chunks, id)
+			removed++
+		}
+	}
+	log.Printf("removed %d unused chunks\n", removed)
+	return nil
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// the same random data on every run
+func randomData(seed int64, size int) []byte {
+	var data = make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+//------------------------------------------------------------------------------
+// chunks of the data by the Chunker
+func splitChunks(t *testing.T, data []byte, write int, gear *[256]uint64) [][]byte {
+	var chunks [][]byte
+	var chunker = Chunker{gear: gear, emit: func(chunk []byte) error {
+		chunks = append(chunks, append([]byte{}, chunk...))
+		return nil
+	}}
+	for len(data) > 0 {
+		var size = write
+		if size > len(data) {
+			size = len(data)
+		}
+		if _, err := chunker.Write(data[:size]); err != nil {
+			t.Fatal(err)
+		}
+		data = data[size:]
+	}
+	if err := chunker.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+//------------------------------------------------------------------------------
+// cuts depend on the content only, an insert changes the chunks around it
+func TestChunker(t *testing.T) {
+	var data = randomData(1, 24 << 20)
+	var chunks = splitChunks(t, data, 100000, &gearTable)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("chunks do not make the data")
+	}
+	for index, chunk := range chunks {
+		if len(chunk) > chunkMax || len(chunk) < chunkMin && index < len(chunks) - 1 {
+			t.Fatalf("chunk %d of %d bytes", index, len(chunk))
+		}
+	}
+	if len(chunks) < 24 / 4 || len(chunks) > 24 * 2 {
+		t.Fatalf("%d chunks of 24 MiB", len(chunks))
+	}
+	if other := splitChunks(t, data, 1 << 20, &gearTable); len(other) != len(chunks) {
+		t.Fatalf("%d chunks with other writes, %d before", len(other), len(chunks))
+	}
+
+	var ids = make(map[string]bool)
+	for _, chunk := range chunks {
+		ids[chunkId(chunk, ChunkKeys{})] = true
+	}
+	var inserted = append(append(append([]byte{}, data[:5 << 20]...), "inserted"...), data[5 << 20:]...)
+	var changed int
+	for _, chunk := range splitChunks(t, inserted, 100000, &gearTable) {
+		if !ids[chunkId(chunk, ChunkKeys{})] {
+			changed++
+		}
+	}
+	if changed > 2 {
+		t.Fatalf("%d chunks changed by insert", changed)
+	}
+}
+
+//------------------------------------------------------------------------------
+func testChunkKeys(t *testing.T, password string) ChunkKeys {
+	t.Helper()
+	keys, err := chunkKeys(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+//------------------------------------------------------------------------------
+// ids and cut points depend on the password
+func TestChunkKeys(t *testing.T) {
+	var data = []byte("data")
+	var plain, a, b = testChunkKeys(t, ""), testChunkKeys(t, "a"), testChunkKeys(t, "b")
+	if chunkId(data, a) == chunkId(data, b) || chunkId(data, a) == chunkId(data, plain) {
+		t.Fatal("id does not depend on the password")
+	}
+	if chunkId(data, a) != chunkId([]byte("data"), testChunkKeys(t, "a")) {
+		t.Fatal("id is not stable")
+	}
+	var sum = sha256.Sum256(data)
+	if chunkId(data, plain) != hex.EncodeToString(sum[:]) || *plain.gear != gearTable {
+		t.Fatal("keys without password are not plain")
+	}
+
+	var random = randomData(6, 12 << 20)
+	var sizes = func(keys ChunkKeys) string {
+		var list []string
+		for _, chunk := range splitChunks(t, random, 1 << 20, keys.gear) {
+			list = append(list, strconv.Itoa(len(chunk)))
+		}
+		return strings.Join(list, " ")
+	}
+	if sizes(a) == sizes(plain) || sizes(a) == sizes(b) {
+		t.Fatal("cut points do not depend on the password")
+	}
+	if sizes(a) != sizes(testChunkKeys(t, "a")) {
+		t.Fatal("cut points are not stable")
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestEncodeChunk(t *testing.T) {
+	var tests = []struct {
+		data        []byte
+		compression Compression
+		password    string
+	}{
+		{randomData(2, 1000), noCompression, ""},
+		{randomData(2, 1000), fastCompression, ""},
+		{bytes.Repeat([]byte("a"), 1000), fastCompression, ""},
+		{bytes.Repeat([]byte("a"), 1000), Compression{compressionZstd, -1}, "secret"},
+		{bytes.Repeat([]byte("a"), 1000), Compression{compressionLz4, -1}, ""},
+		{randomData(3, 1000), noCompression, "secret"},
+	}
+	for _, test := range tests {
+		var options = Options{password: test.password}
+		var keys = testChunkKeys(t, test.password)
+		var id = chunkId(test.data, keys)
+		payload, err := encodeChunk(test.data, test.compression, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isEncrypted(payload) != (len(test.password) > 0) {
+			t.Fatalf("encrypted %v with password %q", isEncrypted(payload), test.password)
+		}
+		data, err := decodeChunk(payload, id, options)
+		if err != nil || !bytes.Equal(data, test.data) {
+			t.Fatalf("decode: %v", err)
+		}
+		// content is checked against the id
+		if _, err = decodeChunk(payload, chunkId([]byte("other"), keys), options); err == nil {
+			t.Fatal("chunk of other id is accepted")
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// backup of the path in repository at the given time
+func backupRepository(t *testing.T, item *PathItem, options Options, date time.Time) bool {
+	t.Helper()
+	item.archive = snapshotName(item.pathHash, item.hostId, date)
+	upload, err := repositoryBackup(context.Background(), item, options)
+	if err != nil {
+		t.Fatalf("backup %s: %v", item.archive, err)
+	}
+	return upload
+}
+
+//------------------------------------------------------------------------------
+func TestRepositoryRoundTrip(t *testing.T) {
+	var cloud = CloudLocal{t.TempDir()}
+	var options = Options{password: "secret"}
+	var ctx = context.Background()
+	var source = filepath.Join(t.TempDir(), "data")
+	var large = string(randomData(4, 3 << 20))
+	writeTree(t, source, map[string]string{"large.bin": large, "a.txt": "a"})
+	var item = PathItem{path: source, pathHash: getStrHash(source), repository: true,
+		compression: noCompression, cloud: cloud, cloudPath: "backup/"}
+	repositories = make(map[string]*Repository)
+
+	var now = time.Now().Truncate(time.Second)
+	if !backupRepository(t, &item, options, now.Add(-time.Hour)) {
+		t.Fatal("nothing uploaded")
+	}
+	var first = item.archive
+	var chunks = len(listRemote(t, cloud, "backup/" + chunkDir))
+	if backupRepository(t, &item, options, now.Add(-time.Minute)) {
+		t.Fatal("unchanged source is uploaded")
+	}
+
+	// the large file is deduplicated
+	writeTree(t, source, map[string]string{"a.txt": "a2"})
+	if !backupRepository(t, &item, options, now) {
+		t.Fatal("nothing uploaded")
+	}
+	if added := len(listRemote(t, cloud, "backup/" + chunkDir)) - chunks; added > 1 {
+		t.Fatalf("%d chunks added of %d", added, chunks)
+	}
+
+	var tests = []struct {
+		version string
+		a       string
+	}{
+		{first, "a"},
+		{item.archive, "a2"},
+	}
+	for _, test := range tests {
+		var dir = t.TempDir()
+		var restore = options
+		restore.workingPath = dir + "/"
+		if err := restoreArchive(ctx, item, test.version, newRestoreTarget(dir, conflictOverwrite), restore); err != nil {
+			t.Fatalf("restore %s: %v", test.version, err)
+		}
+		checkTree(t, dir, map[string]string{"data/": "", "data/a.txt": test.a, "data/large.bin": large})
+	}
+
+	// wrong password fails the restore
+	var wrong = options
+	wrong.password = "wrong"
+	wrong.workingPath = t.TempDir() + "/"
+	if err := restoreArchive(ctx, item, first, newRestoreTarget(t.TempDir(), conflictOverwrite), wrong); err == nil {
+		t.Fatal("restore with wrong password")
+	}
+}
+
+//------------------------------------------------------------------------------
+// unreferenced chunks are removed after the grace period only
+func TestCollectGarbage(t *testing.T) {
+	var cloud = CloudLocal{t.TempDir()}
+	var options = Options{}
+	var ctx = context.Background()
+	var source = filepath.Join(t.TempDir(), "data")
+	writeTree(t, source, map[string]string{"a.txt": "a"})
+	var item = PathItem{path: source, pathHash: getStrHash(source), repository: true,
+		compression: noCompression, cloud: cloud, cloudPath: "backup/"}
+	repositories = make(map[string]*Repository)
+	if !backupRepository(t, &item, options, time.Now()) {
+		t.Fatal("nothing uploaded")
+	}
+	var used = listRemote(t, cloud, "backup/" + chunkDir)
+
+	var old = time.Now().Add(-chunkGracePeriod - time.Hour)
+	var files = map[string]time.Time{
+		"old":      old,
+		"old.part": old,
+		"young":    time.Now().Add(-chunkGracePeriod + time.Hour),
+	}
+	for name, modified := range files {
+		if err := cloud.put(ctx, "backup/" + chunkDir + name, strings.NewReader(name), -1); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(cloud.dir, "backup", chunkDir, name), modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range used {
+		var fileName = filepath.Join(cloud.dir, "backup", chunkDir, name)
+		if err := os.Chtimes(fileName, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := collectGarbage(ctx, item, options); err != nil {
+		t.Fatal(err)
+	}
+	var left = listRemote(t, cloud, "backup/" + chunkDir)
+	var expected = append(append([]string{}, used...), "young")
+	if strings.Join(left, " ") != strings.Join(expected, " ") {
+		t.Fatalf("left %v, expected %v", left, expected)
+	}
+
+	// nothing is removed if a snapshot cannot be read
+	if err := cloud.put(ctx, "backup/" + snapshotDir + "bad.snap", strings.NewReader("bad"), 3); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filepath.Join(cloud.dir, "backup", chunkDir, "young"), old, old)
+	if err := collectGarbage(ctx, item, options); err == nil {
+		t.Fatal("bad snapshot is ignored")
+	}
+	if left = listRemote(t, cloud, "backup/" + chunkDir); len(left) != len(expected) {
+		t.Fatalf("left %v", left)
+	}
+}
+
+//------------------------------------------------------------------------------
+// chunks collected by another host after they were listed are uploaded again
+func TestRefreshRepository(t *testing.T) {
+	var cloud = CloudLocal{t.TempDir()}
+	var options = Options{}
+	var ctx = context.Background()
+	var sources = t.TempDir()
+	var large = string(randomData(5, 2 << 20))
+	var items []PathItem
+	for _, name := range []string{"a", "b"} {
+		var source = filepath.Join(sources, name)
+		writeTree(t, source, map[string]string{"large.bin": large})
+		items = append(items, PathItem{path: source, pathHash: getStrHash(source),
+			repository: true, compression: noCompression, cloud: cloud, cloudPath: "backup/"})
+	}
+	repositories = make(map[string]*Repository)
+	if !backupRepository(t, &items[0], options, time.Now()) {
+		t.Fatal("nothing uploaded")
+	}
+	for _, name := range listRemote(t, cloud, "backup/" + chunkDir) {
+		if err := cloud.delete(ctx, "backup/" + chunkDir + name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the listing of the repository is cached, the chunks are reused first
+	if !backupRepository(t, &items[1], options, time.Now()) {
+		t.Fatal("nothing uploaded")
+	}
+	var dir = t.TempDir()
+	options.workingPath = dir + "/"
+	if err := restoreArchive(ctx, items[1], items[1].archive, newRestoreTarget(dir, conflictOverwrite), options); err != nil {
+		t.Fatal(err)
+	}
+	checkTree(t, dir, map[string]string{"b/": "", "b/large.bin": large})
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// what restore does with an entry that already exists in the target dir,
+// directories are merged
+const (
+	conflictOverwrite = "overwrite"
+	conflictSkip      = "skip"
+	// replaced if the archive one is newer
+	conflictNewer     = "newer"
+	// archive one is saved beside as <name>.restored
+	conflictRename    = "rename"
+)
+
+// restore <path> | --all [version] [--to dir | --in-place] [--conflict policy]
+// [--include glob]... or ls <path> [version] [--include glob]... [--json]
+type RestoreRequest struct {
+	path     string
+	// all paths of config, every one under its original parent in the dir
+	all      bool
+	version  string
+	pinned   bool	// the newest version the path knows, e.g. by a catalog
+	dir      string	// working dir if empty
+	inPlace  bool	// over the source itself
+	conflict string
+	include  []string
+	json     bool	// listing format
+}
+
+// where and how archives are unpacked
+type RestoreTarget struct {
+	dir      string
+	conflict string
+	// globs relative to the source, everything if empty
+	include  []string
+	// ownership is restored, root only
+	owner    bool
+	// paths of entries unpacked by this restore by their names: archives
+	// later in the version chain replace them whatever the policy is
+	restored map[string]string
+	// attributes of directories are set when their content is in place
+	dirs     map[string]*tar.Header
+	// directories not selected by include, restored if anything inside is
+	pending  map[string]*tar.Header
+	users    map[string]int
+	groups   map[string]int
+}
+
+//------------------------------------------------------------------------------
+func newRestoreTarget(dir string, conflict string) *RestoreTarget {
+	return &RestoreTarget{
+		dir:      dir,
+		conflict: conflict,
+		owner:    os.Geteuid() == 0,
+		restored: make(map[string]string),
+		dirs:     make(map[string]*tar.Header),
+		pending:  make(map[string]*tar.Header),
+		users:    make(map[string]int),
+		groups:   make(map[string]int),
+	}
+}
+
+//------------------------------------------------------------------------------
+func checkConflict(policy string) error {
+	switch policy {
+	case conflictOverwrite, conflictSkip, conflictNewer, conflictRename:
+		return nil
+	}
+	return fmt.Errorf("unknown conflict policy %s", policy)
+}
+
+//------------------------------------------------------------------------------
+// options of restore or, if list is set, of ls
+func parseRestoreArgs(args []string, list bool) (RestoreRequest, error) {
+	var request = RestoreRequest{conflict: conflictOverwrite}
+	var positional []string
+	for index := 0; index < len(args); index++ {
+		var value = func() (string, error) {
+			if index + 1 >= len(args) {
+				return "", fmt.Errorf("%s needs a value", args[index])
+			}
+			index++
+			return args[index], nil
+		}
+		var err error
+		var option = args[index]
+		// options of restore are unknown to ls and back
+		if list && (option == "--to" || option == "--in-place" || option == "--conflict" ||
+			option == "--all") ||
+			!list && option == "--json" {
+			option = "--unknown"
+		}
+		switch option {
+		case "--json":
+			request.json = true
+		case "--to":
+			request.dir, err = value()
+		case "--in-place":
+			request.inPlace = true
+		case "--all":
+			request.all = true
+		case "--include":
+			var pattern string
+			if pattern, err = value(); err == nil {
+				request.include = append(request.include, pattern)
+			}
+		case "--conflict":
+			if request.conflict, err = value(); err == nil {
+				err = checkConflict(request.conflict)
+			}
+		default:
+			if strings.HasPrefix(args[index], "--") {
+				err = fmt.Errorf("unknown option %s", args[index])
+			}
+			positional = append(positional, args[index])
+		}
+		if err != nil {
+			return request, err
+		}
+	}
+	if len(request.dir) > 0 && request.inPlace {
+		return request, errors.New("--to and --in-place are exclusive")
+	}
+	if request.all {
+		// path is not given, version is the same for all paths: a time prefix
+		if len(positional) > 1 {
+			return request, errors.New("--all takes only optional version")
+		}
+		if len(positional) == 1 && strings.Trim(positional[0], "0123456789TZ") != "" {
+			return request, fmt.Errorf("--all restores every path, %s is not a version", positional[0])
+		}
+		positional = append([]string{""}, positional...)
+	}
+	if len(positional) == 0 || len(positional) > 2 {
+		return request, errors.New("path and optional version are expected")
+	}
+	request.path = positional[0]
+	if len(positional) > 1 {
+		request.version = positional[1]
+	}
+	return request, nil
+}
+
+//------------------------------------------------------------------------------
+// path to unpack the entry to, empty if the entry is skipped by the policy
+func (this *RestoreTarget) place(header *tar.Header) (string, error) {
+	target, err := extractPath(this.dir, header.Name)
+	if err != nil {
+		return "", err
+	}
+	if previous, ok := this.restored[header.Name]; ok {
+		// its parent may be replaced by a link since
+		if err = checkParents(this.dir, previous); err != nil {
+			return "", err
+		}
+		if fi, err := os.Lstat(previous); err == nil &&
+			!(fi.IsDir() && header.Typeflag == tar.TypeDir) {
+			return previous, os.RemoveAll(previous)
+		}
+		return previous, nil
+	}
+	if err = checkParents(this.dir, target); err != nil {
+		return "", err
+	}
+	fi, err := os.Lstat(target)
+	if os.IsNotExist(err) || (err == nil && fi.IsDir() && header.Typeflag == tar.TypeDir) {
+		return target, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	switch this.conflict {
+	case conflictSkip:
+		return "", nil
+	case conflictNewer:
+		// archives of old format have no mtimes
+		if header.ModTime.Unix() == 0 || !header.ModTime.After(fi.ModTime()) {
+			return "", nil
+		}
+	case conflictRename:
+		target += ".restored"
+		for n := 1; ; n++ {
+			if _, err := os.Lstat(target); os.IsNotExist(err) {
+				break
+			}
+			target = strings.TrimSuffix(target, "." + strconv.Itoa(n - 1)) + "." + strconv.Itoa(n)
+		}
+		return target, nil
+	}
+	// replaced, not written through: it may be a link to elsewhere
+	if fi.IsDir() {
+		return "", fmt.Errorf("%s is a directory", target)
+	}
+	return target, os.Remove(target)
+}
+
+//------------------------------------------------------------------------------
+func (this *RestoreTarget) included(name string) bool {
+	return len(this.include) == 0 || isIncluded(this.include, name)
+}
+
+//------------------------------------------------------------------------------
+// entry is selected by include patterns if it or its parent matches: pattern
+// without slash matches a name at any depth (*.conf), the other ones
+// match from the source root where ** is any number of names
+// (projects/foo/**)
+func isIncluded(patterns []string, name string) bool {
+	// the first name is the source itself
+	var parts = strings.Split(strings.Trim(name, "/"), "/")[1:]
+	for _, pattern := range patterns {
+		var patternParts = strings.Split(pattern, "/")
+		for index := range parts {
+			if len(patternParts) == 1 {
+				if ok, _ := path.Match(pattern, parts[index]); ok {
+					return true
+				}
+			} else if matchGlob(patternParts, parts[:index + 1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//------------------------------------------------------------------------------
+// include patterns relative to the source, absolute path of a file in it
+// is fine as well
+func includePatterns(list []string, item PathItem) ([]string, error) {
+	var patterns []string
+	for _, pattern := range list {
+		if strings.HasPrefix(pattern, item.path + "/") {
+			pattern = pattern[len(item.path):]
+		}
+		pattern = strings.Trim(filepath.ToSlash(pattern), "/")
+		if _, err := path.Match(pattern, ""); err != nil || len(pattern) == 0 {
+			return nil, fmt.Errorf("bad include pattern %s", pattern)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+//------------------------------------------------------------------------------
+func matchGlob(pattern []string, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for index := 0; index <= len(parts); index++ {
+			if matchGlob(pattern[1:], parts[index:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+		return false
+	}
+	return matchGlob(pattern[1:], parts[1:])
+}
+
+//------------------------------------------------------------------------------
+// directories left out by include which contain the entry, the outer first
+func (this *RestoreTarget) restoreParents(name string) error {
+	var parts = strings.Split(strings.TrimSuffix(name, "/"), "/")
+	for index := 1; index < len(parts); index++ {
+		var parent = strings.Join(parts[:index], "/") + "/"
+		if header, ok := this.pending[parent]; ok {
+			delete(this.pending, parent)
+			if err := extractEntry(nil, header, this); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+// path of the entry restored before, e.g. the target of hard link
+func (this *RestoreTarget) restoredPath(name string) (string, error) {
+	if target, ok := this.restored[name]; ok {
+		return target, nil
+	}
+	return extractPath(this.dir, name)
+}
+
+//------------------------------------------------------------------------------
+// removes entries of this restore deleted by the next archive of the chain
+func (this *RestoreTarget) remove(name string) error {
+	name = strings.TrimSuffix(name, "/")
+	for _, key := range []string{name, name + "/"} {
+		if target, ok := this.restored[key]; ok {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+	}
+	for key := range this.restored {
+		if key == name || strings.HasPrefix(key, name + "/") {
+			delete(this.restored, key)
+			delete(this.dirs, key)
+		}
+	}
+	return nil
+}
+
+//------------------------------------------------------------------------------
+func (this *RestoreTarget) lookupId(name string, numeric int, cache map[string]int,
+	lookup func(string) (string, error)) int {
+	if len(name) == 0 {
+		return numeric
+	}
+	if id, ok := cache[name]; ok {
+		return id
+	}
+	var id = numeric
+	if value, err := lookup(name); err == nil {
+		if n, err := strconv.Atoi(value); err == nil {
+			id = n
+		}
+	}
+	cache[name] = id
+	return id
+}
+
+//------------------------------------------------------------------------------
+// owner (by name if it is known here), mode and mtime of the entry
+func (this *RestoreTarget) setAttributes(target string, header *tar.Header) {
+	var symlink = header.Typeflag == tar.TypeSymlink
+	if this.owner {
+		var uid = this.lookupId(header.Uname, header.Uid, this.users,
+			func(name string) (string, error) {
+				u, err := user.Lookup(name)
+				if err != nil {
+					return "", err
+				}
+				return u.Uid, nil
+			})
+		var gid = this.lookupId(header.Gname, header.Gid, this.groups,
+			func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return g.Gid, nil
+			})
+		if err := os.Lchown(target, uid, gid); err != nil {
+			log.Printf("%s: %v\n", header.Name, err)
+		}
+	}
+	if symlink {
+		return
+	}
+	var mode = header.FileInfo().Mode()
+	var perm = mode.Perm()
+	if this.owner {
+		perm |= mode & (os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+	}
+	if err := os.Chmod(target, perm); err != nil {
+		log.Printf("%s: %v\n", header.Name, err)
+	}
+	if header.ModTime.Unix() != 0 {
+		if err := os.Chtimes(target, header.ModTime, header.ModTime); err != nil {
+			log.Printf("%s: %v\n", header.Name, err)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// attributes of the restored directories, the deepest first
+func (this *RestoreTarget) finish() {
+	var names []string
+	for name := range this.dirs {
+		names = append(names, name)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		this.setAttributes(this.restored[name], this.dirs[name])
+	}
+	this.dirs = make(map[string]*tar.Header)
+}
+
+//------------------------------------------------------------------------------
+// target of the request: working dir, the given one or the parent of
+// the source, as archive entries start with the source name; parents of
+// the source are rebuilt in the dir for all paths
+func restoreTarget(request RestoreRequest, item PathItem, options Options) (*RestoreTarget, error) {
+	var dir = options.workingPath
+	switch {
+	case request.inPlace:
+		dir = filepath.Dir(item.path)
+	case len(request.dir) > 0:
+		dir = normalizePathNoCheck(request.dir)
+		if len(dir) == 0 {
+			return nil, fmt.Errorf("bad target dir %s", request.dir)
+		}
+	}
+	if request.all && !request.inPlace {
+		dir = filepath.Join(dir, filepath.Dir(item.path))
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	var target = newRestoreTarget(dir, request.conflict)
+	var err error
+	if target.include, err = includePatterns(request.include, item); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+//------------------------------------------------------------------------------
+// restores the paths one by one, a failed one does not stop the others;
+// false if any failed
+func restorePaths(ctx context.Context, paths []PathItem, request RestoreRequest,
+	options Options) bool {
+	var failed []string
+	for _, item := range paths {
+		if ctx.Err() != nil {
+			break
+		}
+		target, err := restoreTarget(request, item, options)
+		var version = request.version
+		if err == nil && request.pinned {
+			if len(item.versions) == 0 {
+				err = errors.New("no version is known")
+			} else {
+				version = item.versions[len(item.versions) - 1]
+			}
+		}
+		if err == nil {
+			log.Printf("restore path %s to %s\n", item.path, target.dir)
+			err = restoreArchive(ctx, item, version, target, options)
+		}
+		if err != nil {
+			log.Printf("restore of %s failed: %v\n", item.path, err)
+			failed = append(failed, item.path + ": " + err.Error())
+			continue
+		}
+		if len(target.include) > 0 && len(target.restored) == 0 {
+			log.Printf("no entries of %s match include patterns\n", item.path)
+		}
+		log.Printf("%s restored\n", item.path)
+	}
+	if len(paths) > 1 || len(failed) > 0 {
+		log.Printf("restored %d of %d paths\n", len(paths) - len(failed), len(paths))
+		for _, line := range failed {
+			log.Printf("  failed %s\n", line)
+		}
+	}
+	return len(failed) == 0
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// tar stream of the given entries, content of a regular file is its link name
+func craftTar(t *testing.T, headers []tar.Header) []byte {
+	var output bytes.Buffer
+	var writer = tar.NewWriter(&output)
+	for _, header := range headers {
+		var content string
+		if header.Typeflag == tar.TypeReg {
+			content, header.Linkname = header.Linkname, ""
+			header.Size = int64(len(content))
+		}
+		if header.Mode == 0 {
+			header.Mode = 0644
+		}
+		if err := writer.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		writer.Write([]byte(content))
+	}
+	writer.Close()
+	return output.Bytes()
+}
+
+//------------------------------------------------------------------------------
+func TestParseRestoreArgs(t *testing.T) {
+	var tests = []struct {
+		args    string
+		list    bool
+		request RestoreRequest
+		ok      bool
+	}{
+		{"/data", false, RestoreRequest{path: "/data", conflict: conflictOverwrite}, true},
+		{"/data v1 --to /tmp/x", false, RestoreRequest{path: "/data", version: "v1", dir: "/tmp/x",
+			conflict: conflictOverwrite}, true},
+		{"--in-place --conflict newer /data", false, RestoreRequest{path: "/data", inPlace: true,
+			conflict: conflictNewer}, true},
+		{"/data --conflict rename", false, RestoreRequest{path: "/data",
+			conflict: conflictRename}, true},
+		{"/data --include *.conf --include docs/**", false, RestoreRequest{path: "/data",
+			conflict: conflictOverwrite, include: []string{"*.conf", "docs/**"}}, true},
+		{"", false, RestoreRequest{}, false},
+		{"/data v1 v2", false, RestoreRequest{}, false},
+		{"/data --to", false, RestoreRequest{}, false},
+		{"/data --conflict merge", false, RestoreRequest{}, false},
+		{"/data --force", false, RestoreRequest{}, false},
+		{"/data --to /tmp/x --in-place", false, RestoreRequest{}, false},
+		{"/data --include", false, RestoreRequest{}, false},
+		{"/data --json", false, RestoreRequest{}, false},
+		// ls has no options of the target
+		{"/data v1 --json --include *.go", true, RestoreRequest{path: "/data", version: "v1",
+			conflict: conflictOverwrite, include: []string{"*.go"}, json: true}, true},
+		{"/data --to /tmp/x", true, RestoreRequest{}, false},
+		{"/data --in-place", true, RestoreRequest{}, false},
+		{"/data --conflict skip", true, RestoreRequest{}, false},
+		{"--all", false, RestoreRequest{all: true, conflict: conflictOverwrite}, true},
+		{"--all 20240510 --to /tmp/x", false, RestoreRequest{all: true, version: "20240510",
+			dir: "/tmp/x", conflict: conflictOverwrite}, true},
+		{"--all", true, RestoreRequest{}, false},
+		{"--all /data", false, RestoreRequest{}, false},
+		{"--all 20240510 20240511", false, RestoreRequest{}, false},
+	}
+	for _, test := range tests {
+		request, err := parseRestoreArgs(strings.Fields(test.args), test.list)
+		if (err == nil) != test.ok || test.ok && !reflect.DeepEqual(request, test.request) {
+			t.Errorf("%q: %+v, %v", test.args, request, err)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// existing entries under every conflict policy
+func TestPlace(t *testing.T) {
+	var old = time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		name     string
+		conflict string
+		header   tar.Header
+		// target relative to the dir, empty if skipped, "error" if failed
+		target   string
+	}{
+		{"new file", conflictSkip, tar.Header{Name: "data/new.txt", Typeflag: tar.TypeReg}, "data/new.txt"},
+		{"merged dir", conflictSkip, tar.Header{Name: "data/", Typeflag: tar.TypeDir}, "data"},
+		{"overwrite", conflictOverwrite, tar.Header{Name: "data/a.txt", Typeflag: tar.TypeReg},
+			"data/a.txt"},
+		{"skip", conflictSkip, tar.Header{Name: "data/a.txt", Typeflag: tar.TypeReg}, ""},
+		{"newer", conflictNewer, tar.Header{Name: "data/a.txt", Typeflag: tar.TypeReg,
+			ModTime: old.Add(time.Hour)}, "data/a.txt"},
+		{"older", conflictNewer, tar.Header{Name: "data/a.txt", Typeflag: tar.TypeReg,
+			ModTime: old.Add(-time.Hour)}, ""},
+		{"same time", conflictNewer, tar.Header{Name: "data/a.txt", Typeflag: tar.TypeReg,
+			ModTime: old}, ""},
+		{"no mtime", conflictNewer, tar.Header{Name: "data/a.txt", Typeflag: tar.TypeReg,
+			ModTime: time.Unix(0, 0)}, ""},
+		{"rename", conflictRename, tar.Header{Name: "data/a.txt", Typeflag: tar.TypeReg},
+			"data/a.txt.restored"},
+		{"rename again", conflictRename, tar.Header{Name: "data/b.txt", Typeflag: tar.TypeReg},
+			"data/b.txt.restored.2"},
+		{"file over dir", conflictOverwrite, tar.Header{Name: "data/sub", Typeflag: tar.TypeReg},
+			"error"},
+		{"dir over file", conflictOverwrite, tar.Header{Name: "data/a.txt/", Typeflag: tar.TypeDir},
+			"data/a.txt"},
+		{"unsafe", conflictOverwrite, tar.Header{Name: "../a.txt", Typeflag: tar.TypeReg}, "error"},
+	}
+	for _, test := range tests {
+		var dir = t.TempDir()
+		writeTree(t, dir, map[string]string{"data/a.txt": "a", "data/b.txt": "b",
+			"data/b.txt.restored": "b", "data/b.txt.restored.1": "b", "data/sub/": ""})
+		os.Chtimes(filepath.Join(dir, "data/a.txt"), old, old)
+		var target = newRestoreTarget(dir, test.conflict)
+		path, err := target.place(&test.header)
+		var result = path
+		if err != nil {
+			result = "error"
+		} else if len(path) > 0 {
+			result, _ = filepath.Rel(dir, path)
+		}
+		if result != test.target {
+			t.Errorf("%s: %q, %v", test.name, result, err)
+			continue
+		}
+		// replaced entry is removed, not written through
+		if test.conflict == conflictOverwrite && test.target == "data/a.txt" {
+			if _, err := os.Lstat(path); !os.IsNotExist(err) {
+				t.Errorf("%s: entry is not removed: %v", test.name, err)
+			}
+		}
+	}
+
+	// entries restored by this run are replaced whatever the policy is
+	var dir = t.TempDir()
+	writeTree(t, dir, map[string]string{"data/a.txt": "a"})
+	var target = newRestoreTarget(dir, conflictSkip)
+	var header = tar.Header{Name: "data/a.txt", Typeflag: tar.TypeReg}
+	target.restored[header.Name] = filepath.Join(dir, "data/a.txt")
+	if path, err := target.place(&header); err != nil || path != filepath.Join(dir, "data/a.txt") {
+		t.Fatalf("restored entry: %q, %v", path, err)
+	}
+}
+
+//------------------------------------------------------------------------------
+// conflict policy applies to a whole archive
+func TestExtractConflicts(t *testing.T) {
+	var archive = craftTar(t, []tar.Header{
+		{Name: "data/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "data/a.txt", Typeflag: tar.TypeReg, Linkname: "archive a"},
+		{Name: "data/b.txt", Typeflag: tar.TypeReg, Linkname: "archive b"},
+	})
+	var tests = []struct {
+		conflict string
+		tree     map[string]string
+	}{
+		{conflictOverwrite, map[string]string{"data/": "", "data/a.txt": "archive a",
+			"data/b.txt": "archive b"}},
+		{conflictSkip, map[string]string{"data/": "", "data/a.txt": "local a",
+			"data/b.txt": "archive b"}},
+		{conflictRename, map[string]string{"data/": "", "data/a.txt": "local a",
+			"data/a.txt.restored": "archive a", "data/b.txt": "archive b"}},
+	}
+	for _, test := range tests {
+		var dir = t.TempDir()
+		writeTree(t, dir, map[string]string{"data/a.txt": "local a"})
+		var target = newRestoreTarget(dir, test.conflict)
+		if err := extractTar(context.Background(), bytes.NewReader(archive), target); err != nil {
+			t.Fatalf("%s: %v", test.conflict, err)
+		}
+		checkTree(t, dir, test.tree)
+	}
+}
+
+//------------------------------------------------------------------------------
+// modes and mtimes of files and directories are restored,
+// directories get theirs after the content is in place
+func TestRestoreAttributes(t *testing.T) {
+	var source = filepath.Join(t.TempDir(), "data")
+	writeTree(t, source, map[string]string{"a.txt": "a", "run.sh": "#!/bin/sh", "sub/b.txt": "b"})
+	var date = time.Date(2020, 2, 29, 12, 30, 0, 0, time.UTC)
+	var modes = map[string]os.FileMode{"a.txt": 0640, "run.sh": 0755, "sub/b.txt": 0600,
+		"sub": 0750, ".": 0700}
+	for name, mode := range modes {
+		var fileName = filepath.Join(source, name)
+		os.Chmod(fileName, mode)
+		os.Chtimes(fileName, date, date)
+	}
+	var item = PathItem{path: source, compression: noCompression}
+	var archive bytes.Buffer
+	var ctx = context.Background()
+	if _, err := writeArchive(ctx, &item, Options{}, &archive); err != nil {
+		t.Fatal(err)
+	}
+	var dir = t.TempDir()
+	var target = newRestoreTarget(dir, conflictOverwrite)
+	var extract = func(reader io.Reader) error {
+		return extractTar(ctx, reader, target)
+	}
+	if err := readArchive(ctx, item, Options{}, bytes.NewReader(archive.Bytes()), extract); err != nil {
+		t.Fatal(err)
+	}
+	target.finish()
+	for name, mode := range modes {
+		fi, err := os.Stat(filepath.Join(dir, "data", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != mode || !fi.ModTime().Equal(date) {
+			t.Errorf("%s: %v %s", name, fi.Mode().Perm(), fi.ModTime())
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// entries leading out of the target are refused before anything is written
+func TestExtractCraftedTar(t *testing.T) {
+	var tests = []struct {
+		name    string
+		headers []tar.Header
+	}{
+		{"parent", []tar.Header{{Name: "../escape.txt", Typeflag: tar.TypeReg, Linkname: "e"}}},
+		{"parent inside", []tar.Header{{Name: "data/../../escape.txt", Typeflag: tar.TypeReg,
+			Linkname: "e"}}},
+		{"absolute", []tar.Header{{Name: "/escape.txt", Typeflag: tar.TypeReg, Linkname: "e"}}},
+		{"parent dir", []tar.Header{{Name: "../escape/", Typeflag: tar.TypeDir}}},
+		{"hard link out", []tar.Header{{Name: "data/link", Typeflag: tar.TypeLink,
+			Linkname: "../escape.txt"}}},
+	}
+	for _, test := range tests {
+		var parent = t.TempDir()
+		ioutil.WriteFile(filepath.Join(parent, "escape.txt"), []byte("outside"), 0600)
+		var dir = filepath.Join(parent, "target")
+		os.Mkdir(dir, 0700)
+		var target = newRestoreTarget(dir, conflictOverwrite)
+		var err = extractTar(context.Background(), bytes.NewReader(craftTar(t, test.headers)), target)
+		if err == nil || stageOf(err) != stageTar {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if data, _ := ioutil.ReadFile(filepath.Join(parent, "escape.txt")); string(data) != "outside" {
+			t.Errorf("%s: file out of target is changed", test.name)
+		}
+		if _, err = os.Stat(filepath.Join(parent, "escape")); !os.IsNotExist(err) {
+			t.Errorf("%s: dir out of target", test.name)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// names start with the source, patterns are relative to it
+func TestIncluded(t *testing.T) {
+	var tests = []struct {
+		include  string
+		name     string
+		included bool
+	}{
+		{"", "data/a.txt", true},
+		{"*.conf", "data/app.conf", true},
+		{"*.conf", "data/etc/deep/app.conf", true},
+		{"*.conf", "data/app.conf.bak", false},
+		{"*.conf", "data/", false},
+		// everything inside a selected directory
+		{"etc", "data/etc/", true},
+		{"etc", "data/etc/deep/a.txt", true},
+		{"etc", "data/etcetera/a.txt", false},
+		{"docs/*.md", "data/docs/a.md", true},
+		{"docs/*.md", "data/docs/sub/a.md", false},
+		{"docs/*.md", "data/other/docs/a.md", false},
+		{"docs/*.md", "data/docs/", false},
+		{"projects/foo/**", "data/projects/foo/", true},
+		{"projects/foo/**", "data/projects/foo/src/main.go", true},
+		{"projects/foo/**", "data/projects/foobar/main.go", false},
+		{"**/build/*.o", "data/build/a.o", true},
+		{"**/build/*.o", "data/x/y/build/a.o", true},
+		{"**/build/*.o", "data/x/build/sub/a.o", false},
+		{"a/**/z.txt", "data/a/z.txt", true},
+		{"a/**/z.txt", "data/a/b/c/z.txt", true},
+		{"a/**/z.txt", "data/b/z.txt", false},
+		{"*.md,*.txt", "data/a.txt", false},
+		{"*.md *.txt", "data/a.txt", true},
+	}
+	for _, test := range tests {
+		var target = newRestoreTarget(t.TempDir(), conflictOverwrite)
+		target.include = strings.Fields(test.include)
+		if included := target.included(test.name); included != test.included {
+			t.Errorf("%q %s: %v", test.include, test.name, included)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// parents of selected entries are restored with their attributes,
+// the other entries are not
+func TestExtractIncluded(t *testing.T) {
+	var date = time.Date(2020, 2, 29, 12, 30, 0, 0, time.UTC)
+	var archive = craftTar(t, []tar.Header{
+		{Name: "data/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: date},
+		{Name: "data/a.txt", Typeflag: tar.TypeReg, Linkname: "a"},
+		{Name: "data/etc/", Typeflag: tar.TypeDir, Mode: 0750, ModTime: date},
+		{Name: "data/etc/app.conf", Typeflag: tar.TypeReg, Linkname: "conf"},
+		{Name: "data/etc/link.conf", Typeflag: tar.TypeLink, Linkname: "data/a.txt"},
+		{Name: "data/docs/", Typeflag: tar.TypeDir},
+		{Name: "data/docs/b.md", Typeflag: tar.TypeReg, Linkname: "b"},
+	})
+	var dir = t.TempDir()
+	var target = newRestoreTarget(dir, conflictOverwrite)
+	target.include = []string{"*.conf"}
+	if err := extractTar(context.Background(), bytes.NewReader(archive), target); err != nil {
+		t.Fatal(err)
+	}
+	target.finish()
+	// hard link to the entry left out is skipped
+	checkTree(t, dir, map[string]string{"data/": "", "data/etc/": "", "data/etc/app.conf": "conf"})
+	fi, err := os.Stat(filepath.Join(dir, "data/etc"))
+	if err != nil || fi.Mode().Perm() != 0750 || !fi.ModTime().Equal(date) {
+		t.Fatalf("parent attributes: %v", err)
+	}
+}
+
+//------------------------------------------------------------------------------
+// every path is restored under its original parent in the target dir,
+// a failed one does not stop the others
+func TestRestorePaths(t *testing.T) {
+	var work = t.TempDir()
+	t.Chdir(work)
+	var sources = t.TempDir()
+	var docs, mail = filepath.Join(sources, "docs"), filepath.Join(sources, "mail")
+	writeTree(t, docs, map[string]string{"a.txt": "a"})
+	writeTree(t, mail, map[string]string{"inbox": "mail"})
+	var cloud = CloudLocal{t.TempDir()}
+	var options = Options{stateFile: filepath.Join(work, "state"), workingPath: work + "/"}
+	var paths []PathItem
+	for _, path := range []string{docs, mail} {
+		paths = append(paths, PathItem{path: path, pathHash: getStrHash(path), schedule: Once,
+			compression: noCompression, retention: Retention{last: 10}, cloud: cloud,
+			cloudPath: "backup/"})
+	}
+	var ctx = context.Background()
+	backupPaths(ctx, paths, options, nil)
+	// the source may be missing, e.g. on a new machine
+	var missing = filepath.Join(sources, "missing")
+	if path, err := sourcePath(missing); path != missing || err != nil {
+		t.Fatalf("missing path %q: %v", path, err)
+	}
+	paths = append(paths, PathItem{path: missing, pathHash: getStrHash(missing), cloud: cloud,
+		cloudPath: "backup/"})
+
+	var target = t.TempDir()
+	var request = RestoreRequest{all: true, dir: target, conflict: conflictOverwrite}
+	if restorePaths(ctx, paths, request, options) {
+		t.Fatal("path without archives is restored")
+	}
+	checkTree(t, filepath.Join(target, sources), map[string]string{"docs/": "", "docs/a.txt": "a",
+		"mail/": "", "mail/inbox": "mail"})
+	if !restorePaths(ctx, paths[:2], request, options) {
+		t.Fatal("restore failed")
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestCheckParents(t *testing.T) {
+	var dir = t.TempDir()
+	writeTree(t, dir, map[string]string{"data/sub/a.txt": "a"})
+	os.Symlink("/tmp", filepath.Join(dir, "data/link"))
+	os.Symlink("sub", filepath.Join(dir, "data/relative"))
+	var tests = []struct {
+		target string
+		ok     bool
+	}{
+		{"data", true},
+		{"data/a.txt", true},
+		{"data/sub/a.txt", true},
+		{"data/new/deep/a.txt", true},
+		// the link itself may be replaced, not written through
+		{"data/link", true},
+		{"data/link/a.txt", false},
+		{"data/link/new/a.txt", false},
+		{"data/relative/a.txt", false},
+	}
+	for _, test := range tests {
+		if err := checkParents(dir, filepath.Join(dir, test.target)); (err == nil) != test.ok {
+			t.Errorf("%s: %v", test.target, err)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// symlink restored from the archive is not followed by the entries after it,
+// OUTSIDE and RELATIVE in link names are a dir out of the target
+func TestExtractThroughSymlink(t *testing.T) {
+	var tests = []struct {
+		name    string
+		headers []tar.Header
+	}{
+		{"file", []tar.Header{
+			{Name: "data/link", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+			{Name: "data/link/escape.txt", Typeflag: tar.TypeReg, Linkname: "e"}}},
+		{"dir", []tar.Header{
+			{Name: "data/link", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+			{Name: "data/link/sub/", Typeflag: tar.TypeDir}}},
+		{"relative", []tar.Header{
+			{Name: "data/link", Typeflag: tar.TypeSymlink, Linkname: "RELATIVE"},
+			{Name: "data/link/escape.txt", Typeflag: tar.TypeReg, Linkname: "e"}}},
+		{"hard link", []tar.Header{
+			{Name: "data/link", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+			{Name: "data/hard", Typeflag: tar.TypeLink, Linkname: "data/link/secret.txt"}}},
+		{"replaced file", []tar.Header{
+			{Name: "data/sub/", Typeflag: tar.TypeDir},
+			{Name: "data/sub/escape.txt", Typeflag: tar.TypeReg, Linkname: "a"},
+			{Name: "data/sub", Typeflag: tar.TypeSymlink, Linkname: "OUTSIDE"},
+			{Name: "data/sub/escape.txt", Typeflag: tar.TypeReg, Linkname: "e"}}},
+	}
+	for _, test := range tests {
+		var outside = t.TempDir()
+		ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0600)
+		var dir = t.TempDir()
+		var headers = append([]tar.Header{}, test.headers...)
+		for index := range headers {
+			var relative, _ = filepath.Rel(filepath.Join(dir, "data"), outside)
+			headers[index].Linkname = strings.NewReplacer("OUTSIDE", outside,
+				"RELATIVE", relative).Replace(headers[index].Linkname)
+		}
+		var target = newRestoreTarget(dir, conflictOverwrite)
+		var err = extractTar(context.Background(), bytes.NewReader(craftTar(t, headers)), target)
+		if err == nil || stageOf(err) != stageTar {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		checkTree(t, outside, map[string]string{"secret.txt": "secret"})
+	}
+}
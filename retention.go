@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// archive names are <md5(path)>-<host id>-<UTC time>.bin,
+// incremental ones are <md5(path)>-<host id>-<UTC time>-delta.bin,
+// so hosts backing up the same path to one cloud dir keep their versions apart
+const versionTimeFormat = "20060102T150405Z"
+const deltaSuffix = "-delta"
+
+// how many versions to keep, a version is kept if any rule wants it
+type Retention struct {
+	last    int
+	daily   int
+	weekly  int
+	monthly int
+}
+
+// archive in the cloud, date is zero for the archive of old single copy format
+type ArchiveVersion struct {
+	name  string
+	date  time.Time
+	size  int64
+	// changes since the previous version only
+	delta bool
+	// index of chunks in repository
+	snapshot bool
+}
+
+//------------------------------------------------------------------------------
+func versionName(pathHash string, hostId string, date time.Time) string {
+	return pathHash + "-" + hostId + "-" + date.UTC().Format(versionTimeFormat) + ".bin"
+}
+
+//------------------------------------------------------------------------------
+func deltaVersionName(pathHash string, hostId string, date time.Time) string {
+	return pathHash + "-" + hostId + "-" + date.UTC().Format(versionTimeFormat) + deltaSuffix + ".bin"
+}
+
+//------------------------------------------------------------------------------
+func snapshotName(pathHash string, hostId string, date time.Time) string {
+	return snapshotDir + pathHash + "-" + hostId + "-" + date.UTC().Format(versionTimeFormat) + ".snap"
+}
+
+//------------------------------------------------------------------------------
+// snapshots are <snapshot dir>/<md5(path)>-<host id>-<UTC time>.snap,
+// versions of other hosts are not parsed
+func parseVersionName(pathHash string, hostId string, name string) (ArchiveVersion, bool) {
+	if name == pathHash + ".bin" {
+		return ArchiveVersion{name: name}, true
+	}
+	var base, extension = name, ".bin"
+	var snapshot = strings.HasPrefix(name, snapshotDir)
+	if snapshot {
+		base, extension = strings.TrimPrefix(name, snapshotDir), ".snap"
+	}
+	var prefix = pathHash + "-" + hostId + "-"
+	if !strings.HasPrefix(base, prefix) || !strings.HasSuffix(base, extension) {
+		return ArchiveVersion{}, false
+	}
+	var stamp = strings.TrimSuffix(strings.TrimPrefix(base, prefix), extension)
+	var delta = !snapshot && strings.HasSuffix(stamp, deltaSuffix)
+	if delta {
+		stamp = strings.TrimSuffix(stamp, deltaSuffix)
+	}
+	date, err := time.Parse(versionTimeFormat, stamp)
+	if err != nil {
+		return ArchiveVersion{}, false
+	}
+	return ArchiveVersion{name: name, date: date, delta: delta, snapshot: snapshot}, true
+}
+
+//------------------------------------------------------------------------------
+// keep-last=N, keep-daily=N, keep-weekly=N, keep-monthly=N,
+// false if the option is not a retention one
+func parseRetentionOption(retention *Retention, option string) (bool, error) {
+	var pair = strings.SplitN(option, "=", 2)
+	if len(pair) != 2 {
+		return false, nil
+	}
+	var target *int
+	switch strings.TrimSpace(pair[0]) {
+	case "keep-last":
+		target = &retention.last
+	case "keep-daily":
+		target = &retention.daily
+	case "keep-weekly":
+		target = &retention.weekly
+	case "keep-monthly":
+		target = &retention.monthly
+	default:
+		return false, nil
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(pair[1]))
+	if err != nil || n < 0 {
+		return true, fmt.Errorf("bad value of %s", option)
+	}
+	*target = n
+	return true, nil
+}
+
+//------------------------------------------------------------------------------
+// nothing configured means the only copy as before
+func loadRetention(values map[string]string) (Retention, error) {
+	var retention Retention
+	for _, key := range []string{"keep-last", "keep-daily", "keep-weekly", "keep-monthly"} {
+		if len(values[key]) == 0 {
+			continue
+		}
+		if _, err := parseRetentionOption(&retention, key + "=" + values[key]); err != nil {
+			return retention, err
+		}
+	}
+	if retention == (Retention{}) {
+		retention.last = 1
+	}
+	return retention, nil
+}
+
+//------------------------------------------------------------------------------
+// newest first
+func sortVersions(versions []ArchiveVersion) {
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].date.After(versions[j].date)
+	})
+}
+
+//------------------------------------------------------------------------------
+// the newest version of every period is kept for the given number of periods,
+// versions are sorted newest first
+func keptVersions(versions []ArchiveVersion, retention Retention) map[string]bool {
+	var kept = make(map[string]bool)
+	var rules = []struct {
+		count  int
+		period func(time.Time) string
+	}{
+		{retention.last, func(date time.Time) string { return date.String() }},
+		{retention.daily, func(date time.Time) string { return date.Format("2006-01-02") }},
+		{retention.weekly, func(date time.Time) string {
+			year, week := date.ISOWeek()
+			return fmt.Sprintf("%d-%d", year, week)
+		}},
+		{retention.monthly, func(date time.Time) string { return date.Format("2006-01") }},
+	}
+	for _, rule := range rules {
+		var periods = make(map[string]bool)
+		for _, version := range versions {
+			if len(periods) >= rule.count {
+				break
+			}
+			var period = rule.period(version.date.Local())
+			if !periods[period] {
+				periods[period] = true
+				kept[version.name] = true
+			}
+		}
+	}
+	// the last upload is never removed
+	if len(versions) > 0 {
+		kept[versions[0].name] = true
+	}
+	// delta is useless without the versions it is based on
+	for index, version := range versions {
+		if !kept[version.name] || !version.delta {
+			continue
+		}
+		for _, older := range versions[index + 1:] {
+			kept[older.name] = true
+			if !older.delta {
+				break
+			}
+		}
+	}
+	return kept
+}
+
+//------------------------------------------------------------------------------
+// archives to unpack one after another to get the version:
+// the full one and the deltas up to the version, versions are newest first
+func versionChain(versions []ArchiveVersion, target ArchiveVersion) ([]ArchiveVersion, error) {
+	var chain []ArchiveVersion
+	for index, version := range versions {
+		if version.name != target.name && len(chain) == 0 {
+			continue
+		}
+		chain = append([]ArchiveVersion{version}, chain...)
+		if !version.delta {
+			return chain, nil
+		}
+		if index == len(versions) - 1 {
+			break
+		}
+	}
+	if len(chain) == 0 {
+		// not listed, e.g. the archive of old format
+		return []ArchiveVersion{target}, nil
+	}
+	return nil, fmt.Errorf("no full backup before %s", target.name)
+}
+
+//------------------------------------------------------------------------------
+func listVersions(ctx context.Context, item PathItem, options Options) ([]ArchiveVersion, error) {
+	versions, _, err := listArchives(ctx, item, options)
+	return versions, err
+}
+
+//------------------------------------------------------------------------------
+// versions found in the cloud, or the ones from the state file if the cloud
+// cannot list files, and uploads left by killed runs;
+// both archives and repository snapshots are looked for
+func listArchives(ctx context.Context, item PathItem,
+	options Options) ([]ArchiveVersion, []string, error) {
+	var versions []ArchiveVersion
+	var parts []string
+	for _, dir := range []string{"", snapshotDir} {
+		files, err := item.cloud.list(ctx, item.cloudPath + dir)
+		switch {
+		case errors.Is(err, errUnsupported):
+			if len(dir) > 0 {
+				break
+			}
+			for _, name := range item.versions {
+				if version, ok := parseVersionName(item.pathHash, item.hostId, name); ok {
+					versions = append(versions, version)
+				}
+			}
+		case errors.Is(err, errNotFound):
+		case err != nil:
+			return nil, nil, err
+		default:
+			for _, file := range files {
+				var fileName = dir + file.name
+				var name = strings.TrimSuffix(fileName, ".part")
+				if _, ok := parseVersionName(item.pathHash, item.hostId, name); ok && name != fileName {
+					parts = append(parts, fileName)
+				}
+				if version, ok := parseVersionName(item.pathHash, item.hostId, fileName); ok && !file.dir {
+					version.size = file.size
+					versions = append(versions, version)
+				}
+			}
+		}
+	}
+	sortVersions(versions)
+	return versions, parts, nil
+}
+
+//------------------------------------------------------------------------------
+// version by time prefix (e.g. 20180519 is the last backup of that day),
+// the newest one if empty
+func findVersion(versions []ArchiveVersion, prefix string) (ArchiveVersion, bool) {
+	for _, version := range versions {
+		if strings.HasPrefix(version.date.UTC().Format(versionTimeFormat), prefix) ||
+			version.name == prefix {
+			return version, true
+		}
+	}
+	return ArchiveVersion{}, false
+}
+
+//------------------------------------------------------------------------------
+// removes versions not wanted by retention policy,
+// the state keeps what is left, oldest first
+func pruneVersions(ctx context.Context, item *PathItem, options Options) error {
+	versions, parts, err := listArchives(ctx, *item, options)
+	if err != nil {
+		return err
+	}
+	for _, part := range parts {
+		log.Printf("remove unfinished upload %s\n", part)
+		deleteArchive(ctx, *item, part, options)
+	}
+	var kept = keptVersions(versions, item.retention)
+	var pruned bool
+	var left []string
+	for index := len(versions) - 1; index >= 0; index-- {
+		var version = versions[index]
+		if kept[version.name] {
+			left = append(left, version.name)
+			continue
+		}
+		log.Printf("prune version %s\n", version.name)
+		err := item.cloud.delete(ctx, item.cloudPath + version.name)
+		if err != nil && !errors.Is(err, errNotFound) {
+			logCloudError(err)
+			log.Printf("remote delete failed %v\n", err)
+			left = append(left, version.name)
+		} else if version.snapshot {
+			pruned = true
+		}
+	}
+	item.versions = left
+	// chunks of removed snapshots may be not needed anymore
+	if pruned {
+		return collectGarbage(ctx, *item, options)
+	}
+	return nil
+}
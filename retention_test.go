@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+//------------------------------------------------------------------------------
+// versions of "2024-05-10 20" like local times, "+" marks a delta;
+// newest first as they are listed
+func testVersions(t *testing.T, dates ...string) []ArchiveVersion {
+	var versions []ArchiveVersion
+	for _, text := range dates {
+		var delta = strings.HasSuffix(text, "+")
+		date, err := time.ParseInLocation("2006-01-02 15", strings.TrimSuffix(text, "+"), time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var version = ArchiveVersion{name: versionName("hash", "host", date), date: date, delta: delta}
+		if delta {
+			version.name = deltaVersionName("hash", "host", date)
+		}
+		versions = append(versions, version)
+	}
+	sortVersions(versions)
+	return versions
+}
+
+//------------------------------------------------------------------------------
+// dates of versions in the format of testVersions
+func versionDates(versions []ArchiveVersion, kept map[string]bool) string {
+	var dates []string
+	for _, version := range versions {
+		if kept != nil && !kept[version.name] {
+			continue
+		}
+		var text = version.date.Format("2006-01-02 15")
+		if version.delta {
+			text += "+"
+		}
+		dates = append(dates, text)
+	}
+	return strings.Join(dates, ", ")
+}
+
+//------------------------------------------------------------------------------
+func TestKeptVersions(t *testing.T) {
+	var tests = []struct {
+		name      string
+		retention Retention
+		versions  []string
+		kept      string
+	}{
+		{"last", Retention{last: 3},
+			[]string{"2024-05-10 20", "2024-05-10 08", "2024-05-09 20", "2024-05-08 12"},
+			"2024-05-10 20, 2024-05-10 08, 2024-05-09 20"},
+		{"newest of a day", Retention{daily: 2},
+			[]string{"2024-05-10 20", "2024-05-10 08", "2024-05-09 20", "2024-05-09 08", "2024-05-08 12"},
+			"2024-05-10 20, 2024-05-09 20"},
+		{"days are counted, not skipped ones", Retention{daily: 2},
+			[]string{"2024-05-10 12", "2024-05-01 12", "2024-04-01 12"},
+			"2024-05-10 12, 2024-05-01 12"},
+		// iso weeks start on monday
+		{"weeks", Retention{weekly: 2},
+			[]string{"2024-01-08 12", "2024-01-07 12", "2024-01-05 12", "2024-01-01 12", "2023-12-31 12"},
+			"2024-01-08 12, 2024-01-07 12"},
+		{"week of the previous year", Retention{weekly: 3},
+			[]string{"2024-01-08 12", "2024-01-07 12", "2024-01-01 12", "2023-12-31 12", "2023-12-30 12"},
+			"2024-01-08 12, 2024-01-07 12, 2023-12-31 12"},
+		{"week 53 across new year", Retention{weekly: 2},
+			[]string{"2021-01-03 12", "2020-12-31 12", "2020-12-27 12"},
+			"2021-01-03 12, 2020-12-27 12"},
+		{"months", Retention{monthly: 3},
+			[]string{"2024-03-01 12", "2024-02-29 12", "2024-02-01 12", "2024-01-31 12", "2023-12-15 12"},
+			"2024-03-01 12, 2024-02-29 12, 2024-01-31 12"},
+		{"any rule keeps", Retention{last: 1, daily: 2, monthly: 2},
+			[]string{"2024-03-02 20", "2024-03-02 08", "2024-03-01 12", "2024-02-20 12", "2024-02-10 12"},
+			"2024-03-02 20, 2024-03-01 12, 2024-02-20 12"},
+		{"fewer versions than periods", Retention{daily: 10},
+			[]string{"2024-05-10 12", "2024-05-09 12", "2024-05-08 12"},
+			"2024-05-10 12, 2024-05-09 12, 2024-05-08 12"},
+		{"the last upload is kept", Retention{},
+			[]string{"2024-05-10 12", "2024-05-09 12"},
+			"2024-05-10 12"},
+		{"no versions", Retention{last: 1}, nil, ""},
+
+		// deltas need the full archive and the deltas between
+		{"delta of the last", Retention{last: 1},
+			[]string{"2024-05-05 12+", "2024-05-04 12", "2024-05-03 12+", "2024-05-02 12+", "2024-05-01 12"},
+			"2024-05-05 12+, 2024-05-04 12"},
+		{"chain of deltas", Retention{last: 1},
+			[]string{"2024-05-04 12+", "2024-05-03 12+", "2024-05-02 12+", "2024-05-01 12", "2024-04-30 12"},
+			"2024-05-04 12+, 2024-05-03 12+, 2024-05-02 12+, 2024-05-01 12"},
+		{"monthly delta", Retention{monthly: 3},
+			[]string{"2024-05-05 12+", "2024-04-20 12", "2024-04-10 12+", "2024-03-25 12+", "2024-03-20 12",
+				"2024-02-20 12"},
+			"2024-05-05 12+, 2024-04-20 12, 2024-03-25 12+, 2024-03-20 12"},
+		{"full archive of weekly delta", Retention{weekly: 2},
+			[]string{"2024-01-10 12+", "2024-01-08 12", "2024-01-07 12+", "2024-01-02 12+", "2023-12-30 12",
+				"2023-12-20 12"},
+			"2024-01-10 12+, 2024-01-08 12, 2024-01-07 12+, 2024-01-02 12+, 2023-12-30 12"},
+	}
+	for _, test := range tests {
+		var versions = testVersions(t, test.versions...)
+		var kept = keptVersions(versions, test.retention)
+		if dates := versionDates(versions, kept); dates != test.kept {
+			t.Errorf("%s: kept %s, expected %s", test.name, dates, test.kept)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestVersionChain(t *testing.T) {
+	var versions = testVersions(t, "2024-05-05 12+", "2024-05-04 12", "2024-05-03 12+",
+		"2024-05-02 12+", "2024-05-01 12", "2024-04-30 12+")
+	var tests = []struct {
+		target int
+		chain  string
+	}{
+		{0, "2024-05-04 12, 2024-05-05 12+"},
+		{1, "2024-05-04 12"},
+		{2, "2024-05-01 12, 2024-05-02 12+, 2024-05-03 12+"},
+		{4, "2024-05-01 12"},
+		{5, ""},
+	}
+	for _, test := range tests {
+		chain, err := versionChain(versions, versions[test.target])
+		var dates = versionDates(chain, nil)
+		if dates != test.chain || (err != nil) != (len(test.chain) == 0) {
+			t.Errorf("%d: %v %v, expected %s", test.target, dates, err, test.chain)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestParseVersionName(t *testing.T) {
+	var date = time.Date(2024, 5, 10, 20, 30, 0, 0, time.UTC)
+	var tests = []struct {
+		name     string
+		ok       bool
+		delta    bool
+		dated    bool
+		snapshot bool
+	}{
+		{versionName("hash", "host", date), true, false, true, false},
+		{deltaVersionName("hash", "host", date), true, true, true, false},
+		{snapshotName("hash", "host", date), true, false, true, true},
+		{"hash.bin", true, false, false, false},
+		{versionName("other", "host", date), false, false, false, false},
+		// versions of other hosts are not listed
+		{versionName("hash", "host2", date), false, false, false, false},
+		{snapshotName("hash", "host2", date), false, false, false, false},
+		{"hash-20240510T203000Z.bin", false, false, false, false},
+		{"hash-host-20240510.bin", false, false, false, false},
+		{versionName("hash", "host", date) + ".part", false, false, false, false},
+	}
+	for _, test := range tests {
+		version, ok := parseVersionName("hash", "host", test.name)
+		if ok != test.ok || version.delta != test.delta || version.snapshot != test.snapshot ||
+			ok && test.dated != version.date.Equal(date) || ok && version.name != test.name {
+			t.Errorf("%s: %+v %v", test.name, version, ok)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestLoadRetention(t *testing.T) {
+	var tests = []struct {
+		values    map[string]string
+		retention Retention
+		err       bool
+	}{
+		{map[string]string{}, Retention{last: 1}, false},
+		{map[string]string{"keep-daily": "7", "keep-monthly": " 12 "}, Retention{daily: 7, monthly: 12}, false},
+		{map[string]string{"keep-last": "0"}, Retention{last: 1}, false},
+		{map[string]string{"keep-weekly": "-1"}, Retention{}, true},
+		{map[string]string{"keep-last": "two"}, Retention{}, true},
+	}
+	for _, test := range tests {
+		retention, err := loadRetention(test.values)
+		if (err != nil) != test.err || !test.err && retention != test.retention {
+			t.Errorf("%v: %+v %v", test.values, retention, err)
+		}
+	}
+
+	var retention Retention
+	for _, option := range []string{"keep-last=2", "keep-weekly=4", "exclude:*.o", "every=1h"} {
+		if _, err := parseRetentionOption(&retention, option); err != nil {
+			t.Fatalf("%s: %v", option, err)
+		}
+	}
+	if retention != (Retention{last: 2, weekly: 4}) {
+		t.Fatalf("options: %+v", retention)
+	}
+	for _, option := range []string{"keep-weekly=-1", "keep-last=two"} {
+		if ok, err := parseRetentionOption(&retention, option); !ok || err == nil {
+			t.Errorf("%s is accepted", option)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestFindVersion(t *testing.T) {
+	var versions = testVersions(t, "2024-05-10 20", "2024-05-10 08", "2024-05-09 20")
+	var tests = []struct {
+		prefix string
+		found  string
+	}{
+		{"", versions[0].name},
+		{versions[1].date.UTC().Format("20060102T15"), versions[1].name},
+		{versions[2].name, versions[2].name},
+		{"2023", ""},
+	}
+	for _, test := range tests {
+		version, ok := findVersion(versions, test.prefix)
+		if ok != (len(test.found) > 0) || version.name != test.found {
+			t.Errorf("%q: %s %v", test.prefix, version.name, ok)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// versions of other paths are kept, the state has the ones left
+func TestPruneVersions(t *testing.T) {
+	var cloud = CloudLocal{t.TempDir()}
+	var ctx = context.Background()
+	var versions = testVersions(t, "2024-05-10 20", "2024-05-10 08", "2024-05-09 20", "2024-05-08 12")
+	var other = versionName("hash", "host2", time.Date(2024, 5, 7, 12, 0, 0, 0, time.UTC))
+	var names = []string{"other-host-20240510T080000Z.bin", "hash.bin", other}
+	for _, version := range versions {
+		names = append(names, version.name)
+	}
+	for _, name := range names {
+		if err := cloud.put(ctx, "backup/" + name, strings.NewReader(name), -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var item = PathItem{pathHash: "hash", hostId: "host", cloud: cloud, cloudPath: "backup/",
+		retention: Retention{daily: 2}}
+	if err := pruneVersions(ctx, &item, Options{}); err != nil {
+		t.Fatal(err)
+	}
+	var expected = []string{versions[2].name, versions[0].name}
+	if strings.Join(item.versions, " ") != strings.Join(expected, " ") {
+		t.Fatalf("left %v, expected %v", item.versions, expected)
+	}
+	// the old single copy is the oldest one, versions of other hosts are kept
+	expected = append(expected, other, "other-host-20240510T080000Z.bin")
+	if files := listRemote(t, cloud, "backup"); strings.Join(files, " ") != strings.Join(expected, " ") {
+		t.Fatalf("cloud has %v", files)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cron expression: minute hour day-of-month month day-of-week,
+// fields are bit sets of allowed values
+type CronSchedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+	// day matches if either day of month or day of week matches
+	// when both are restricted, as in cron
+	anyDay     bool
+	anyWeekday bool
+}
+
+var cronMacros = map[string]string{
+	"@hourly":  "0 * * * *",
+	"@daily":   "0 0 * * *",
+	"@weekly":  "0 0 * * 0",
+	"@monthly": "0 0 1 * *",
+	"@yearly":  "0 0 1 1 *",
+}
+
+var cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun",
+	"jul", "aug", "sep", "oct", "nov", "dec"}
+
+var cronWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+//------------------------------------------------------------------------------
+// e.g. 0 3 * * 1,4 or */15 8-18 * * mon-fri or @daily
+func parseCron(expression string) (*CronSchedule, error) {
+	if macro, ok := cronMacros[expression]; ok {
+		expression = macro
+	}
+	var fields = strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %s has not 5 fields", expression)
+	}
+	var schedule CronSchedule
+	var err error
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if schedule.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, err
+	}
+	// 7 is sunday as well
+	if schedule.weekdays, err = parseCronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return nil, err
+	}
+	if schedule.weekdays & (1 << 7) != 0 {
+		schedule.weekdays |= 1
+	}
+	schedule.anyDay = fields[2] == "*"
+	schedule.anyWeekday = fields[4] == "*"
+	return &schedule, nil
+}
+
+//------------------------------------------------------------------------------
+// list of values, ranges and steps: 1,4 or 1-5 or */2 or 8-18/2,
+// names are values from min
+func parseCronField(field string, min int, max int, names []string) (uint64, error) {
+	var value = func(text string) (int, error) {
+		for index, name := range names {
+			if strings.ToLower(text) == name {
+				return min + index, nil
+			}
+		}
+		n, err := strconv.Atoi(text)
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("bad value %s in cron field %s", text, field)
+		}
+		return n, nil
+	}
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		var step = 1
+		if index := strings.Index(part, "/"); index >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[index + 1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("bad step in cron field %s", field)
+			}
+			part = part[:index]
+		}
+		var first, last = min, max
+		if part != "*" {
+			var bounds = strings.SplitN(part, "-", 2)
+			var err error
+			if first, err = value(bounds[0]); err != nil {
+				return 0, err
+			}
+			last = first
+			if len(bounds) > 1 {
+				if last, err = value(bounds[1]); err != nil {
+					return 0, err
+				}
+			} else if step > 1 {
+				// 5/15 is the same as 5-max/15
+				last = max
+			}
+			if last < first {
+				return 0, fmt.Errorf("bad range in cron field %s", field)
+			}
+		}
+		for n := first; n <= last; n += step {
+			bits |= 1 << uint(n)
+		}
+	}
+	return bits, nil
+}
+
+//------------------------------------------------------------------------------
+func (this *CronSchedule) matchDay(date time.Time) bool {
+	if this.months & (1 << uint(date.Month())) == 0 {
+		return false
+	}
+	var day = this.days & (1 << uint(date.Day())) != 0
+	var weekday = this.weekdays & (1 << uint(date.Weekday())) != 0
+	if this.anyDay || this.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+//------------------------------------------------------------------------------
+// the first time of the schedule after the given one, zero if there is no
+// such time (e.g. 30th of february); wall clock is walked, so the time
+// skipped by DST is run at the shifted time and the repeated hour runs once
+func (this *CronSchedule) next(after time.Time) time.Time {
+	var location = after.Location()
+	// calendar days without DST
+	var year, month, day = after.Date()
+	var date = time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	for count := 0; count < 5 * 366; count, date = count + 1, date.AddDate(0, 0, 1) {
+		if !this.matchDay(date) {
+			continue
+		}
+		for hour := 0; hour < 24; hour++ {
+			if this.hours & (1 << uint(hour)) == 0 {
+				continue
+			}
+			for minute := 0; minute < 60; minute++ {
+				if this.minutes & (1 << uint(minute)) == 0 {
+					continue
+				}
+				var next = time.Date(date.Year(), date.Month(), date.Day(),
+					hour, minute, 0, 0, location)
+				if next.After(after) {
+					return next
+				}
+			}
+		}
+	}
+	return time.Time{}
+}
+
+//------------------------------------------------------------------------------
+// the last time of the schedule not after the given one, zero if there is
+// no such time for years
+func (this *CronSchedule) previous(before time.Time) time.Time {
+	var location = before.Location()
+	var year, month, day = before.Date()
+	var date = time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+	for count := 0; count < 5 * 366; count, date = count + 1, date.AddDate(0, 0, -1) {
+		if !this.matchDay(date) {
+			continue
+		}
+		for hour := 23; hour >= 0; hour-- {
+			if this.hours & (1 << uint(hour)) == 0 {
+				continue
+			}
+			for minute := 59; minute >= 0; minute-- {
+				if this.minutes & (1 << uint(minute)) == 0 {
+					continue
+				}
+				var previous = time.Date(date.Year(), date.Month(), date.Day(),
+					hour, minute, 0, 0, location)
+				if !previous.After(before) {
+					return previous
+				}
+			}
+		}
+	}
+	return time.Time{}
+}
+
+//------------------------------------------------------------------------------
+// dayly, weekly and monthly periods start at midnight of the days set by
+// weekly and monthly options, monday and the 1st if they are not set;
+// nil for once
+func periodSchedule(schedule int, options Options) *CronSchedule {
+	var cron = CronSchedule{minutes: 1, hours: 1, months: 0x1ffe,
+		days: 0xfffffffe, weekdays: 0x7f, anyDay: true, anyWeekday: true}
+	switch schedule {
+	case Dayly:
+	case Weekly:
+		cron.weekdays, cron.anyWeekday = 1 << uint(time.Monday), false
+		if len(options.weeklyDays) > 0 {
+			cron.weekdays = 0
+			for _, day := range options.weeklyDays {
+				cron.weekdays |= 1 << uint(day)
+			}
+		}
+	case Monthly:
+		cron.days, cron.anyDay = 1 << 1, false
+		if len(options.monthlyDays) > 0 {
+			cron.days = 0
+			for _, day := range options.monthlyDays {
+				if day >= 1 && day <= 31 {
+					cron.days |= 1 << uint(day)
+				}
+			}
+		}
+	default:
+		return nil
+	}
+	return &cron
+}
+
+//------------------------------------------------------------------------------
+// time.ParseDuration format, d is a day: 6h, 30m, 2d
+func parseInterval(value string) (time.Duration, error) {
+	var interval time.Duration
+	var err error
+	if strings.HasSuffix(value, "d") {
+		var days int
+		days, err = strconv.Atoi(strings.TrimSuffix(value, "d"))
+		interval = time.Duration(days) * 24 * time.Hour
+	} else {
+		interval, err = time.ParseDuration(value)
+	}
+	if err != nil || interval <= 0 {
+		return 0, fmt.Errorf("bad interval %s", value)
+	}
+	return interval, nil
+}
+
+//------------------------------------------------------------------------------
+// time the path is to be backed up at, in the past if it is due, zero if
+// never: the last scheduled time if the last successful backup is older
+// than that, so a backup missed while the machine was off is made on the
+// next start unless it is late for more than max-delay
+func nextBackup(item *PathItem, current time.Time, options Options) time.Time {
+	if item.date.IsZero() {
+		return current
+	}
+	if item.every > 0 {
+		return item.date.Add(item.every)
+	}
+	var schedule = item.cron
+	if schedule == nil {
+		if schedule = periodSchedule(item.schedule, options); schedule == nil {
+			return time.Time{}
+		}
+	}
+	var due = schedule.previous(current)
+	if !due.IsZero() && item.date.Before(due) &&
+		(item.maxDelay == 0 || current.Sub(due) <= item.maxDelay) {
+		return due
+	}
+	return schedule.next(current)
+}
+
+//------------------------------------------------------------------------------
+func isDue(item *PathItem, current time.Time, options Options) bool {
+	var next = nextBackup(item, current, options)
+	if !next.IsZero() && !next.After(current) {
+		return true
+	}
+	if item.maxDelay > 0 {
+		var unlimited = *item
+		unlimited.maxDelay = 0
+		if due := nextBackup(&unlimited, current, options); !due.IsZero() && !due.After(current) {
+			log.Printf("backup due at %s is late for more than %s, wait for the next one\n",
+				due.Format("2006-01-02 15:04"), item.maxDelay)
+		}
+	}
+	return false
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+//------------------------------------------------------------------------------
+func parseTestTime(t *testing.T, text string, location *time.Location) time.Time {
+	t.Helper()
+	date, err := time.ParseInLocation("2006-01-02 15:04", text, location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return date
+}
+
+//------------------------------------------------------------------------------
+func TestParseCron(t *testing.T) {
+	var tests = []struct {
+		expression string
+		ok         bool
+	}{
+		{"0 3 * * 1,4", true},
+		{"*/15 8-18 * * mon-fri", true},
+		{"5/15 * * * *", true},
+		{"0 0 1-7 * 1", true},
+		{"0 12 * jan,JUL *", true},
+		{"0 0 * * 7", true},
+		{"@daily", true},
+		{"@yearly", true},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"0 0 0 * *", false},
+		{"0 0 32 * *", false},
+		{"0 0 * 13 *", false},
+		{"0 0 * * 8", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"0 0 * foo *", false},
+		{"* * * *", false},
+		{"@never", false},
+	}
+	for _, test := range tests {
+		if _, err := parseCron(test.expression); (err == nil) != test.ok {
+			t.Errorf("%s: %v", test.expression, err)
+		}
+	}
+
+	schedule, _ := parseCron("5/15 1-9/4 * * sun,7")
+	if schedule.minutes != 1 << 5 | 1 << 20 | 1 << 35 | 1 << 50 ||
+		schedule.hours != 1 << 1 | 1 << 5 | 1 << 9 || schedule.weekdays & 1 == 0 ||
+		!schedule.anyDay || schedule.anyWeekday {
+		t.Fatalf("fields: %+v", schedule)
+	}
+}
+
+//------------------------------------------------------------------------------
+// the next time after the given one, in UTC
+func TestCronNext(t *testing.T) {
+	var tests = []struct {
+		name       string
+		expression string
+		after      string
+		next       string
+	}{
+		{"later today", "0 3 * * *", "2024-05-10 02:59", "2024-05-10 03:00"},
+		{"not the same time", "0 3 * * *", "2024-05-10 03:00", "2024-05-11 03:00"},
+		{"steps", "*/15 8-18 * * mon-fri", "2024-05-10 18:45", "2024-05-13 08:00"},
+		{"end of month", "30 23 31 * *", "2024-04-01 00:00", "2024-05-31 23:30"},
+		{"leap day", "0 0 29 2 *", "2025-01-01 00:00", "2028-02-29 00:00"},
+		{"month names", "0 12 * jan,jul *", "2024-01-31 12:00", "2024-07-01 12:00"},
+		{"sunday as 7", "0 0 * * 7", "2024-05-10 00:00", "2024-05-12 00:00"},
+		// day of month or day of week when both are restricted
+		{"friday before the 13th", "0 0 13 * fri", "2024-11-01 12:00", "2024-11-08 00:00"},
+		{"the 13th before friday", "0 0 13 * fri", "2024-11-09 00:00", "2024-11-13 00:00"},
+		{"first week or mondays", "0 0 1-7 * 1", "2024-05-07 12:00", "2024-05-13 00:00"},
+		// and when one is *
+		{"only the 13th", "0 0 13 * *", "2024-11-01 12:00", "2024-11-13 00:00"},
+		{"only fridays", "0 0 * * fri", "2024-11-09 00:00", "2024-11-15 00:00"},
+		{"restricted month", "0 0 13 6 fri", "2024-05-01 00:00", "2024-06-07 00:00"},
+		{"never", "0 0 30 2 *", "2024-01-01 00:00", ""},
+	}
+	for _, test := range tests {
+		schedule, err := parseCron(test.expression)
+		if err != nil {
+			t.Fatalf("%s: %v", test.expression, err)
+		}
+		var next = schedule.next(parseTestTime(t, test.after, time.UTC))
+		var text string
+		if !next.IsZero() {
+			text = next.Format("2006-01-02 15:04")
+		}
+		if text != test.next {
+			t.Errorf("%s: %s after %s is %q, expected %q", test.name, test.expression,
+				test.after, text, test.next)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestCronPrevious(t *testing.T) {
+	var tests = []struct {
+		expression string
+		before     string
+		previous   string
+	}{
+		{"0 3 * * *", "2024-05-10 03:00", "2024-05-10 03:00"},
+		{"0 3 * * *", "2024-05-10 02:59", "2024-05-09 03:00"},
+		{"0 0 13 * fri", "2024-11-12 00:00", "2024-11-08 00:00"},
+		{"0 0 1 1 *", "2024-05-10 00:00", "2024-01-01 00:00"},
+		{"0 0 30 2 *", "2024-05-10 00:00", ""},
+	}
+	for _, test := range tests {
+		schedule, _ := parseCron(test.expression)
+		var previous = schedule.previous(parseTestTime(t, test.before, time.UTC))
+		var text string
+		if !previous.IsZero() {
+			text = previous.Format("2006-01-02 15:04")
+		}
+		if text != test.previous {
+			t.Errorf("%s before %s is %q, expected %q", test.expression, test.before, text, test.previous)
+		}
+	}
+}
+
+//------------------------------------------------------------------------------
+// runs of the schedule from the time on, in the location of the time
+func cronRuns(schedule *CronSchedule, from time.Time, count int) []string {
+	var runs []string
+	for date := from; len(runs) < count; {
+		date = schedule.next(date)
+		runs = append(runs, date.Format("2006-01-02 15:04 MST"))
+	}
+	return runs
+}
+
+//------------------------------------------------------------------------------
+// wall clock is walked: time skipped by DST is run at the shifted time,
+// the repeated hour runs once
+func TestCronDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name       string
+		expression string
+		from       string
+		runs       []string
+	}{
+		{"skipped time", "30 2 * * *", "2024-03-30 12:00",
+			[]string{"2024-03-31 03:30 CEST", "2024-04-01 02:30 CEST"}},
+		{"hourly over the gap", "0 * * * *", "2024-03-31 00:30",
+			[]string{"2024-03-31 01:00 CET", "2024-03-31 03:00 CEST", "2024-03-31 04:00 CEST"}},
+		{"repeated time", "30 2 * * *", "2024-10-26 12:00",
+			[]string{"2024-10-27 02:30 CET", "2024-10-28 02:30 CET"}},
+		{"hourly over the repeated hour", "0 * * * *", "2024-10-27 00:30",
+			[]string{"2024-10-27 01:00 CEST", "2024-10-27 02:00 CET", "2024-10-27 03:00 CET"}},
+		{"daily at midnight", "@daily", "2024-03-30 12:00",
+			[]string{"2024-03-31 00:00 CET", "2024-04-01 00:00 CEST"}},
+	}
+	for _, test := range tests {
+		schedule, _ := parseCron(test.expression)
+		var runs = cronRuns(schedule, parseTestTime(t, test.from, berlin), len(test.runs))
+		for index := range runs {
+			if runs[index] != test.runs[index] {
+				t.Errorf("%s: %v, expected %v", test.name, runs, test.runs)
+				break
+			}
+		}
+	}
+
+	// the day of the fall back is 25 hours long, the next day is not
+	schedule, _ := parseCron("0 0 * * *")
+	var start = parseTestTime(t, "2024-10-26 12:00", berlin)
+	var first = schedule.next(start)
+	var second = schedule.next(first)
+	var third = schedule.next(second)
+	if second.Sub(first) != 25 * time.Hour || third.Sub(second) != 24 * time.Hour {
+		t.Fatalf("days of %s %s %s", first, second, third)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestPeriodSchedule(t *testing.T) {
+	var options = Options{weeklyDays: []int{int(time.Friday)}, monthlyDays: []int{15, 40}}
+	var tests = []struct {
+		schedule int
+		options  Options
+		after    string
+		next     string
+	}{
+		{Dayly, Options{}, "2024-05-10 12:00", "2024-05-11 00:00"},
+		{Weekly, Options{}, "2024-05-10 12:00", "2024-05-13 00:00"},
+		{Weekly, options, "2024-05-10 12:00", "2024-05-17 00:00"},
+		{Monthly, Options{}, "2024-05-10 12:00", "2024-06-01 00:00"},
+		{Monthly, options, "2024-05-10 12:00", "2024-05-15 00:00"},
+	}
+	for _, test := range tests {
+		var next = periodSchedule(test.schedule, test.options).next(parseTestTime(t, test.after, time.UTC))
+		if text := next.Format("2006-01-02 15:04"); text != test.next {
+			t.Errorf("%d: %s, expected %s", test.schedule, text, test.next)
+		}
+	}
+	if periodSchedule(Once, options) != nil {
+		t.Fatal("once has a schedule")
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestIsDue(t *testing.T) {
+	var cron, _ = parseCron("0 3 * * *")
+	var options = Options{weeklyDays: []int{int(time.Friday)}}
+	var tests = []struct {
+		name    string
+		item    PathItem
+		date    string
+		current string
+		due     bool
+	}{
+		{"never backed up", PathItem{schedule: Once}, "", "2024-05-10 12:00", true},
+		{"once", PathItem{schedule: Once}, "2024-01-01 00:00", "2024-05-10 12:00", false},
+		{"interval not passed", PathItem{every: 6 * time.Hour}, "2024-05-10 07:00", "2024-05-10 12:00", false},
+		{"interval passed", PathItem{every: 6 * time.Hour}, "2024-05-10 06:00", "2024-05-10 12:00", true},
+		{"made today", PathItem{schedule: Dayly}, "2024-05-10 00:30", "2024-05-10 23:59", false},
+		{"made yesterday", PathItem{schedule: Dayly}, "2024-05-09 23:00", "2024-05-10 08:00", true},
+		{"week not started", PathItem{schedule: Weekly}, "2024-05-03 01:00", "2024-05-09 23:00", false},
+		{"week started", PathItem{schedule: Weekly}, "2024-05-03 01:00", "2024-05-10 00:00", true},
+		{"scheduled time", PathItem{cron: cron}, "2024-05-09 03:00", "2024-05-10 03:00", true},
+		{"before scheduled time", PathItem{cron: cron}, "2024-05-09 03:00", "2024-05-10 02:59", false},
+		// backup missed while the machine was off
+		{"catch up", PathItem{cron: cron}, "2024-05-07 03:05", "2024-05-10 10:00", true},
+		{"catch up in time", PathItem{cron: cron, maxDelay: 8 * time.Hour},
+			"2024-05-07 03:05", "2024-05-10 10:00", true},
+		{"too late to catch up", PathItem{cron: cron, maxDelay: 6 * time.Hour},
+			"2024-05-07 03:05", "2024-05-10 10:00", false},
+		{"next run after the late one", PathItem{cron: cron, maxDelay: 6 * time.Hour},
+			"2024-05-07 03:05", "2024-05-11 03:00", true},
+		{"delay is no interval", PathItem{cron: cron, maxDelay: 6 * time.Hour},
+			"2024-05-10 03:00", "2024-05-10 08:00", false},
+	}
+	for _, test := range tests {
+		var item = test.item
+		if len(test.date) > 0 {
+			item.date = parseTestTime(t, test.date, time.UTC)
+		}
+		if due := isDue(&item, parseTestTime(t, test.current, time.UTC), options); due != test.due {
+			t.Errorf("%s: due is %v", test.name, due)
+		}
+	}
+
+	// the late backup waits for the next scheduled time
+	var item = PathItem{cron: cron, maxDelay: 6 * time.Hour,
+		date: parseTestTime(t, "2024-05-07 03:05", time.UTC)}
+	var next = nextBackup(&item, parseTestTime(t, "2024-05-10 10:00", time.UTC), options)
+	if text := next.Format("2006-01-02 15:04"); text != "2024-05-11 03:00" {
+		t.Fatalf("next backup at %s", text)
+	}
+}
+
+//------------------------------------------------------------------------------
+func TestParseInterval(t *testing.T) {
+	var tests = []struct {
+		value    string
+		interval time.Duration
+	}{
+		{"6h", 6 * time.Hour},
+		{"30m", 30 * time.Minute},
+		{"2d", 48 * time.Hour},
+		{"0h", 0},
+		{"-1h", 0},
+		{"d", 0},
+		{"week", 0},
+	}
+	for _, test := range tests {
+		interval, err := parseInterval(test.value)
+		if interval != test.interval || (err == nil) != (test.interval > 0) {
+			t.Errorf("%s: %s %v", test.value, interval, err)
+		}
+	}
+}